@@ -0,0 +1,367 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2021 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// Subject where all servers receive requests of the admin API.
+	adminSubject = "hub.admin"
+)
+
+var (
+	// Time to wait for other servers to answer requests of the admin API.
+	adminTimeout = 500 * time.Millisecond
+)
+
+func (h *Hub) getLocalAdminRooms() []*AdminRoomEntry {
+	h.ru.RLock()
+	rooms := make([]*Room, 0, len(h.rooms))
+	for _, room := range h.rooms {
+		rooms = append(rooms, room)
+	}
+	h.ru.RUnlock()
+
+	result := make([]*AdminRoomEntry, 0, len(rooms))
+	for _, room := range rooms {
+		result = append(result, &AdminRoomEntry{
+			RoomId:   room.Id(),
+			Backend:  room.Backend().Id(),
+			Sessions: room.GetLocalRosterEntries(),
+		})
+	}
+	return result
+}
+
+func (s *ClientSession) getAdminMcuEntries() ([]*AdminPublisherEntry, []*AdminSubscriberEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var publishers []*AdminPublisherEntry
+	for _, publisher := range s.publishers {
+		publishers = append(publishers, &AdminPublisherEntry{
+			Id:         publisher.Id(),
+			StreamType: publisher.StreamType(),
+		})
+	}
+	sort.Slice(publishers, func(i, j int) bool {
+		return publishers[i].StreamType < publishers[j].StreamType
+	})
+
+	var subscribers []*AdminSubscriberEntry
+	for _, subscriber := range s.subscribers {
+		subscribers = append(subscribers, &AdminSubscriberEntry{
+			Id:         subscriber.Id(),
+			Publisher:  subscriber.Publisher(),
+			StreamType: subscriber.StreamType(),
+		})
+	}
+	sort.Slice(subscribers, func(i, j int) bool {
+		if subscribers[i].Publisher != subscribers[j].Publisher {
+			return subscribers[i].Publisher < subscribers[j].Publisher
+		}
+		return subscribers[i].StreamType < subscribers[j].StreamType
+	})
+	return publishers, subscribers
+}
+
+func (h *Hub) getLocalAdminSession(sessionId string) *AdminSessionEntry {
+	session := h.GetSessionByPublicId(sessionId)
+	if session == nil {
+		return nil
+	}
+
+	entry := &AdminSessionEntry{
+		SessionId:  session.PublicId(),
+		ServerId:   h.serverId,
+		Backend:    session.Backend().Id(),
+		ClientType: session.ClientType(),
+		UserId:     session.UserId(),
+	}
+	if room := session.GetRoom(); room != nil {
+		entry.RoomId = room.Id()
+	}
+	switch sess := session.(type) {
+	case *ClientSession:
+		entry.Connected = sess.GetClient() != nil
+		entry.RoomSessionId = sess.RoomSessionId()
+		entry.Publishers, entry.Subscribers = sess.getAdminMcuEntries()
+	case *VirtualSession:
+		entry.Connected = sess.Session().GetClient() != nil
+	}
+	return entry
+}
+
+func (h *Hub) closeLocalSession(sessionId string) bool {
+	session := h.GetSessionByPublicId(sessionId)
+	if session == nil {
+		return false
+	}
+
+	log.Printf("Closing session %s through admin API", session.PublicId())
+	switch sess := session.(type) {
+	case *ClientSession:
+		// Same as if the client had sent a "bye" message.
+		if client := sess.GetClient(); client != nil {
+			client.SendByeResponseWithReason(nil, "session_closed")
+			h.processUnregister(client)
+		}
+	case *VirtualSession:
+		h.mu.Lock()
+		delete(h.virtualSessions, GetVirtualSessionId(sess.Session(), sess.SessionId()))
+		h.mu.Unlock()
+	}
+	session.Close()
+	return true
+}
+
+func (h *Hub) announceAdminServer(active bool, sync bool) {
+	msg := &NatsMessage{
+		SendTime: time.Now(),
+		Type:     "admin",
+		Admin: &NatsAdminRequest{
+			Type:     "announce",
+			Active:   active,
+			Sync:     sync,
+			ServerId: h.serverId,
+		},
+	}
+	if err := h.nats.PublishNats(adminSubject, msg); err != nil {
+		log.Printf("Could not announce server for admin requests: %s", err)
+	}
+}
+
+func (h *Hub) processAdminAnnounce(request *NatsAdminRequest) {
+	h.remoteServersLock.Lock()
+	if request.Active {
+		h.remoteServers[request.ServerId] = true
+	} else {
+		delete(h.remoteServers, request.ServerId)
+	}
+	h.remoteServersLock.Unlock()
+
+	if request.Sync {
+		h.announceAdminServer(true, false)
+	}
+}
+
+func (h *Hub) getRemoteServers() map[string]bool {
+	h.remoteServersLock.Lock()
+	defer h.remoteServersLock.Unlock()
+
+	result := make(map[string]bool, len(h.remoteServers))
+	for serverId := range h.remoteServers {
+		result[serverId] = true
+	}
+	return result
+}
+
+func (h *Hub) processAdminRequest(request *NatsAdminRequest) {
+	// Always respond (even if nothing was found) so the requesting server
+	// doesn't have to wait for the timeout.
+	response := &NatsAdminResponse{
+		ServerId: h.serverId,
+	}
+	switch request.Type {
+	case "rooms":
+		response.Rooms = h.getLocalAdminRooms()
+	case "session":
+		response.Session = h.getLocalAdminSession(request.SessionId)
+	case "closesession":
+		response.Closed = h.closeLocalSession(request.SessionId)
+	default:
+		log.Printf("Unsupported admin request with type %s: %+v", request.Type, request)
+		return
+	}
+
+	msg := &NatsMessage{
+		SendTime:      time.Now(),
+		Type:          "adminresponse",
+		AdminResponse: response,
+	}
+	if err := h.nats.PublishNats(request.ReplyTo, msg); err != nil {
+		log.Printf("Could not send admin response to %s: %s", request.ReplyTo, err)
+	}
+}
+
+// requestAdmin sends a request of the admin API to the other servers and
+// passes the responses to the callback until it returns false, all known
+// servers have responded or the timeout expired.
+func (h *Hub) requestAdmin(request *NatsAdminRequest, callback func(response *NatsAdminResponse) bool) error {
+	pending := h.getRemoteServers()
+	if len(pending) == 0 {
+		// No other servers in the cluster.
+		return nil
+	}
+
+	receiver := make(chan *nats.Msg, 64)
+	replyTo := adminSubject + ".reply." + newRandomString(32)
+	subscription, err := h.nats.Subscribe(replyTo, receiver)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := subscription.Unsubscribe(); err != nil {
+			log.Printf("Error closing admin subscription %s: %s", replyTo, err)
+		}
+	}()
+
+	request.ReplyTo = replyTo
+	request.ServerId = h.serverId
+	msg := &NatsMessage{
+		SendTime: time.Now(),
+		Type:     "admin",
+		Admin:    request,
+	}
+	if err := h.nats.PublishNats(adminSubject, msg); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(adminTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case message := <-receiver:
+			var msg NatsMessage
+			if err := h.nats.Decode(message, &msg); err != nil {
+				log.Printf("Could not decode admin response %+v: %s", message, err)
+				continue
+			} else if msg.Type != "adminresponse" || msg.AdminResponse == nil {
+				log.Printf("Invalid admin response %+v", msg)
+				continue
+			}
+
+			if !callback(msg.AdminResponse) {
+				return nil
+			}
+
+			delete(pending, msg.AdminResponse.ServerId)
+			if len(pending) == 0 {
+				return nil
+			}
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
+// GetAdminRooms returns the rooms with their sessions on all servers.
+func (h *Hub) GetAdminRooms() ([]*AdminRoomEntry, error) {
+	rooms := make(map[string]*AdminRoomEntry)
+	sessions := make(map[string]bool)
+	addRooms := func(entries []*AdminRoomEntry) {
+		for _, entry := range entries {
+			key := entry.Backend + "|" + entry.RoomId
+			room, found := rooms[key]
+			if !found {
+				room = &AdminRoomEntry{
+					RoomId:  entry.RoomId,
+					Backend: entry.Backend,
+				}
+				rooms[key] = room
+			}
+
+			for _, session := range entry.Sessions {
+				if sessions[session.SessionId] {
+					continue
+				}
+
+				sessions[session.SessionId] = true
+				room.Sessions = append(room.Sessions, session)
+			}
+		}
+	}
+
+	addRooms(h.getLocalAdminRooms())
+	if err := h.requestAdmin(&NatsAdminRequest{
+		Type: "rooms",
+	}, func(response *NatsAdminResponse) bool {
+		addRooms(response.Rooms)
+		// Wait for the responses of all servers.
+		return true
+	}); err != nil {
+		return nil, err
+	}
+
+	result := make([]*AdminRoomEntry, 0, len(rooms))
+	for _, room := range rooms {
+		sort.Slice(room.Sessions, func(i, j int) bool {
+			return room.Sessions[i].SessionId < room.Sessions[j].SessionId
+		})
+		result = append(result, room)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].RoomId != result[j].RoomId {
+			return result[i].RoomId < result[j].RoomId
+		}
+		return result[i].Backend < result[j].Backend
+	})
+	return result, nil
+}
+
+// GetAdminSession returns the session with the given public id from any
+// server, or "nil" if no such session exists.
+func (h *Hub) GetAdminSession(sessionId string) (*AdminSessionEntry, error) {
+	if entry := h.getLocalAdminSession(sessionId); entry != nil {
+		return entry, nil
+	}
+
+	var entry *AdminSessionEntry
+	if err := h.requestAdmin(&NatsAdminRequest{
+		Type:      "session",
+		SessionId: sessionId,
+	}, func(response *NatsAdminResponse) bool {
+		entry = response.Session
+		return entry == nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// CloseAdminSession closes the session with the given public id on any
+// server. Returns false if no such session exists.
+func (h *Hub) CloseAdminSession(sessionId string) (bool, error) {
+	if h.closeLocalSession(sessionId) {
+		return true, nil
+	}
+
+	closed := false
+	if err := h.requestAdmin(&NatsAdminRequest{
+		Type:      "closesession",
+		SessionId: sessionId,
+	}, func(response *NatsAdminResponse) bool {
+		closed = response.Closed
+		return !closed
+	}); err != nil {
+		return false, err
+	}
+
+	return closed, nil
+}
@@ -0,0 +1,61 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2021 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+// Responses of the admin API of the signaling server.
+
+type AdminRoomEntry struct {
+	RoomId   string                `json:"roomid"`
+	Backend  string                `json:"backend"`
+	Sessions []*RosterSessionEntry `json:"sessions"`
+}
+
+type AdminRoomsResponse struct {
+	Rooms []*AdminRoomEntry `json:"rooms"`
+}
+
+type AdminPublisherEntry struct {
+	Id         string `json:"id"`
+	StreamType string `json:"streamtype"`
+}
+
+type AdminSubscriberEntry struct {
+	Id         string `json:"id"`
+	Publisher  string `json:"publisher"`
+	StreamType string `json:"streamtype"`
+}
+
+type AdminSessionEntry struct {
+	SessionId  string `json:"sessionid"`
+	ServerId   string `json:"serverid"`
+	Backend    string `json:"backend"`
+	ClientType string `json:"clienttype"`
+	UserId     string `json:"userid,omitempty"`
+	// The session has a client connected to it.
+	Connected bool `json:"connected"`
+
+	RoomId        string `json:"roomid,omitempty"`
+	RoomSessionId string `json:"roomsessionid,omitempty"`
+
+	Publishers  []*AdminPublisherEntry  `json:"publishers,omitempty"`
+	Subscribers []*AdminSubscriberEntry `json:"subscribers,omitempty"`
+}
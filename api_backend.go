@@ -94,10 +94,150 @@ type BackendServerRoomRequest struct {
 
 	Message *BackendRoomMessageRequest `json:"message,omitempty"`
 
+	SwitchTo *BackendRoomSwitchToRequest `json:"switchto,omitempty"`
+
+	Recording *BackendRoomRecordingRequest `json:"recording,omitempty"`
+
+	Permissions *BackendRoomPermissionsRequest `json:"permissions,omitempty"`
+
 	// Internal properties
 	ReceivedTime int64 `json:"received,omitempty"`
 }
 
+func (r *BackendServerRoomRequest) CheckValid() error {
+	switch r.Type {
+	case "":
+		return NewBackendMissingFieldError("type")
+	case "invite":
+		if r.Invite == nil {
+			return NewBackendMissingFieldError("invite")
+		}
+	case "disinvite":
+		if r.Disinvite == nil {
+			return NewBackendMissingFieldError("disinvite")
+		}
+	case "update":
+		if r.Update == nil {
+			return NewBackendMissingFieldError("update")
+		}
+	case "delete":
+		if r.Delete == nil {
+			return NewBackendMissingFieldError("delete")
+		}
+	case "incall":
+		if r.InCall == nil {
+			return NewBackendMissingFieldError("incall")
+		}
+	case "participants":
+		if r.Participants == nil {
+			return NewBackendMissingFieldError("participants")
+		}
+	case "message":
+		if r.Message == nil {
+			return NewBackendMissingFieldError("message")
+		} else if r.Message.Data == nil {
+			return NewBackendMissingFieldError("message.data")
+		}
+	case "switchto":
+		if r.SwitchTo == nil {
+			return NewBackendMissingFieldError("switchto")
+		} else if r.SwitchTo.RoomId == "" {
+			return NewBackendMissingFieldError("switchto.roomid")
+		}
+	case "recording":
+		if r.Recording == nil {
+			return NewBackendMissingFieldError("recording")
+		}
+		switch r.Recording.Action {
+		case "start":
+		case "stop":
+		case "":
+			return NewBackendMissingFieldError("recording.action")
+		default:
+			return NewBackendInvalidFieldError("recording.action", "Unsupported recording action: "+r.Recording.Action)
+		}
+	case "permissions":
+		if r.Permissions == nil {
+			return NewBackendMissingFieldError("permissions")
+		} else if len(r.Permissions.SessionIds) == 0 && len(r.Permissions.UserIds) == 0 {
+			return NewBackendMissingFieldError("permissions.sessionids")
+		} else if r.Permissions.Permissions == nil {
+			// An empty list is valid and removes all permissions.
+			return NewBackendMissingFieldError("permissions.permissions")
+		}
+	default:
+		return NewErrorDetail("unsupported_type", "Unsupported request type: "+r.Type, &BackendServerErrorDetails{
+			Field: "type",
+		})
+	}
+	return nil
+}
+
+type BackendServerErrorDetails struct {
+	// Name of the field that caused the error, e.g. "invite" or "switchto.roomid".
+	Field string `json:"field,omitempty"`
+}
+
+func NewBackendMissingFieldError(field string) *Error {
+	return NewErrorDetail("missing_field", "Field "+field+" missing", &BackendServerErrorDetails{
+		Field: field,
+	})
+}
+
+func NewBackendInvalidFieldError(field string, message string) *Error {
+	return NewErrorDetail("invalid_field", message, &BackendServerErrorDetails{
+		Field: field,
+	})
+}
+
+type BackendServerRoomResponse struct {
+	RoomId string `json:"roomid,omitempty"`
+	// The HTTP status code of processing the request.
+	Status int    `json:"status"`
+	Error  *Error `json:"error,omitempty"`
+}
+
+type BackendServerRoomBatchEntry struct {
+	RoomId  string                    `json:"roomid"`
+	Request *BackendServerRoomRequest `json:"request"`
+}
+
+type BackendServerRoomBatchRequest struct {
+	Requests []*BackendServerRoomBatchEntry `json:"requests"`
+}
+
+type BackendServerRoomBatchResponse struct {
+	// Responses in the same order as the requests.
+	Responses []*BackendServerRoomResponse `json:"responses"`
+}
+
+type BackendServerBroadcastRequest struct {
+	// Either "message" or "event".
+	Type string `json:"type"`
+
+	// Optional list of user ids to restrict the broadcast to.
+	UserIds []string `json:"userids,omitempty"`
+
+	Data *json.RawMessage `json:"data"`
+}
+
+func (r *BackendServerBroadcastRequest) CheckValid() error {
+	switch r.Type {
+	case "":
+		return NewBackendMissingFieldError("type")
+	case "message":
+	case "event":
+	default:
+		return NewErrorDetail("unsupported_type", "Unsupported broadcast type: "+r.Type, &BackendServerErrorDetails{
+			Field: "type",
+		})
+	}
+	if r.Data == nil {
+		return NewBackendMissingFieldError("data")
+	}
+	return nil
+}
+
 type BackendRoomInviteRequest struct {
 	UserIds []string `json:"userids,omitempty"`
 	// TODO(jojo): We should get rid of "AllUserIds" and find a better way to
@@ -140,6 +280,30 @@ type BackendRoomMessageRequest struct {
 	Data *json.RawMessage `json:"data,omitempty"`
 }
 
+// BackendRoomSwitchToRequest notifies sessions that they should switch to a
+// different room. The server only sends a "switchto" event to the sessions,
+// they stay in the current room until the clients join the target room.
+type BackendRoomSwitchToRequest struct {
+	// Target room the sessions should switch to.
+	RoomId string `json:"roomid"`
+	// Room session ids of the sessions that should switch.
+	SessionIds []string `json:"sessionids"`
+}
+
+type BackendRoomRecordingRequest struct {
+	// Either "start" or "stop".
+	Action string `json:"action"`
+}
+
+type BackendRoomPermissionsRequest struct {
+	// Nextcloud session ids of the sessions to update.
+	SessionIds []string `json:"sessionids,omitempty"`
+	// Update all sessions of these users in the room.
+	UserIds []string `json:"userids,omitempty"`
+
+	Permissions []Permission `json:"permissions"`
+}
+
 // Requests from the signaling server to the Nextcloud backend.
 
 type BackendClientAuthRequest struct {
@@ -157,6 +321,10 @@ type BackendClientRequest struct {
 	Ping *BackendClientPingRequest `json:"ping,omitempty"`
 
 	Session *BackendClientSessionRequest `json:"session,omitempty"`
+
+	Recording *BackendClientRecordingRequest `json:"recording,omitempty"`
+
+	Events *BackendClientEventsRequest `json:"events,omitempty"`
 }
 
 func NewBackendClientAuthRequest(params *json.RawMessage) *BackendClientRequest {
@@ -181,6 +349,8 @@ type BackendClientResponse struct {
 	Ping *BackendClientRingResponse `json:"ping,omitempty"`
 
 	Session *BackendClientSessionResponse `json:"session,omitempty"`
+
+	Recording *BackendClientRecordingResponse `json:"recording,omitempty"`
 }
 
 type BackendClientAuthResponse struct {
@@ -225,6 +395,14 @@ type BackendClientRoomResponse struct {
 	Session *json.RawMessage `json:"session,omitempty"`
 
 	Permissions *[]Permission `json:"permissions,omitempty"`
+
+	// The session must wait in the lobby until a moderator approves it.
+	Waiting bool `json:"waiting,omitempty"`
+
+	// Optional maximum number of sessions in the room (across all servers).
+	MaxSessions int `json:"maxsessions,omitempty"`
+	// Optional maximum number of sessions publishing media in the room.
+	MaxPublishers int `json:"maxpublishers,omitempty"`
 }
 
 type RoomSessionData struct {
@@ -289,6 +467,73 @@ func NewBackendClientSessionRequest(roomid string, action string, sessionid stri
 	return request
 }
 
+type BackendClientRecordingRequest struct {
+	Version string `json:"version"`
+	RoomId  string `json:"roomid"`
+	// One of "started", "stopped" or "failed".
+	Action     string `json:"action"`
+	SessionId  string `json:"sessionid"`
+	UserId     string `json:"userid,omitempty"`
+	StreamType string `json:"streamtype"`
+	// Base filename of the recording in the MCU.
+	Filename string `json:"filename,omitempty"`
+}
+
+type BackendClientRecordingResponse struct {
+	Version string `json:"version"`
+	RoomId  string `json:"roomid"`
+}
+
+func NewBackendClientRecordingRequest(roomid string, action string, sessionid string, userid string, streamType string, filename string) *BackendClientRequest {
+	return &BackendClientRequest{
+		Type: "recording",
+		Recording: &BackendClientRecordingRequest{
+			Version:    BackendVersion,
+			RoomId:     roomid,
+			Action:     action,
+			SessionId:  sessionid,
+			UserId:     userid,
+			StreamType: streamType,
+			Filename:   filename,
+		},
+	}
+}
+
+const (
+	BackendEventSessionJoined    = "joined"
+	BackendEventSessionLeft      = "left"
+	BackendEventSessionExpired   = "expired"
+	BackendEventCallStarted      = "callstarted"
+	BackendEventCallEnded        = "callended"
+	BackendEventPublisherStarted = "publisherstarted"
+	BackendEventPublisherStopped = "publisherstopped"
+)
+
+type BackendClientEvent struct {
+	Type string `json:"type"`
+	// Time of the event in milliseconds since the epoch.
+	Timestamp  int64  `json:"timestamp"`
+	RoomId     string `json:"roomid,omitempty"`
+	SessionId  string `json:"sessionid,omitempty"`
+	UserId     string `json:"userid,omitempty"`
+	StreamType string `json:"streamtype,omitempty"`
+}
+
+type BackendClientEventsRequest struct {
+	Version string                `json:"version"`
+	Events  []*BackendClientEvent `json:"events"`
+}
+
+func NewBackendClientEventsRequest(events []*BackendClientEvent) *BackendClientRequest {
+	return &BackendClientRequest{
+		Type: "events",
+		Events: &BackendClientEventsRequest{
+			Version: BackendVersion,
+			Events:  events,
+		},
+	}
+}
+
 type OcsMeta struct {
 	Status     string `json:"status"`
 	StatusCode int    `json:"statuscode"`
@@ -22,6 +22,7 @@
 package signaling
 
 import (
+	"encoding/json"
 	"net/http"
 	"testing"
 )
@@ -56,3 +57,82 @@ func TestBackendChecksum(t *testing.T) {
 		t.Errorf("Checksum %s could not be validated from request", check1)
 	}
 }
+
+func TestBackendServerRoomRequest(t *testing.T) {
+	data := json.RawMessage("{\"foo\":\"bar\"}")
+	valid_messages := []*BackendServerRoomRequest{
+		{Type: "invite", Invite: &BackendRoomInviteRequest{}},
+		{Type: "disinvite", Disinvite: &BackendRoomDisinviteRequest{}},
+		{Type: "update", Update: &BackendRoomUpdateRequest{}},
+		{Type: "delete", Delete: &BackendRoomDeleteRequest{}},
+		{Type: "incall", InCall: &BackendRoomInCallRequest{}},
+		{Type: "participants", Participants: &BackendRoomParticipantsRequest{}},
+		{Type: "message", Message: &BackendRoomMessageRequest{Data: &data}},
+		{Type: "switchto", SwitchTo: &BackendRoomSwitchToRequest{RoomId: "other-room"}},
+		{Type: "recording", Recording: &BackendRoomRecordingRequest{Action: "start"}},
+		{Type: "recording", Recording: &BackendRoomRecordingRequest{Action: "stop"}},
+		{Type: "permissions", Permissions: &BackendRoomPermissionsRequest{
+			SessionIds:  []string{"session-id"},
+			Permissions: []Permission{PERMISSION_MAY_PUBLISH_MEDIA},
+		}},
+		{Type: "permissions", Permissions: &BackendRoomPermissionsRequest{
+			UserIds:     []string{"user-id"},
+			Permissions: []Permission{},
+		}},
+	}
+	for _, msg := range valid_messages {
+		if err := msg.CheckValid(); err != nil {
+			t.Errorf("Message %+v should be valid, got %s", msg, err)
+		}
+	}
+
+	invalid_messages := map[string]*BackendServerRoomRequest{
+		"type":            {},
+		"invite":          {Type: "invite"},
+		"disinvite":       {Type: "disinvite"},
+		"update":          {Type: "update"},
+		"delete":          {Type: "delete"},
+		"incall":          {Type: "incall"},
+		"participants":    {Type: "participants"},
+		"message":         {Type: "message"},
+		"message.data":    {Type: "message", Message: &BackendRoomMessageRequest{}},
+		"switchto":        {Type: "switchto"},
+		"switchto.roomid": {Type: "switchto", SwitchTo: &BackendRoomSwitchToRequest{}},
+		"recording":       {Type: "recording"},
+		"recording.action": {Type: "recording", Recording: &BackendRoomRecordingRequest{
+			Action: "pause",
+		}},
+		"permissions": {Type: "permissions"},
+		"permissions.sessionids": {Type: "permissions", Permissions: &BackendRoomPermissionsRequest{
+			Permissions: []Permission{},
+		}},
+		"permissions.permissions": {Type: "permissions", Permissions: &BackendRoomPermissionsRequest{
+			SessionIds: []string{"session-id"},
+		}},
+	}
+	for field, msg := range invalid_messages {
+		err := msg.CheckValid()
+		if err == nil {
+			t.Errorf("Message %+v should not be valid", msg)
+			continue
+		}
+
+		e, ok := err.(*Error)
+		if !ok {
+			t.Errorf("Expected error object for %+v, got %T", msg, err)
+			continue
+		}
+		if details, ok := e.Details.(*BackendServerErrorDetails); !ok {
+			t.Errorf("Expected error details for %+v, got %+v", msg, e.Details)
+		} else if details.Field != field {
+			t.Errorf("Expected field %s for %+v, got %s", field, msg, details.Field)
+		}
+	}
+
+	msg := &BackendServerRoomRequest{Type: "lala"}
+	if err := msg.CheckValid(); err == nil {
+		t.Errorf("Message %+v should not be valid", msg)
+	} else if e, ok := err.(*Error); !ok || e.Code != "unsupported_type" {
+		t.Errorf("Expected unsupported type error, got %+v", err)
+	}
+}
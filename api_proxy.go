@@ -177,6 +177,10 @@ type CommandProxyClientMessage struct {
 	ClientId    string    `json:"clientId,omitempty"`
 	Bitrate     int       `json:"bitrate,omitempty"`
 	MediaTypes  MediaType `json:"mediatypes,omitempty"`
+
+	// Used for type "set-recording".
+	Recording bool   `json:"recording,omitempty"`
+	Filename  string `json:"filename,omitempty"`
 }
 
 func (m *CommandProxyClientMessage) CheckValid() error {
@@ -197,6 +201,8 @@ func (m *CommandProxyClientMessage) CheckValid() error {
 	case "delete-publisher":
 		fallthrough
 	case "delete-subscriber":
+		fallthrough
+	case "set-recording":
 		if m.ClientId == "" {
 			return fmt.Errorf("client id missing")
 		}
@@ -254,6 +260,13 @@ type EventProxyServerMessage struct {
 
 	ClientId string `json:"clientId,omitempty"`
 	Load     int64  `json:"load,omitempty"`
+
+	// Used for type "talking"
+	Talking *TalkingProxyServerMessage `json:"talking,omitempty"`
+}
+
+type TalkingProxyServerMessage struct {
+	Talking bool `json:"talking"`
 }
 
 // Information on a proxy in the etcd cluster.
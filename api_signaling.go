@@ -26,11 +26,17 @@ import (
 	"fmt"
 	"net/url"
 	"strings"
+
+	"github.com/golang-jwt/jwt"
 )
 
 const (
 	// Version that must be sent in a "hello" message.
 	HelloVersion = "1.0"
+
+	// Version of a "hello" message that contains a signed token which can be
+	// validated without contacting the backend.
+	HelloVersionV2 = "2.0"
 )
 
 // ClientMessage is a message that is sent from a client to the server.
@@ -53,6 +59,10 @@ type ClientMessage struct {
 	Control *ControlClientMessage `json:"control,omitempty"`
 
 	Internal *InternalClientMessage `json:"internal,omitempty"`
+
+	TransientData *TransientDataClientMessage `json:"transient,omitempty"`
+
+	Ack *AckClientMessage `json:"ack,omitempty"`
 }
 
 func (m *ClientMessage) CheckValid() error {
@@ -67,6 +77,8 @@ func (m *ClientMessage) CheckValid() error {
 		}
 	case "bye":
 		// No additional check required.
+	case "roster":
+		// No additional check required.
 	case "room":
 		if m.Room == nil {
 			return fmt.Errorf("room missing")
@@ -91,6 +103,18 @@ func (m *ClientMessage) CheckValid() error {
 		} else if err := m.Internal.CheckValid(); err != nil {
 			return err
 		}
+	case "transient":
+		if m.TransientData == nil {
+			return fmt.Errorf("transient missing")
+		} else if err := m.TransientData.CheckValid(); err != nil {
+			return err
+		}
+	case "ack":
+		if m.Ack == nil {
+			return fmt.Errorf("ack missing")
+		} else if err := m.Ack.CheckValid(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -123,6 +147,10 @@ func (m *ClientMessage) NewWrappedErrorServerMessage(e error) *ServerMessage {
 type ServerMessage struct {
 	Id string `json:"id,omitempty"`
 
+	// Sequence number of the message, only set if the client requested the
+	// "sequence" feature.
+	Seq uint64 `json:"seq,omitempty"`
+
 	Type string `json:"type"`
 
 	Error *Error `json:"error,omitempty"`
@@ -138,6 +166,10 @@ type ServerMessage struct {
 	Control *ControlServerMessage `json:"control,omitempty"`
 
 	Event *EventServerMessage `json:"event,omitempty"`
+
+	TransientData *TransientDataServerMessage `json:"transient,omitempty"`
+
+	Roster *RosterServerMessage `json:"roster,omitempty"`
 }
 
 func (r *ServerMessage) CloseAfterSend(session Session) bool {
@@ -258,6 +290,28 @@ func (p *ClientTypeInternalAuthParams) CheckValid() error {
 	return nil
 }
 
+type HelloV2AuthParams struct {
+	Token string `json:"token"`
+}
+
+func (p *HelloV2AuthParams) CheckValid() error {
+	if p.Token == "" {
+		return fmt.Errorf("token missing")
+	}
+	return nil
+}
+
+// HelloV2TokenClaims are the claims of a token that is sent in a "hello"
+// message with version "2.0". The subject contains the user id, the issuer
+// the URL of the backend and the audience and "backendid" the id of the
+// backend as configured in the signaling server.
+type HelloV2TokenClaims struct {
+	jwt.StandardClaims
+
+	BackendId string           `json:"backendid,omitempty"`
+	UserData  *json.RawMessage `json:"userdata,omitempty"`
+}
+
 type HelloClientMessageAuth struct {
 	// The client type that is connecting. Leave empty to use the default
 	// "HelloClientTypeClient"
@@ -269,6 +323,7 @@ type HelloClientMessageAuth struct {
 	parsedUrl *url.URL
 
 	internalParams ClientTypeInternalAuthParams
+	helloV2Params  HelloV2AuthParams
 }
 
 // Type "hello"
@@ -277,6 +332,8 @@ type HelloClientMessage struct {
 	Version string `json:"version"`
 
 	ResumeId string `json:"resumeid"`
+	// Last sequence number received by the client, only used when resuming.
+	LastSeq uint64 `json:"lastseq,omitempty"`
 
 	Features []string `json:"features,omitempty"`
 
@@ -285,7 +342,7 @@ type HelloClientMessage struct {
 }
 
 func (m *HelloClientMessage) CheckValid() error {
-	if m.Version != HelloVersion {
+	if m.Version != HelloVersion && m.Version != HelloVersionV2 {
 		return fmt.Errorf("unsupported hello version: %s", m.Version)
 	}
 	if m.ResumeId == "" {
@@ -308,6 +365,14 @@ func (m *HelloClientMessage) CheckValid() error {
 
 				m.Auth.parsedUrl = u
 			}
+
+			if m.Version == HelloVersionV2 {
+				if err := json.Unmarshal(*m.Auth.Params, &m.Auth.helloV2Params); err != nil {
+					return err
+				} else if err := m.Auth.helloV2Params.CheckValid(); err != nil {
+					return err
+				}
+			}
 		case HelloClientTypeInternal:
 			if err := json.Unmarshal(*m.Auth.Params, &m.Auth.internalParams); err != nil {
 				return err
@@ -322,10 +387,29 @@ func (m *HelloClientMessage) CheckValid() error {
 }
 
 const (
+	// Features that can be requested by clients.
+	ClientFeatureSequence    = "sequence"
+	ClientFeatureMessagePack = "msgpack"
+	// Messages sent to the own user id will be delivered to the other sessions
+	// of the same user.
+	ClientFeatureOwnSessions = "own-sessions"
+
 	// Features for all clients.
 	ServerFeatureMcu                   = "mcu"
 	ServerFeatureSimulcast             = "simulcast"
 	ServerFeatureAudioVideoPermissions = "audio-video-permissions"
+	ServerFeatureTransientData         = "transient-data"
+	ServerFeatureHelloV2               = "hello-v2"
+	ServerFeatureMessagePack           = "msgpack"
+	ServerFeatureOwnSessions           = "own-sessions"
+	ServerFeatureSwitchTo              = "switchto"
+	ServerFeatureLobby                 = "lobby"
+	ServerFeatureRoster                = "roster"
+	ServerFeatureRoomHistory           = "room-history"
+	ServerFeatureSpeaking              = "speaking"
+	ServerFeatureRecording             = "recording"
+	ServerFeatureUpdatePermissions     = "update-permissions"
+	ServerFeatureBackendBroadcast      = "backend-broadcast"
 
 	// Features for internal clients only.
 	ServerFeatureInternalVirtualSessions = "virtual-sessions"
@@ -334,6 +418,16 @@ const (
 var (
 	DefaultFeatures []string = []string{
 		ServerFeatureAudioVideoPermissions,
+		ServerFeatureTransientData,
+		ServerFeatureHelloV2,
+		ServerFeatureMessagePack,
+		ServerFeatureOwnSessions,
+		ServerFeatureSwitchTo,
+		ServerFeatureLobby,
+		ServerFeatureRoster,
+		ServerFeatureRoomHistory,
+		ServerFeatureUpdatePermissions,
+		ServerFeatureBackendBroadcast,
 	}
 	DefaultFeaturesInternal []string = []string{
 		ServerFeatureInternalVirtualSessions,
@@ -367,6 +461,16 @@ func (m *ByeClientMessage) CheckValid() error {
 
 type ByeServerMessage struct {
 	Reason string `json:"reason"`
+
+	// Set if the client should connect again (e.g. to a different server).
+	Reconnect *ByeServerMessageReconnect `json:"reconnect,omitempty"`
+}
+
+type ByeServerMessageReconnect struct {
+	// The session can be resumed after reconnecting.
+	Resume bool `json:"resume"`
+	// Time in milliseconds to wait before reconnecting.
+	Delay int64 `json:"delay,omitempty"`
 }
 
 // Type "room"
@@ -392,6 +496,10 @@ const (
 	RecipientTypeSession = "session"
 	RecipientTypeUser    = "user"
 	RecipientTypeRoom    = "room"
+	RecipientTypeCall    = "call"
+
+	// Sender of messages broadcasted by the backend.
+	SenderTypeBackend = "backend"
 )
 
 type MessageClientMessageRecipient struct {
@@ -405,6 +513,10 @@ type MessageClientMessage struct {
 	Recipient MessageClientMessageRecipient `json:"recipient"`
 
 	Data *json.RawMessage `json:"data"`
+
+	// Room messages marked as persistent will be sent to sessions joining
+	// the room later.
+	Persistent bool `json:"persistent,omitempty"`
 }
 
 type MessageClientMessageData struct {
@@ -422,6 +534,8 @@ func (m *MessageClientMessage) CheckValid() error {
 	switch m.Recipient.Type {
 	case RecipientTypeRoom:
 		// No additional checks required.
+	case RecipientTypeCall:
+		// No additional checks required.
 	case RecipientTypeSession:
 		if m.Recipient.SessionId == "" {
 			return fmt.Errorf("session id missing")
@@ -433,6 +547,9 @@ func (m *MessageClientMessage) CheckValid() error {
 	default:
 		return fmt.Errorf("unsupported recipient type %v", m.Recipient.Type)
 	}
+	if m.Persistent && m.Recipient.Type != RecipientTypeRoom {
+		return fmt.Errorf("only room messages can be persistent")
+	}
 	return nil
 }
 
@@ -462,17 +579,72 @@ type MessageServerMessage struct {
 
 // Type "control"
 
+const (
+	// Kick the recipient from the room of the sender.
+	ControlActionKick = "kick"
+	// Approve / deny the request of the recipient to join the room of the
+	// sender from the lobby.
+	ControlActionApprove = "approve"
+	ControlActionDeny    = "deny"
+)
+
+type ControlClientMessageAction struct {
+	Type string `json:"type"`
+
+	// Number of seconds the kicked user (or room session for guests) may not
+	// join the room again.
+	BanDuration int `json:"banduration,omitempty"`
+}
+
 type ControlClientMessage struct {
 	MessageClientMessage
+
+	// Optional action that will be performed by the server.
+	Action *ControlClientMessageAction `json:"action,omitempty"`
 }
 
 func (m *ControlClientMessage) CheckValid() error {
+	if m.Action != nil {
+		return m.checkValidAction()
+	}
+
 	if err := m.MessageClientMessage.CheckValid(); err != nil {
 		return err
 	}
 	return nil
 }
 
+func (m *ControlClientMessage) checkValidAction() error {
+	switch m.Action.Type {
+	case ControlActionKick:
+		if m.Action.BanDuration < 0 {
+			return fmt.Errorf("invalid ban duration %d", m.Action.BanDuration)
+		}
+	case ControlActionApprove:
+		fallthrough
+	case ControlActionDeny:
+		if m.Recipient.Type != RecipientTypeSession {
+			return fmt.Errorf("unsupported recipient type %v for action %s", m.Recipient.Type, m.Action.Type)
+		}
+	default:
+		return fmt.Errorf("unsupported action %s", m.Action.Type)
+	}
+
+	switch m.Recipient.Type {
+	case RecipientTypeSession:
+		if m.Recipient.SessionId == "" {
+			return fmt.Errorf("session id missing")
+		}
+	case RecipientTypeUser:
+		if m.Recipient.UserId == "" {
+			return fmt.Errorf("user id missing")
+		}
+	default:
+		return fmt.Errorf("unsupported recipient type %v for action %s", m.Recipient.Type, m.Action.Type)
+	}
+	return nil
+}
+
 type ControlServerMessage struct {
 	Sender    *MessageServerMessageSender    `json:"sender"`
 	Recipient *MessageClientMessageRecipient `json:"recipient,omitempty"`
@@ -613,6 +785,25 @@ type RoomFlagsServerMessage struct {
 	Flags     uint32 `json:"flags"`
 }
 
+type RoomPermissionsServerMessage struct {
+	RoomId      string       `json:"roomid"`
+	SessionId   string       `json:"sessionid"`
+	Permissions []Permission `json:"permissions"`
+}
+
+type RoomRevokedServerMessage struct {
+	RoomId     string   `json:"roomid,omitempty"`
+	SessionId  string   `json:"sessionid"`
+	StreamType string   `json:"streamtype"`
+	Media      []string `json:"media"`
+}
+
+type RoomSpeakingServerMessage struct {
+	RoomId    string `json:"roomid,omitempty"`
+	SessionId string `json:"sessionid"`
+	Speaking  bool   `json:"speaking"`
+}
+
 type EventServerMessage struct {
 	Target string `json:"target"`
 	Type   string `json:"type"`
@@ -627,9 +818,52 @@ type EventServerMessage struct {
 	Disinvite *RoomDisinviteEventServerMessage `json:"disinvite,omitempty"`
 	Update    *RoomEventServerMessage          `json:"update,omitempty"`
 	Flags     *RoomFlagsServerMessage          `json:"flags,omitempty"`
+	Revoked   *RoomRevokedServerMessage        `json:"revoked,omitempty"`
+	Speaking  *RoomSpeakingServerMessage       `json:"speaking,omitempty"`
+
+	// Used for target "participants" and type "permissions"
+	Permissions *RoomPermissionsServerMessage `json:"permissions,omitempty"`
 
 	// Used for target "message"
 	Message *RoomEventMessage `json:"message,omitempty"`
+
+	// Used for target "room" and type "switchto"
+	SwitchTo *EventServerMessageSwitchTo `json:"switchto,omitempty"`
+
+	// Used for target "room" and type "lobby"
+	Lobby *EventServerMessageLobby `json:"lobby,omitempty"`
+	// Used for target "room" and type "joinrequest"
+	JoinRequest *EventServerMessageSessionEntry `json:"joinrequest,omitempty"`
+	// Used for target "room" and type "recording"
+	Recording *EventServerMessageRecording `json:"recording,omitempty"`
+
+	// Used for target "backend" and type "broadcast"
+	Broadcast *BroadcastEventServerMessage `json:"broadcast,omitempty"`
+}
+
+type BroadcastEventServerMessage struct {
+	Data *json.RawMessage `json:"data"`
+}
+
+const (
+	LobbyStatusWaiting = "waiting"
+	LobbyStatusDenied  = "denied"
+)
+
+type EventServerMessageLobby struct {
+	RoomId string `json:"roomid"`
+	Status string `json:"status"`
+}
+
+type EventServerMessageRecording struct {
+	RoomId    string `json:"roomid"`
+	Recording bool   `json:"recording"`
+}
+
+// EventServerMessageSwitchTo is sent if the session should join a different
+// room. The client must send a "room" request for the target room itself.
+type EventServerMessageSwitchTo struct {
+	RoomId string `json:"roomid"`
 }
 
 type EventServerMessageSessionEntry struct {
@@ -639,6 +873,79 @@ type EventServerMessageSessionEntry struct {
 	RoomSessionId string           `json:"roomsessionid,omitempty"`
 }
 
+// Type "ack"
+
+type AckClientMessage struct {
+	// Acknowledge all messages up to (and including) this sequence number.
+	Seq uint64 `json:"seq"`
+}
+
+func (m *AckClientMessage) CheckValid() error {
+	if m.Seq == 0 {
+		return fmt.Errorf("seq missing")
+	}
+	return nil
+}
+
+// Type "roster"
+
+type RosterServerMessage struct {
+	RoomId   string                `json:"roomid"`
+	Sessions []*RosterSessionEntry `json:"sessions"`
+}
+
+type RosterSessionEntry struct {
+	SessionId     string           `json:"sessionid"`
+	UserId        string           `json:"userid"`
+	User          *json.RawMessage `json:"user,omitempty"`
+	RoomSessionId string           `json:"roomsessionid,omitempty"`
+
+	// Combination of the "Flag*" values, "0" if the session is not in the call.
+	InCall int `json:"incall"`
+
+	Internal bool `json:"internal,omitempty"`
+	Virtual  bool `json:"virtual,omitempty"`
+	// Flags of virtual sessions.
+	Flags uint32 `json:"flags,omitempty"`
+}
+
+// Type "transient"
+
+type TransientDataClientMessage struct {
+	Type string `json:"type"`
+
+	Key   string           `json:"key,omitempty"`
+	Value *json.RawMessage `json:"value,omitempty"`
+}
+
+func (m *TransientDataClientMessage) CheckValid() error {
+	switch m.Type {
+	case "set":
+		if m.Key == "" {
+			return fmt.Errorf("key missing")
+		}
+		// A "nil" value is allowed and will remove the key.
+	case "remove":
+		if m.Key == "" {
+			return fmt.Errorf("key missing")
+		}
+	case "":
+		return fmt.Errorf("type missing")
+	default:
+		return fmt.Errorf("unsupported type %s", m.Type)
+	}
+	return nil
+}
+
+type TransientDataServerMessage struct {
+	Type string `json:"type"`
+
+	Key      string                 `json:"key,omitempty"`
+	OldValue interface{}            `json:"oldvalue,omitempty"`
+	Value    interface{}            `json:"value,omitempty"`
+	Data     map[string]interface{} `json:"data,omitempty"`
+}
+
 // MCU-related types
 
 type AnswerOfferMessage struct {
@@ -40,10 +40,14 @@ func wrapMessage(messageType string, msg testCheckValid) *ClientMessage {
 		wrapped.Hello = msg.(*HelloClientMessage)
 	case "message":
 		wrapped.Message = msg.(*MessageClientMessage)
+	case "control":
+		wrapped.Control = msg.(*ControlClientMessage)
 	case "bye":
 		wrapped.Bye = msg.(*ByeClientMessage)
 	case "room":
 		wrapped.Room = msg.(*RoomClientMessage)
+	case "transient":
+		wrapped.TransientData = msg.(*TransientDataClientMessage)
 	default:
 		return nil
 	}
@@ -88,6 +92,7 @@ func TestClientMessage(t *testing.T) {
 
 func TestHelloClientMessage(t *testing.T) {
 	internalAuthParams := []byte("{\"backend\":\"https://domain.invalid\"}")
+	tokenAuthParams := []byte("{\"token\":\"invalid-token\"}")
 	valid_messages := []testCheckValid{
 		&HelloClientMessage{
 			Version: HelloVersion,
@@ -115,6 +120,17 @@ func TestHelloClientMessage(t *testing.T) {
 			Version:  HelloVersion,
 			ResumeId: "the-resume-id",
 		},
+		&HelloClientMessage{
+			Version: HelloVersionV2,
+			Auth: HelloClientMessageAuth{
+				Params: (*json.RawMessage)(&tokenAuthParams),
+				Url:    "https://domain.invalid",
+			},
+		},
+		&HelloClientMessage{
+			Version:  HelloVersionV2,
+			ResumeId: "the-resume-id",
+		},
 	}
 	invalid_messages := []testCheckValid{
 		&HelloClientMessage{},
@@ -160,6 +176,13 @@ func TestHelloClientMessage(t *testing.T) {
 				Params: &json.RawMessage{'x', 'y', 'z'}, // Invalid JSON.
 			},
 		},
+		&HelloClientMessage{
+			Version: HelloVersionV2,
+			Auth: HelloClientMessageAuth{
+				Params: &json.RawMessage{'{', '}'}, // Token missing.
+				Url:    "https://domain.invalid",
+			},
+		},
 	}
 
 	testMessages(t, "hello", valid_messages, invalid_messages)
@@ -195,9 +218,30 @@ func TestMessageClientMessage(t *testing.T) {
 			},
 			Data: &json.RawMessage{'{', '}'},
 		},
+		&MessageClientMessage{
+			Recipient: MessageClientMessageRecipient{
+				Type: "call",
+			},
+			Data: &json.RawMessage{'{', '}'},
+		},
+		&MessageClientMessage{
+			Recipient: MessageClientMessageRecipient{
+				Type: "room",
+			},
+			Data:       &json.RawMessage{'{', '}'},
+			Persistent: true,
+		},
 	}
 	invalid_messages := []testCheckValid{
 		&MessageClientMessage{},
+		&MessageClientMessage{
+			Recipient: MessageClientMessageRecipient{
+				Type:      "session",
+				SessionId: "the-session-id",
+			},
+			Data:       &json.RawMessage{'{', '}'},
+			Persistent: true,
+		},
 		&MessageClientMessage{
 			Recipient: MessageClientMessageRecipient{
 				Type:      "session",
@@ -254,6 +298,145 @@ func TestMessageClientMessage(t *testing.T) {
 	}
 }
 
+func TestControlClientMessage(t *testing.T) {
+	valid_messages := []testCheckValid{
+		&ControlClientMessage{
+			MessageClientMessage: MessageClientMessage{
+				Recipient: MessageClientMessageRecipient{
+					Type: "room",
+				},
+				Data: &json.RawMessage{'{', '}'},
+			},
+		},
+		&ControlClientMessage{
+			MessageClientMessage: MessageClientMessage{
+				Recipient: MessageClientMessageRecipient{
+					Type:      "session",
+					SessionId: "the-session-id",
+				},
+			},
+			Action: &ControlClientMessageAction{
+				Type: "kick",
+			},
+		},
+		&ControlClientMessage{
+			MessageClientMessage: MessageClientMessage{
+				Recipient: MessageClientMessageRecipient{
+					Type:   "user",
+					UserId: "the-user-id",
+				},
+			},
+			Action: &ControlClientMessageAction{
+				Type:        "kick",
+				BanDuration: 60,
+			},
+		},
+		&ControlClientMessage{
+			MessageClientMessage: MessageClientMessage{
+				Recipient: MessageClientMessageRecipient{
+					Type:      "session",
+					SessionId: "the-session-id",
+				},
+			},
+			Action: &ControlClientMessageAction{
+				Type: "approve",
+			},
+		},
+	}
+	invalid_messages := []testCheckValid{
+		&ControlClientMessage{},
+		&ControlClientMessage{
+			MessageClientMessage: MessageClientMessage{
+				Recipient: MessageClientMessageRecipient{
+					Type:      "session",
+					SessionId: "the-session-id",
+				},
+			},
+			Action: &ControlClientMessageAction{
+				Type: "unknown-action",
+			},
+		},
+		&ControlClientMessage{
+			MessageClientMessage: MessageClientMessage{
+				Recipient: MessageClientMessageRecipient{
+					Type:      "session",
+					SessionId: "the-session-id",
+				},
+			},
+			Action: &ControlClientMessageAction{
+				Type:        "kick",
+				BanDuration: -1,
+			},
+		},
+		&ControlClientMessage{
+			MessageClientMessage: MessageClientMessage{
+				Recipient: MessageClientMessageRecipient{
+					Type: "session",
+				},
+			},
+			Action: &ControlClientMessageAction{
+				Type: "kick",
+			},
+		},
+		&ControlClientMessage{
+			MessageClientMessage: MessageClientMessage{
+				Recipient: MessageClientMessageRecipient{
+					Type: "room",
+				},
+			},
+			Action: &ControlClientMessageAction{
+				Type: "kick",
+			},
+		},
+		&ControlClientMessage{
+			MessageClientMessage: MessageClientMessage{
+				Recipient: MessageClientMessageRecipient{
+					Type:   "user",
+					UserId: "the-user-id",
+				},
+			},
+			Action: &ControlClientMessageAction{
+				Type: "deny",
+			},
+		},
+	}
+	testMessages(t, "control", valid_messages, invalid_messages)
+}
+
+func TestTransientDataClientMessage(t *testing.T) {
+	value := json.RawMessage("\"bar\"")
+	valid_messages := []testCheckValid{
+		&TransientDataClientMessage{
+			Type:  "set",
+			Key:   "foo",
+			Value: &value,
+		},
+		&TransientDataClientMessage{
+			Type: "set",
+			Key:  "foo",
+		},
+		&TransientDataClientMessage{
+			Type: "remove",
+			Key:  "foo",
+		},
+	}
+	invalid_messages := []testCheckValid{
+		&TransientDataClientMessage{},
+		&TransientDataClientMessage{
+			Type: "set",
+		},
+		&TransientDataClientMessage{
+			Type: "remove",
+		},
+		&TransientDataClientMessage{
+			Type: "unknown",
+			Key:  "foo",
+		},
+	}
+
+	testMessages(t, "transient", valid_messages, invalid_messages)
+}
+
 func TestByeClientMessage(t *testing.T) {
 	// Any "bye" message is valid.
 	valid_messages := []testCheckValid{
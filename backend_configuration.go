@@ -22,6 +22,8 @@
 package signaling
 
 import (
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/url"
 	"reflect"
@@ -29,6 +31,7 @@ import (
 	"sync"
 
 	"github.com/dlintw/goconf"
+	"github.com/golang-jwt/jwt"
 )
 
 var (
@@ -41,6 +44,9 @@ type Backend struct {
 	secret []byte
 	compat bool
 
+	// Public key to validate tokens sent in "hello" messages (optional).
+	publicKey interface{}
+
 	allowHttp bool
 
 	maxStreamBitrate int
@@ -49,6 +55,9 @@ type Backend struct {
 	sessionLimit uint64
 	sessionsLock sync.Mutex
 	sessions     map[string]bool
+
+	// Url that receives event notifications (optional).
+	webhookUrl *url.URL
 }
 
 func (b *Backend) Id() string {
@@ -59,10 +68,18 @@ func (b *Backend) Secret() []byte {
 	return b.secret
 }
 
+func (b *Backend) PublicKey() interface{} {
+	return b.publicKey
+}
+
 func (b *Backend) IsCompat() bool {
 	return b.compat
 }
 
+func (b *Backend) WebhookUrl() *url.URL {
+	return b.webhookUrl
+}
+
 func (b *Backend) IsUrlAllowed(u *url.URL) bool {
 	switch u.Scheme {
 	case "https":
@@ -122,6 +139,18 @@ func NewBackendConfiguration(config *goconf.ConfigFile) (*BackendConfiguration,
 	if err != nil || sessionLimit < 0 {
 		sessionLimit = 0
 	}
+	var commonPublicKey interface{}
+	if filename, _ := config.GetString("backend", "publickey"); filename != "" {
+		if commonPublicKey, err = loadBackendPublicKey(filename); err != nil {
+			return nil, err
+		}
+	}
+	var commonWebhookUrl *url.URL
+	if webhook, _ := config.GetString("backend", "webhook"); webhook != "" {
+		if commonWebhookUrl, err = parseWebhookUrl(webhook, allowHttp); err != nil {
+			log.Printf("Invalid common webhook configured (%s), events will not be sent", err)
+		}
+	}
 	backends := make(map[string][]*Backend)
 	var compatBackend *Backend
 	numBackends := 0
@@ -132,16 +161,25 @@ func NewBackendConfiguration(config *goconf.ConfigFile) (*BackendConfiguration,
 			secret: []byte(commonSecret),
 			compat: true,
 
+			publicKey: commonPublicKey,
+
 			allowHttp: allowHttp,
 
 			sessionLimit: uint64(sessionLimit),
+
+			webhookUrl: commonWebhookUrl,
 		}
 		if sessionLimit > 0 {
 			log.Printf("Allow a maximum of %d sessions", sessionLimit)
 		}
 		numBackends += 1
 	} else if backendIds, _ := config.GetString("backend", "backends"); backendIds != "" {
-		for host, configuredBackends := range getConfiguredHosts(backendIds, config) {
+		configuredHosts, err := getConfiguredHosts(backendIds, config)
+		if err != nil {
+			return nil, err
+		}
+
+		for host, configuredBackends := range configuredHosts {
 			backends[host] = append(backends[host], configuredBackends...)
 			for _, be := range configuredBackends {
 				log.Printf("Backend %s added for %s", be.id, be.url)
@@ -170,9 +208,13 @@ func NewBackendConfiguration(config *goconf.ConfigFile) (*BackendConfiguration,
 				secret: []byte(commonSecret),
 				compat: true,
 
+				publicKey: commonPublicKey,
+
 				allowHttp: allowHttp,
 
 				sessionLimit: uint64(sessionLimit),
+
+				webhookUrl: commonWebhookUrl,
 			}
 			hosts := make([]string, 0, len(allowMap))
 			for host := range allowMap {
@@ -245,6 +287,41 @@ func (b *BackendConfiguration) UpsertHost(host string, backends []*Backend) {
 	statsBackendsCurrent.Add(float64(len(backends)))
 }
 
+func parseWebhookUrl(value string, allowHttp bool) (*url.URL, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook url %s: %s", value, err)
+	}
+
+	switch u.Scheme {
+	case "http":
+		if !allowHttp {
+			return nil, fmt.Errorf("http is not allowed for webhook url %s", value)
+		}
+		return u, nil
+	case "https":
+		return u, nil
+	default:
+		return nil, fmt.Errorf("unsupported scheme in webhook url %s", value)
+	}
+}
+
+// loadBackendPublicKey reads a RSA or ECDSA public key in PEM format.
+func loadBackendPublicKey(filename string) (interface{}, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read public key from %s: %s", filename, err)
+	}
+
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseECPublicKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported public key in %s", filename)
+}
+
 func getConfiguredBackendIDs(backendIds string) (ids []string) {
 	seen := make(map[string]bool)
 
@@ -264,7 +341,7 @@ func getConfiguredBackendIDs(backendIds string) (ids []string) {
 	return ids
 }
 
-func getConfiguredHosts(backendIds string, config *goconf.ConfigFile) (hosts map[string][]*Backend) {
+func getConfiguredHosts(backendIds string, config *goconf.ConfigFile) (hosts map[string][]*Backend, err error) {
 	hosts = make(map[string][]*Backend)
 	for _, id := range getConfiguredBackendIDs(backendIds) {
 		u, _ := config.GetString(id, "url")
@@ -293,6 +370,13 @@ func getConfiguredHosts(backendIds string, config *goconf.ConfigFile) (hosts map
 			continue
 		}
 
+		var publicKey interface{}
+		if filename, _ := config.GetString(id, "publickey"); filename != "" {
+			if publicKey, err = loadBackendPublicKey(filename); err != nil {
+				return nil, fmt.Errorf("invalid public key for backend %s: %s", id, err)
+			}
+		}
+
 		sessionLimit, err := config.GetInt(id, "sessionlimit")
 		if err != nil || sessionLimit < 0 {
 			sessionLimit = 0
@@ -310,21 +394,34 @@ func getConfiguredHosts(backendIds string, config *goconf.ConfigFile) (hosts map
 			maxScreenBitrate = 0
 		}
 
+		var webhookUrl *url.URL
+		if webhook, _ := config.GetString(id, "webhook"); webhook != "" {
+			if webhookUrl, err = parseWebhookUrl(webhook, parsed.Scheme == "http"); err != nil {
+				log.Printf("Backend %s has an invalid webhook configured (%s), events will not be sent", id, err)
+			} else {
+				log.Printf("Backend %s sends events to %s", id, webhookUrl)
+			}
+		}
+
 		hosts[parsed.Host] = append(hosts[parsed.Host], &Backend{
 			id:     id,
 			url:    u,
 			secret: []byte(secret),
 
+			publicKey: publicKey,
+
 			allowHttp: parsed.Scheme == "http",
 
 			maxStreamBitrate: maxStreamBitrate,
 			maxScreenBitrate: maxScreenBitrate,
 
 			sessionLimit: uint64(sessionLimit),
+
+			webhookUrl: webhookUrl,
 		})
 	}
 
-	return hosts
+	return hosts, nil
 }
 
 func (b *BackendConfiguration) Reload(config *goconf.ConfigFile) {
@@ -334,7 +431,11 @@ func (b *BackendConfiguration) Reload(config *goconf.ConfigFile) {
 	}
 
 	if backendIds, _ := config.GetString("backend", "backends"); backendIds != "" {
-		configuredHosts := getConfiguredHosts(backendIds, config)
+		configuredHosts, err := getConfiguredHosts(backendIds, config)
+		if err != nil {
+			log.Printf("Could not reload backends, keeping existing configuration: %s", err)
+			return
+		}
 
 		// remove backends that are no longer configured
 		for hostname := range b.backends {
@@ -464,3 +464,37 @@ func TestBackendReloadRemoveBackendFromSharedHost(t *testing.T) {
 		t.Error("BackendConfiguration should be equal after Reload")
 	}
 }
+
+func TestBackendInvalidPublicKey(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("backend", "backends", "backend1")
+	config.AddOption("backend", "allowall", "false")
+	config.AddOption("backend1", "url", "http://domain1.invalid/foo/")
+	config.AddOption("backend1", "secret", string(testBackendSecret)+"-backend1")
+	config.AddOption("backend1", "publickey", "/path/does/not/exist.pem")
+	if cfg, err := NewBackendConfiguration(config); err == nil {
+		t.Errorf("Expected error for invalid public key, got %+v", cfg)
+	}
+}
+
+func TestParseWebhookUrl(t *testing.T) {
+	testcases := []struct {
+		url       string
+		allowHttp bool
+		valid     bool
+	}{
+		{"https://domain.invalid/webhook", false, true},
+		{"https://domain.invalid/webhook", true, true},
+		{"http://domain.invalid/webhook", true, true},
+		{"http://domain.invalid/webhook", false, false},
+		{"ftp://domain.invalid/webhook", true, false},
+		{"://domain.invalid", true, false},
+	}
+	for _, tc := range testcases {
+		if u, err := parseWebhookUrl(tc.url, tc.allowHttp); tc.valid && err != nil {
+			t.Errorf("Expected %s to be valid (allowHttp=%t), got %s", tc.url, tc.allowHttp, err)
+		} else if !tc.valid && err == nil {
+			t.Errorf("Expected %s to be invalid (allowHttp=%t), got %s", tc.url, tc.allowHttp, u)
+		}
+	}
+}
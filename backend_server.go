@@ -25,6 +25,7 @@ import (
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -41,17 +42,36 @@ import (
 
 	"github.com/dlintw/goconf"
 	"github.com/gorilla/mux"
+	"github.com/nats-io/nats.go"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const (
 	maxBodySize = 64 * 1024
+	// Batch requests contain multiple room requests.
+	maxBatchBodySize = 1024 * 1024
+
+	// Maximum number of room requests in a batch request.
+	maxBatchEntries = 100
+
+	// Maximum number of rooms that are processed concurrently in batch requests.
+	maxBatchConcurrency = 8
 
 	randomUsernameLength = 32
 
 	sessionIdNotInMeeting = "0"
 )
 
+var (
+	authenticationFailedError = NewError("authentication_failed", "Authentication check failed")
+	noSuchRoomError           = NewError("no_such_room", "The room is not active on any server.")
+	noSuchSessionError        = NewError("no_such_session", "The session does not exist on any server.")
+	processingFailedError     = NewError("processing_failed", "Error while processing")
+
+	// Time to wait for a server hosting the room to confirm a recording request.
+	recordingTimeout = time.Second
+)
+
 type BackendServer struct {
 	hub          *Hub
 	nats         NatsClient
@@ -67,6 +87,8 @@ type BackendServer struct {
 
 	statsAllowedIps map[string]bool
 	invalidSecret   []byte
+
+	adminSecret []byte
 }
 
 func NewBackendServer(config *goconf.ConfigFile, hub *Hub, version string) (*BackendServer, error) {
@@ -117,6 +139,13 @@ func NewBackendServer(config *goconf.ConfigFile, hub *Hub, version string) (*Bac
 		}
 	}
 
+	adminSecret, _ := config.GetString("admin", "secret")
+	if adminSecret != "" {
+		log.Printf("Using configured secret for the admin API")
+	} else {
+		log.Printf("No secret configured for the admin API, using the IPs allowed for the stats endpoint")
+	}
+
 	invalidSecret := make([]byte, 32)
 	if _, err := rand.Read(invalidSecret); err != nil {
 		return nil, err
@@ -135,6 +164,8 @@ func NewBackendServer(config *goconf.ConfigFile, hub *Hub, version string) (*Bac
 
 		statsAllowedIps: statsAllowedIps,
 		invalidSecret:   invalidSecret,
+
+		adminSecret: []byte(adminSecret),
 	}, nil
 }
 
@@ -152,7 +183,13 @@ func (b *BackendServer) Start(r *mux.Router) error {
 	s := r.PathPrefix("/api/v1").Subrouter()
 	s.HandleFunc("/welcome", b.setComonHeaders(b.welcomeFunc)).Methods("GET")
 	s.HandleFunc("/room/{roomid}", b.setComonHeaders(b.parseRequestBody(b.roomHandler))).Methods("POST")
+	s.HandleFunc("/rooms", b.setComonHeaders(b.parseRequestBodyWithLimit(maxBatchBodySize, b.roomBatchHandler))).Methods("POST")
+	s.HandleFunc("/broadcast", b.setComonHeaders(b.parseRequestBody(b.broadcastHandler))).Methods("POST")
 	s.HandleFunc("/stats", b.setComonHeaders(b.validateStatsRequest(b.statsHandler))).Methods("GET")
+	s.HandleFunc("/drain", b.setComonHeaders(b.validateAdminRequest(b.drainHandler))).Methods("POST")
+	s.HandleFunc("/admin/rooms", b.setComonHeaders(b.validateAdminRequest(b.adminRoomsHandler))).Methods("GET")
+	s.HandleFunc("/admin/rooms/{roomid}", b.setComonHeaders(b.validateAdminRequest(b.adminRoomHandler))).Methods("GET", "DELETE")
+	s.HandleFunc("/admin/sessions/{sessionid}", b.setComonHeaders(b.validateAdminRequest(b.adminSessionHandler))).Methods("GET", "DELETE")
 
 	// Expose prometheus metrics at "/metrics".
 	r.HandleFunc("/metrics", b.setComonHeaders(b.validateStatsRequest(b.metricsHandler))).Methods("GET")
@@ -244,32 +281,36 @@ func (b *BackendServer) getTurnCredentials(w http.ResponseWriter, r *http.Reques
 }
 
 func (b *BackendServer) parseRequestBody(f func(http.ResponseWriter, *http.Request, []byte)) func(http.ResponseWriter, *http.Request) {
+	return b.parseRequestBodyWithLimit(maxBodySize, f)
+}
+
+func (b *BackendServer) parseRequestBodyWithLimit(limit int64, f func(http.ResponseWriter, *http.Request, []byte)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Sanity checks
 		if r.ContentLength == -1 {
-			http.Error(w, "Length required", http.StatusLengthRequired)
+			b.sendErrorResponse(w, http.StatusLengthRequired, NewError("length_required", "Length required"))
 			return
-		} else if r.ContentLength > maxBodySize {
-			http.Error(w, "Request entity too large", http.StatusRequestEntityTooLarge)
+		} else if r.ContentLength > limit {
+			b.sendErrorResponse(w, http.StatusRequestEntityTooLarge, NewError("request_too_large", "Request entity too large"))
 			return
 		}
 		ct := r.Header.Get("Content-Type")
 		if !strings.HasPrefix(ct, "application/json") {
 			log.Printf("Received unsupported content-type: %s", ct)
-			http.Error(w, "Unsupported Content-Type", http.StatusBadRequest)
+			b.sendErrorResponse(w, http.StatusBadRequest, NewError("unsupported_content_type", "Unsupported Content-Type"))
 			return
 		}
 
 		if r.Header.Get(HeaderBackendSignalingRandom) == "" ||
 			r.Header.Get(HeaderBackendSignalingChecksum) == "" {
-			http.Error(w, "Authentication check failed", http.StatusForbidden)
+			b.sendErrorResponse(w, http.StatusForbidden, authenticationFailedError)
 			return
 		}
 
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			log.Println("Error reading body: ", err)
-			http.Error(w, "Could not read body", http.StatusBadRequest)
+			b.sendErrorResponse(w, http.StatusBadRequest, NewError("invalid_body", "Could not read body"))
 			return
 		}
 
@@ -515,10 +556,7 @@ func (b *BackendServer) sendRoomMessage(roomid string, backend *Backend, request
 	return b.nats.PublishBackendServerRoomRequest(GetSubjectForBackendRoomId(roomid, backend), request)
 }
 
-func (b *BackendServer) roomHandler(w http.ResponseWriter, r *http.Request, body []byte) {
-	v := mux.Vars(r)
-	roomid := v["roomid"]
-
+func (b *BackendServer) getBackendForRequest(r *http.Request, body []byte) *Backend {
 	var backend *Backend
 	backendUrl := r.Header.Get(HeaderBackendServer)
 	if backendUrl != "" {
@@ -528,8 +566,7 @@ func (b *BackendServer) roomHandler(w http.ResponseWriter, r *http.Request, body
 
 		if backend == nil {
 			// Unknown backend URL passed, return immediately.
-			http.Error(w, "Authentication check failed", http.StatusForbidden)
-			return
+			return nil
 		}
 	}
 
@@ -549,24 +586,85 @@ func (b *BackendServer) roomHandler(w http.ResponseWriter, r *http.Request, body
 		}
 
 		if backend == nil {
-			http.Error(w, "Authentication check failed", http.StatusForbidden)
-			return
+			return nil
 		}
 	}
 
 	if !ValidateBackendChecksum(r, body, backend.Secret()) {
-		http.Error(w, "Authentication check failed", http.StatusForbidden)
-		return
+		return nil
 	}
 
-	var request BackendServerRoomRequest
-	if err := json.Unmarshal(body, &request); err != nil {
-		log.Printf("Error decoding body %s: %s", string(body), err)
-		http.Error(w, "Could not read body", http.StatusBadRequest)
-		return
+	return backend
+}
+
+func (b *BackendServer) sendRoomRecording(roomid string, backend *Backend, request *BackendServerRoomRequest) error {
+	receiver := make(chan *nats.Msg, 64)
+	replyTo := "recording.reply." + newRandomString(32)
+	subscription, err := b.nats.Subscribe(replyTo, receiver)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := subscription.Unsubscribe(); err != nil {
+			log.Printf("Error closing recording subscription %s: %s", replyTo, err)
+		}
+	}()
+
+	msg := &NatsMessage{
+		SendTime: time.Now(),
+		Type:     "recording",
+		Recording: &NatsRoomRecordingMessage{
+			Type:      request.Recording.Action,
+			Recording: request.Recording.Action == "start",
+			ReplyTo:   replyTo,
+		},
+	}
+	if err := b.nats.PublishNats(GetSubjectForBackendRoomId(roomid, backend), msg); err != nil {
+		return err
 	}
 
-	request.ReceivedTime = time.Now().UnixNano()
+	// The recording state only lives in the room, so the request only has an
+	// effect if at least one server is hosting the room.
+	timer := time.NewTimer(recordingTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case message := <-receiver:
+			var response NatsMessage
+			if err := b.nats.Decode(message, &response); err != nil {
+				log.Printf("Could not decode recording response %+v: %s", message, err)
+				continue
+			} else if response.Type != "recording" || response.Recording == nil || response.Recording.Type != "ack" {
+				log.Printf("Invalid recording response %+v", response)
+				continue
+			}
+
+			return nil
+		case <-timer.C:
+			return noSuchRoomError
+		}
+	}
+}
+
+func newInvalidRoomRequestResponse(roomid string, err error) *BackendServerRoomResponse {
+	response := &BackendServerRoomResponse{
+		RoomId: roomid,
+		Status: http.StatusBadRequest,
+	}
+	if e, ok := err.(*Error); ok {
+		response.Error = e
+	} else {
+		response.Error = NewError("invalid_request", err.Error())
+	}
+	return response
+}
+
+// processRoomRequest must only be called with requests that passed "CheckValid".
+func (b *BackendServer) processRoomRequest(roomid string, backend *Backend, request *BackendServerRoomRequest) *BackendServerRoomResponse {
+	response := &BackendServerRoomResponse{
+		RoomId: roomid,
+		Status: http.StatusOK,
+	}
 
 	var err error
 	switch request.Type {
@@ -577,44 +675,221 @@ func (b *BackendServer) roomHandler(w http.ResponseWriter, r *http.Request, body
 		b.sendRoomDisinvite(roomid, backend, DisinviteReasonDisinvited, request.Disinvite.UserIds, request.Disinvite.SessionIds)
 		b.sendRoomUpdate(roomid, backend, request.Disinvite.UserIds, request.Disinvite.AllUserIds, request.Disinvite.Properties)
 	case "update":
-		err = b.nats.PublishBackendServerRoomRequest(GetSubjectForBackendRoomId(roomid, backend), &request)
+		err = b.nats.PublishBackendServerRoomRequest(GetSubjectForBackendRoomId(roomid, backend), request)
 		b.sendRoomUpdate(roomid, backend, nil, request.Update.UserIds, request.Update.Properties)
 	case "delete":
-		err = b.nats.PublishBackendServerRoomRequest(GetSubjectForBackendRoomId(roomid, backend), &request)
+		err = b.nats.PublishBackendServerRoomRequest(GetSubjectForBackendRoomId(roomid, backend), request)
 		b.sendRoomDisinvite(roomid, backend, DisinviteReasonDeleted, request.Delete.UserIds, nil)
 	case "incall":
-		err = b.sendRoomIncall(roomid, backend, &request)
+		err = b.sendRoomIncall(roomid, backend, request)
 	case "participants":
-		err = b.sendRoomParticipantsUpdate(roomid, backend, &request)
+		err = b.sendRoomParticipantsUpdate(roomid, backend, request)
 	case "message":
-		err = b.sendRoomMessage(roomid, backend, &request)
-	default:
-		http.Error(w, "Unsupported request type: "+request.Type, http.StatusBadRequest)
+		err = b.sendRoomMessage(roomid, backend, request)
+	case "recording":
+		err = b.sendRoomRecording(roomid, backend, request)
+	case "permissions":
+		// The Nextcloud session ids are resolved by the servers hosting the sessions.
+		err = b.nats.PublishBackendServerRoomRequest(GetSubjectForBackendRoomId(roomid, backend), request)
+	case "switchto":
+		// Only sessions that are in the room will be notified.
+		err = b.nats.PublishBackendServerRoomRequest(GetSubjectForBackendRoomId(roomid, backend), request)
+	}
+
+	if err == noSuchRoomError {
+		response.Status = http.StatusNotFound
+		response.Error = noSuchRoomError
+	} else if err != nil {
+		log.Printf("Error processing %+v for room %s: %s", request, roomid, err)
+		response.Status = http.StatusInternalServerError
+		response.Error = processingFailedError
+	}
+	return response
+}
+
+func (b *BackendServer) roomHandler(w http.ResponseWriter, r *http.Request, body []byte) {
+	v := mux.Vars(r)
+	roomid := v["roomid"]
+
+	backend := b.getBackendForRequest(r, body)
+	if backend == nil {
+		b.sendErrorResponse(w, http.StatusForbidden, authenticationFailedError)
 		return
 	}
 
-	if err != nil {
-		log.Printf("Error processing %s for room %s: %s", string(body), roomid, err)
-		http.Error(w, "Error while processing", http.StatusInternalServerError)
+	var request BackendServerRoomRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		log.Printf("Error decoding body %s: %s", string(body), err)
+		b.sendErrorResponse(w, http.StatusBadRequest, NewError("invalid_body", "Could not decode body: "+err.Error()))
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.Header().Set("X-Content-Type-Options", "nosniff")
-	w.WriteHeader(http.StatusOK)
-	// TODO(jojo): Return better response struct.
-	w.Write([]byte("{}")) // nolint
+	request.ReceivedTime = time.Now().UnixNano()
+
+	var response *BackendServerRoomResponse
+	if err := request.CheckValid(); err != nil {
+		response = newInvalidRoomRequestResponse(roomid, err)
+	} else {
+		response = b.processRoomRequest(roomid, backend, &request)
+	}
+	b.sendJSONResponseWithStatus(w, response.Status, response)
 }
 
-func (b *BackendServer) validateStatsRequest(f func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		addr := getRealUserIP(r)
-		if strings.Contains(addr, ":") {
-			if host, _, err := net.SplitHostPort(addr); err == nil {
-				addr = host
+func (b *BackendServer) roomBatchHandler(w http.ResponseWriter, r *http.Request, body []byte) {
+	backend := b.getBackendForRequest(r, body)
+	if backend == nil {
+		b.sendErrorResponse(w, http.StatusForbidden, authenticationFailedError)
+		return
+	}
+
+	var request BackendServerRoomBatchRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		log.Printf("Error decoding body %s: %s", string(body), err)
+		b.sendErrorResponse(w, http.StatusBadRequest, NewError("invalid_body", "Could not decode body: "+err.Error()))
+		return
+	}
+
+	if len(request.Requests) > maxBatchEntries {
+		b.sendErrorResponse(w, http.StatusBadRequest, NewError("too_many_requests", fmt.Sprintf("At most %d requests are allowed in a batch", maxBatchEntries)))
+		return
+	}
+
+	// Requests for the same room are processed in the given order, different
+	// rooms are processed concurrently.
+	responses := make([]*BackendServerRoomResponse, len(request.Requests))
+	var rooms []string
+	roomEntries := make(map[string][]int)
+	for idx, entry := range request.Requests {
+		if entry == nil || entry.RoomId == "" {
+			responses[idx] = &BackendServerRoomResponse{
+				Status: http.StatusBadRequest,
+				Error:  NewBackendMissingFieldError("roomid"),
 			}
+			continue
+		} else if entry.Request == nil {
+			responses[idx] = &BackendServerRoomResponse{
+				RoomId: entry.RoomId,
+				Status: http.StatusBadRequest,
+				Error:  NewBackendMissingFieldError("request"),
+			}
+			continue
+		} else if err := entry.Request.CheckValid(); err != nil {
+			responses[idx] = newInvalidRoomRequestResponse(entry.RoomId, err)
+			continue
+		}
+
+		entry.Request.ReceivedTime = time.Now().UnixNano()
+		if _, found := roomEntries[entry.RoomId]; !found {
+			rooms = append(rooms, entry.RoomId)
 		}
-		if !b.statsAllowedIps[addr] {
+		roomEntries[entry.RoomId] = append(roomEntries[entry.RoomId], idx)
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxBatchConcurrency)
+	for _, roomid := range rooms {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(roomid string, indices []int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			for _, idx := range indices {
+				responses[idx] = b.processRoomRequest(roomid, backend, request.Requests[idx].Request)
+			}
+		}(roomid, roomEntries[roomid])
+	}
+	wg.Wait()
+
+	b.sendJSONResponse(w, &BackendServerRoomBatchResponse{
+		Responses: responses,
+	})
+}
+
+func (b *BackendServer) broadcastHandler(w http.ResponseWriter, r *http.Request, body []byte) {
+	backend := b.getBackendForRequest(r, body)
+	if backend == nil {
+		b.sendErrorResponse(w, http.StatusForbidden, authenticationFailedError)
+		return
+	}
+
+	var request BackendServerBroadcastRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		log.Printf("Error decoding body %s: %s", string(body), err)
+		b.sendErrorResponse(w, http.StatusBadRequest, NewError("invalid_body", "Could not decode body: "+err.Error()))
+		return
+	}
+
+	if err := request.CheckValid(); err != nil {
+		if e, ok := err.(*Error); ok {
+			b.sendErrorResponse(w, http.StatusBadRequest, e)
+		} else {
+			b.sendErrorResponse(w, http.StatusBadRequest, NewError("invalid_request", err.Error()))
+		}
+		return
+	}
+
+	var msg *ServerMessage
+	switch request.Type {
+	case "message":
+		msg = &ServerMessage{
+			Type: "message",
+			Message: &MessageServerMessage{
+				Sender: &MessageServerMessageSender{
+					Type: SenderTypeBackend,
+				},
+				Data: request.Data,
+			},
+		}
+	case "event":
+		msg = &ServerMessage{
+			Type: "event",
+			Event: &EventServerMessage{
+				Target: "backend",
+				Type:   "broadcast",
+				Broadcast: &BroadcastEventServerMessage{
+					Data: request.Data,
+				},
+			},
+		}
+	}
+
+	message := &NatsMessage{
+		SendTime: time.Now(),
+		Type:     "broadcast",
+		Broadcast: &NatsBroadcastMessage{
+			BackendId: backend.Id(),
+			UserIds:   request.UserIds,
+			Message:   msg,
+		},
+	}
+	// Every server of the cluster delivers the broadcast to its own sessions.
+	if err := b.nats.PublishNats(GetSubjectForBackendId(backend), message); err != nil {
+		log.Printf("Could not publish broadcast %+v to backend %s: %s", request, backend.Id(), err)
+		b.sendErrorResponse(w, http.StatusInternalServerError, processingFailedError)
+		return
+	}
+
+	b.sendJSONResponse(w, &BackendServerRoomResponse{
+		Status: http.StatusOK,
+	})
+}
+
+func (b *BackendServer) isStatsAllowed(r *http.Request) bool {
+	addr := getRealUserIP(r)
+	if strings.Contains(addr, ":") {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			addr = host
+		}
+	}
+	return b.statsAllowedIps[addr]
+}
+
+func (b *BackendServer) validateStatsRequest(f func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !b.isStatsAllowed(r) {
 			http.Error(w, "Authentication check failed", http.StatusForbidden)
 			return
 		}
@@ -638,6 +913,160 @@ func (b *BackendServer) statsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(statsData) // nolint
 }
 
+func (b *BackendServer) drainHandler(w http.ResponseWriter, r *http.Request) {
+	if b.hub.Drain() {
+		log.Printf("Draining requested from %s", getRealUserIP(r))
+	}
+
+	b.sendJSONResponse(w, &BackendServerRoomResponse{
+		Status: http.StatusOK,
+	})
+}
+
+func (b *BackendServer) validateAdminRequest(f func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(b.adminSecret) == 0 {
+			if !b.isStatsAllowed(r) {
+				b.sendErrorResponse(w, http.StatusForbidden, authenticationFailedError)
+				return
+			}
+		} else {
+			auth := r.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(auth[7:]), b.adminSecret) != 1 {
+				b.sendErrorResponse(w, http.StatusForbidden, authenticationFailedError)
+				return
+			}
+		}
+
+		f(w, r)
+	}
+}
+
+func (b *BackendServer) sendJSONResponse(w http.ResponseWriter, response interface{}) {
+	b.sendJSONResponseWithStatus(w, http.StatusOK, response)
+}
+
+func (b *BackendServer) sendErrorResponse(w http.ResponseWriter, status int, e *Error) {
+	b.sendJSONResponseWithStatus(w, status, &BackendServerRoomResponse{
+		Status: status,
+		Error:  e,
+	})
+}
+
+func (b *BackendServer) sendJSONResponseWithStatus(w http.ResponseWriter, status int, response interface{}) {
+	data, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		log.Printf("Could not serialize response %+v: %s", response, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(data) // nolint
+}
+
+func (b *BackendServer) getBackendById(id string) *Backend {
+	if backend := b.hub.backend.GetCompatBackend(); backend != nil && backend.Id() == id {
+		return backend
+	}
+
+	for _, backend := range b.hub.backend.GetBackends() {
+		if backend.Id() == id {
+			return backend
+		}
+	}
+	return nil
+}
+
+func (b *BackendServer) adminRoomsHandler(w http.ResponseWriter, r *http.Request) {
+	rooms, err := b.hub.GetAdminRooms()
+	if err != nil {
+		log.Printf("Could not get rooms: %s", err)
+		b.sendErrorResponse(w, http.StatusInternalServerError, processingFailedError)
+		return
+	}
+
+	b.sendJSONResponse(w, &AdminRoomsResponse{
+		Rooms: rooms,
+	})
+}
+
+func (b *BackendServer) adminRoomHandler(w http.ResponseWriter, r *http.Request) {
+	v := mux.Vars(r)
+	roomid := v["roomid"]
+	// The same room id could be used on different backends.
+	backendId := r.URL.Query().Get("backend")
+
+	rooms, err := b.hub.GetAdminRooms()
+	if err != nil {
+		log.Printf("Could not get rooms: %s", err)
+		b.sendErrorResponse(w, http.StatusInternalServerError, processingFailedError)
+		return
+	}
+
+	var result []*AdminRoomEntry
+	for _, room := range rooms {
+		if room.RoomId == roomid && (backendId == "" || room.Backend == backendId) {
+			result = append(result, room)
+		}
+	}
+	if len(result) == 0 {
+		b.sendErrorResponse(w, http.StatusNotFound, noSuchRoomError)
+		return
+	}
+
+	if r.Method == "DELETE" {
+		for _, room := range result {
+			request := &BackendServerRoomRequest{
+				Type:   "delete",
+				Delete: &BackendRoomDeleteRequest{},
+
+				ReceivedTime: time.Now().UnixNano(),
+			}
+			log.Printf("Closing room %s of backend %s through admin API", room.RoomId, room.Backend)
+			if err := b.nats.PublishBackendServerRoomRequest(GetSubjectForBackendRoomId(room.RoomId, b.getBackendById(room.Backend)), request); err != nil {
+				log.Printf("Could not close room %s of backend %s: %s", room.RoomId, room.Backend, err)
+				b.sendErrorResponse(w, http.StatusInternalServerError, processingFailedError)
+				return
+			}
+		}
+	}
+
+	b.sendJSONResponse(w, &AdminRoomsResponse{
+		Rooms: result,
+	})
+}
+
+func (b *BackendServer) adminSessionHandler(w http.ResponseWriter, r *http.Request) {
+	v := mux.Vars(r)
+	sessionid := v["sessionid"]
+
+	session, err := b.hub.GetAdminSession(sessionid)
+	if err != nil {
+		log.Printf("Could not get session %s: %s", sessionid, err)
+		b.sendErrorResponse(w, http.StatusInternalServerError, processingFailedError)
+		return
+	} else if session == nil {
+		b.sendErrorResponse(w, http.StatusNotFound, noSuchSessionError)
+		return
+	}
+
+	if r.Method == "DELETE" {
+		if closed, err := b.hub.CloseAdminSession(sessionid); err != nil {
+			log.Printf("Could not close session %s: %s", sessionid, err)
+			b.sendErrorResponse(w, http.StatusInternalServerError, processingFailedError)
+			return
+		} else if !closed {
+			b.sendErrorResponse(w, http.StatusNotFound, noSuchSessionError)
+			return
+		}
+	}
+
+	b.sendJSONResponse(w, session)
+}
+
 func (b *BackendServer) metricsHandler(w http.ResponseWriter, r *http.Request) {
 	promhttp.Handler().ServeHTTP(w, r)
 }
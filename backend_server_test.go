@@ -313,6 +313,57 @@ func TestBackendServer_UnsupportedRequest(t *testing.T) {
 	}
 }
 
+func TestBackendServer_InvalidRequestField(t *testing.T) {
+	_, _, _, _, _, server, shutdown := CreateBackendServerForTest(t)
+	defer shutdown()
+
+	// Invites without "invite" object must not be processed.
+	msg := &BackendServerRoomRequest{
+		Type: "invite",
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roomId := "the-room-id"
+	res, err := performBackendRequest(server.URL+"/api/v1/room/"+roomId, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected error response, got %s: %s", res.Status, string(body))
+	}
+	if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("Expected JSON response, got %s", ct)
+	}
+
+	var response struct {
+		RoomId string `json:"roomid"`
+		Error  struct {
+			Code    string                    `json:"code"`
+			Details BackendServerErrorDetails `json:"details"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.RoomId != roomId {
+		t.Errorf("Expected room %s, got %s", roomId, string(body))
+	}
+	if response.Error.Code != "missing_field" {
+		t.Errorf("Expected missing_field error, got %s", string(body))
+	}
+	if response.Error.Details.Field != "invite" {
+		t.Errorf("Expected error for field invite, got %s", string(body))
+	}
+}
+
 func TestBackendServer_RoomInvite(t *testing.T) {
 	_, _, n, hub, _, server, shutdown := CreateBackendServerForTest(t)
 	defer shutdown()
@@ -1213,7 +1264,7 @@ func TestBackendServer_RoomMessage(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
 	defer cancel()
 
-	_, err := client.RunUntilHello(ctx)
+	hello1, err := client.RunUntilHello(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1264,21 +1315,111 @@ func TestBackendServer_RoomMessage(t *testing.T) {
 	} else if !bytes.Equal(messageData, *message.Data) {
 		t.Errorf("Expected message data %s, got %s", string(messageData), string(*message.Data))
 	}
+
+	// Sessions joining later will receive the message after joining.
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client2.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client2.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	// The own "join" event is sent through NATS and might be received after
+	// the message from the history.
+	if message, err := client2.RunUntilRoomMessageIgnoringJoin(ctx); err != nil {
+		t.Error(err)
+	} else if message.RoomId != roomId {
+		t.Errorf("Expected message for room %s, got %s", roomId, message.RoomId)
+	} else if !bytes.Equal(messageData, *message.Data) {
+		t.Errorf("Expected message data %s, got %s", string(messageData), string(*message.Data))
+	}
 }
 
-func TestBackendServer_TurnCredentials(t *testing.T) {
-	_, _, _, _, _, server, shutdown := CreateBackendServerForTestWithTurn(t)
+func TestBackendServer_RoomBatch(t *testing.T) {
+	_, _, _, hub, _, server, shutdown := CreateBackendServerForTest(t)
 	defer shutdown()
 
-	q := make(url.Values)
-	q.Set("service", "turn")
-	q.Set("api", turnApiKey)
-	request, err := http.NewRequest("GET", server.URL+"/turn/credentials?"+q.Encode(), nil)
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	if _, err := client.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// Ignore "join" events.
+	if err := client.DrainMessages(ctx); err != nil {
+		t.Error(err)
+	}
+
+	messageData1 := json.RawMessage("{\"foo\":\"bar\"}")
+	messageData2 := json.RawMessage("{\"bar\":\"baz\"}")
+	msg := &BackendServerRoomBatchRequest{
+		Requests: []*BackendServerRoomBatchEntry{
+			{
+				RoomId: roomId,
+				Request: &BackendServerRoomRequest{
+					Type: "message",
+					Message: &BackendRoomMessageRequest{
+						Data: &messageData1,
+					},
+				},
+			},
+			{
+				RoomId: "other-room",
+				Request: &BackendServerRoomRequest{
+					Type: "lala",
+				},
+			},
+			{
+				RoomId: "missing-request",
+			},
+			{
+				RoomId: "missing-invite",
+				Request: &BackendServerRoomRequest{
+					Type: "invite",
+				},
+			},
+			{
+				RoomId: roomId,
+				Request: &BackendServerRoomRequest{
+					Type: "message",
+					Message: &BackendRoomMessageRequest{
+						Data: &messageData2,
+					},
+				},
+			},
+		},
+	}
+
+	data, err := json.Marshal(msg)
 	if err != nil {
 		t.Fatal(err)
 	}
-	client := &http.Client{}
-	res, err := client.Do(request)
+	res, err := performBackendRequest(server.URL+"/api/v1/rooms", data)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1288,24 +1429,1030 @@ func TestBackendServer_TurnCredentials(t *testing.T) {
 		t.Error(err)
 	}
 	if res.StatusCode != 200 {
-		t.Errorf("Expected successful request, got %s: %s", res.Status, string(body))
+		t.Fatalf("Expected successful request, got %s: %s", res.Status, string(body))
 	}
 
-	var cred TurnCredentials
-	if err := json.Unmarshal(body, &cred); err != nil {
+	var response BackendServerRoomBatchResponse
+	if err := json.Unmarshal(body, &response); err != nil {
 		t.Fatal(err)
 	}
+	expected := []struct {
+		RoomId string
+		Status int
+		Code   string
+	}{
+		{roomId, http.StatusOK, ""},
+		{"other-room", http.StatusBadRequest, "unsupported_type"},
+		{"missing-request", http.StatusBadRequest, "missing_field"},
+		{"missing-invite", http.StatusBadRequest, "missing_field"},
+		{roomId, http.StatusOK, ""},
+	}
+	if len(response.Responses) != len(expected) {
+		t.Fatalf("Expected %d responses, got %+v", len(expected), response.Responses)
+	}
+	for idx, r := range response.Responses {
+		var code string
+		if r.Error != nil {
+			code = r.Error.Code
+		}
+		if r.RoomId != expected[idx].RoomId || r.Status != expected[idx].Status || code != expected[idx].Code {
+			t.Errorf("Expected response %d to be %+v, got %+v", idx, expected[idx], r)
+		}
+	}
 
-	m := hmac.New(sha1.New, []byte(turnSecret))
-	m.Write([]byte(cred.Username)) // nolint
-	password := base64.StdEncoding.EncodeToString(m.Sum(nil))
-	if cred.Password != password {
-		t.Errorf("Expected password %s, got %s", password, cred.Password)
+	// Messages for the same room are delivered in order.
+	for _, expectedData := range []json.RawMessage{messageData1, messageData2} {
+		if message, err := client.RunUntilRoomMessage(ctx); err != nil {
+			t.Error(err)
+		} else if message.RoomId != roomId {
+			t.Errorf("Expected message for room %s, got %s", roomId, message.RoomId)
+		} else if !bytes.Equal(expectedData, *message.Data) {
+			t.Errorf("Expected message data %s, got %s", string(expectedData), string(*message.Data))
+		}
 	}
-	if cred.TTL != int64((24 * time.Hour).Seconds()) {
-		t.Errorf("Expected a TTL of %d, got %d", int64((24 * time.Hour).Seconds()), cred.TTL)
+}
+
+func TestBackendServer_RoomBatchTooManyRequests(t *testing.T) {
+	_, _, _, _, _, server, shutdown := CreateBackendServerForTest(t)
+	defer shutdown()
+
+	msg := &BackendServerRoomBatchRequest{}
+	for i := 0; i <= maxBatchEntries; i++ {
+		msg.Requests = append(msg.Requests, &BackendServerRoomBatchEntry{
+			RoomId: fmt.Sprintf("room-%d", i),
+			Request: &BackendServerRoomRequest{
+				Type: "delete",
+				Delete: &BackendRoomDeleteRequest{
+					UserIds: []string{testDefaultUserId},
+				},
+			},
+		})
 	}
-	if !reflect.DeepEqual(cred.URIs, turnServers) {
-		t.Errorf("Expected the list of servers as %s, got %s", turnServers, cred.URIs)
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := performBackendRequest(server.URL+"/api/v1/rooms", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected bad request, got %s: %s", res.Status, string(body))
+	}
+
+	var response BackendServerRoomResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		t.Fatal(err)
+	} else if response.Error == nil || response.Error.Code != "too_many_requests" {
+		t.Errorf("Expected too_many_requests error, got %+v", response)
+	}
+}
+
+func performPermissionsRequest(t *testing.T, server *httptest.Server, roomId string, request *BackendRoomPermissionsRequest) {
+	msg := &BackendServerRoomRequest{
+		Type:        "permissions",
+		Permissions: request,
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := performBackendRequest(server.URL+"/api/v1/room/"+roomId, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected successful request, got %s: %s", res.Status, string(body))
+	}
+}
+
+func checkMessagePermissions(message *ServerMessage, roomId string, sessionId string, permissions []Permission) error {
+	if err := checkMessageType(message, "event"); err != nil {
+		return err
+	} else if message.Event.Target != "participants" || message.Event.Type != "permissions" {
+		return fmt.Errorf("Expected permissions event, got %+v", message.Event)
+	} else if message.Event.Permissions.RoomId != roomId {
+		return fmt.Errorf("Expected room %s, got %+v", roomId, message.Event.Permissions)
+	} else if message.Event.Permissions.SessionId != sessionId {
+		return fmt.Errorf("Expected session %s, got %+v", sessionId, message.Event.Permissions)
+	} else if !reflect.DeepEqual(message.Event.Permissions.Permissions, permissions) {
+		return fmt.Errorf("Expected permissions %+v, got %+v", permissions, message.Event.Permissions)
+	}
+	return nil
+}
+
+func TestBackendServer_RoomPermissionsClustered(t *testing.T) {
+	hub1, hub2, server1, server2, shutdown := CreateClusteredHubsForTest(t)
+	defer shutdown()
+
+	client1 := NewTestClient(t, server1, hub1)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	client2 := NewTestClient(t, server2, hub2)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+	if err := client2.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+
+	session1 := hub1.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	session2 := hub2.GetSessionByPublicId(hello2.Hello.SessionId).(*ClientSession)
+
+	// Update session on the other server by its Nextcloud session id.
+	permissions2 := []Permission{PERMISSION_MAY_PUBLISH_AUDIO}
+	performPermissionsRequest(t, server1, roomId, &BackendRoomPermissionsRequest{
+		SessionIds:  []string{roomId + "-" + hello2.Hello.SessionId},
+		Permissions: permissions2,
+	})
+	if message, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Error(err)
+	} else if err := checkMessagePermissions(message, roomId, hello2.Hello.SessionId, permissions2); err != nil {
+		t.Error(err)
+	}
+	if !session2.HasPermission(PERMISSION_MAY_PUBLISH_AUDIO) {
+		t.Errorf("Session %s should be allowed to publish audio", session2.PublicId())
+	}
+	if session2.HasPermission(PERMISSION_MAY_PUBLISH_VIDEO) {
+		t.Errorf("Session %s should not be allowed to publish video", session2.PublicId())
+	}
+
+	// Remove all permissions from the sessions of a user.
+	permissions1 := []Permission{}
+	performPermissionsRequest(t, server2, roomId, &BackendRoomPermissionsRequest{
+		UserIds:     []string{testDefaultUserId + "1"},
+		Permissions: permissions1,
+	})
+	if message, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Error(err)
+	} else if err := checkMessagePermissions(message, roomId, hello1.Hello.SessionId, permissions1); err != nil {
+		t.Error(err)
+	}
+	if session1.HasPermission(PERMISSION_MAY_PUBLISH_AUDIO) {
+		t.Errorf("Session %s should not be allowed to publish audio", session1.PublicId())
+	}
+	// The other session was not modified.
+	if !session2.HasPermission(PERMISSION_MAY_PUBLISH_AUDIO) {
+		t.Errorf("Session %s should be allowed to publish audio", session2.PublicId())
+	}
+}
+
+func performBroadcastRequest(server *httptest.Server, request *BackendServerBroadcastRequest) (int, *BackendServerRoomResponse, error) {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return 0, nil, err
+	}
+	res, err := performBackendRequest(server.URL+"/api/v1/broadcast", data)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	var response BackendServerRoomResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return 0, nil, fmt.Errorf("Could not decode response %s: %s", string(body), err)
+	}
+	return res.StatusCode, &response, nil
+}
+
+func TestBackendServer_BroadcastClustered(t *testing.T) {
+	hub1, hub2, server1, server2, shutdown := CreateClusteredHubsForTest(t)
+	defer shutdown()
+
+	client1 := NewTestClient(t, server1, hub1)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	client2 := NewTestClient(t, server2, hub2)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	if _, err := client1.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client2.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	client3 := NewTestClient(t, server1, hub1)
+	defer client3.CloseWithBye()
+	if err := client3.SendHello(testDefaultUserId + "3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client3.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each server subscribes once to the broadcasts of the backend.
+	backend := hub1.backend.GetCompatBackend()
+	loopback := hub1.nats.(*LoopbackNatsClient)
+	loopback.mu.Lock()
+	subscriptions := len(loopback.subscriptions[GetSubjectForBackendId(backend)])
+	loopback.mu.Unlock()
+	if subscriptions != 2 {
+		t.Errorf("Expected 2 subscriptions for backend %s, got %d", backend.Id(), subscriptions)
+	}
+
+	// Messages are sent to all sessions of the backend, even if they are not
+	// in a room.
+	messageData := json.RawMessage("{\"notice\":\"maintenance\"}")
+	if status, response, err := performBroadcastRequest(server1, &BackendServerBroadcastRequest{
+		Type: "message",
+		Data: &messageData,
+	}); err != nil {
+		t.Fatal(err)
+	} else if status != http.StatusOK || response.Status != http.StatusOK {
+		t.Fatalf("Expected successful request, got %d: %+v", status, response)
+	}
+
+	for _, client := range []*TestClient{client1, client2, client3} {
+		if message, err := client.RunUntilMessage(ctx); err != nil {
+			t.Error(err)
+		} else if err := checkMessageType(message, "message"); err != nil {
+			t.Error(err)
+		} else if message.Message.Sender.Type != SenderTypeBackend {
+			t.Errorf("Expected sender type %s, got %+v", SenderTypeBackend, message.Message.Sender)
+		} else if !bytes.Equal(messageData, *message.Message.Data) {
+			t.Errorf("Expected message data %s, got %s", string(messageData), string(*message.Message.Data))
+		}
+	}
+
+	// Events can be restricted to sessions of given users.
+	eventData := json.RawMessage("{\"reload\":true}")
+	if status, response, err := performBroadcastRequest(server1, &BackendServerBroadcastRequest{
+		Type:    "event",
+		UserIds: []string{testDefaultUserId + "2"},
+		Data:    &eventData,
+	}); err != nil {
+		t.Fatal(err)
+	} else if status != http.StatusOK || response.Status != http.StatusOK {
+		t.Fatalf("Expected successful request, got %d: %+v", status, response)
+	}
+
+	if message, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Error(err)
+	} else if err := checkMessageType(message, "event"); err != nil {
+		t.Error(err)
+	} else if message.Event.Target != "backend" || message.Event.Type != "broadcast" {
+		t.Errorf("Expected broadcast event, got %+v", message.Event)
+	} else if !bytes.Equal(eventData, *message.Event.Broadcast.Data) {
+		t.Errorf("Expected event data %s, got %s", string(eventData), string(*message.Event.Broadcast.Data))
+	}
+
+	ctx2, cancel2 := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel2()
+	if message, err := client1.RunUntilMessage(ctx2); err == nil {
+		t.Errorf("Expected no message, got %+v", message)
+	} else if err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+
+	// Invalid requests are rejected.
+	if status, response, err := performBroadcastRequest(server2, &BackendServerBroadcastRequest{
+		Type: "message",
+	}); err != nil {
+		t.Fatal(err)
+	} else if status != http.StatusBadRequest || response.Error == nil || response.Error.Code != "missing_field" {
+		t.Errorf("Expected missing field error, got %d: %+v", status, response)
+	}
+}
+
+func TestBackendServer_RoomSwitchTo(t *testing.T) {
+	_, _, _, hub, _, server, shutdown := CreateBackendServerForTest(t)
+	defer shutdown()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	client3 := NewTestClient(t, server, hub)
+	defer client3.CloseWithBye()
+	if err := client3.SendHello(testDefaultUserId + "3"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello3, err := client3.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Join room by id.
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// Give message processing some time.
+	time.Sleep(10 * time.Millisecond)
+
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	WaitForUsersJoined(ctx, t, client1, hello1, client2, hello2)
+
+	otherRoomId := "other-room"
+	if room, err := client3.JoinRoom(ctx, otherRoomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != otherRoomId {
+		t.Fatalf("Expected room %s, got %s", otherRoomId, room.Room.RoomId)
+	}
+	if err := client3.RunUntilJoined(ctx, hello3.Hello); err != nil {
+		t.Error(err)
+	}
+
+	// The target room is required.
+	msg := &BackendServerRoomRequest{
+		Type:     "switchto",
+		SwitchTo: &BackendRoomSwitchToRequest{},
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := performBackendRequest(server.URL+"/api/v1/room/"+roomId, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected bad request, got %s", res.Status)
+	}
+
+	breakoutRoomId := "breakout-room"
+	msg = &BackendServerRoomRequest{
+		Type: "switchto",
+		SwitchTo: &BackendRoomSwitchToRequest{
+			RoomId: breakoutRoomId,
+			SessionIds: []string{
+				roomId + "-" + hello1.Hello.SessionId,
+				// Sessions in other rooms may not be switched.
+				otherRoomId + "-" + hello3.Hello.SessionId,
+			},
+		},
+	}
+
+	data, err = json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = performBackendRequest(server.URL+"/api/v1/room/"+roomId, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	if res.StatusCode != 200 {
+		t.Errorf("Expected successful request, got %s: %s", res.Status, string(body))
+	}
+
+	var event *EventServerMessage
+	if err := checkReceiveClientEvent(ctx, client1, "switchto", &event); err != nil {
+		t.Error(err)
+	} else if event.Target != "room" {
+		t.Errorf("Expected target room, got %+v", event)
+	} else if event.SwitchTo == nil || event.SwitchTo.RoomId != breakoutRoomId {
+		t.Errorf("Expected switch to room %s, got %+v", breakoutRoomId, event.SwitchTo)
+	}
+
+	// The session stays in the room until the client joins the target room.
+	if session := hub.GetSessionByPublicId(hello1.Hello.SessionId); session == nil {
+		t.Errorf("Session %s does not exist", hello1.Hello.SessionId)
+	} else if room := session.GetRoom(); room == nil || room.Id() != roomId {
+		t.Errorf("Expected session to be in room %s, got %+v", roomId, room)
+	}
+
+	// Only the passed sessions in the room are notified.
+	ctx2, cancel2 := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel2()
+	if message, err := client2.RunUntilMessage(ctx2); err == nil {
+		t.Errorf("Expected no message, got %+v", message)
+	} else if err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+	ctx3, cancel3 := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel3()
+	if message, err := client3.RunUntilMessage(ctx3); err == nil {
+		t.Errorf("Expected no message, got %+v", message)
+	} else if err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+
+	if room, err := client1.JoinRoom(ctx, breakoutRoomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != breakoutRoomId {
+		t.Fatalf("Expected room %s, got %s", breakoutRoomId, room.Room.RoomId)
+	}
+}
+
+func TestBackendServer_TurnCredentials(t *testing.T) {
+	_, _, _, _, _, server, shutdown := CreateBackendServerForTestWithTurn(t)
+	defer shutdown()
+
+	q := make(url.Values)
+	q.Set("service", "turn")
+	q.Set("api", turnApiKey)
+	request, err := http.NewRequest("GET", server.URL+"/turn/credentials?"+q.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{}
+	res, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	if res.StatusCode != 200 {
+		t.Errorf("Expected successful request, got %s: %s", res.Status, string(body))
+	}
+
+	var cred TurnCredentials
+	if err := json.Unmarshal(body, &cred); err != nil {
+		t.Fatal(err)
+	}
+
+	m := hmac.New(sha1.New, []byte(turnSecret))
+	m.Write([]byte(cred.Username)) // nolint
+	password := base64.StdEncoding.EncodeToString(m.Sum(nil))
+	if cred.Password != password {
+		t.Errorf("Expected password %s, got %s", password, cred.Password)
+	}
+	if cred.TTL != int64((24 * time.Hour).Seconds()) {
+		t.Errorf("Expected a TTL of %d, got %d", int64((24 * time.Hour).Seconds()), cred.TTL)
+	}
+	if !reflect.DeepEqual(cred.URIs, turnServers) {
+		t.Errorf("Expected the list of servers as %s, got %s", turnServers, cred.URIs)
+	}
+}
+
+func TestBackendServer_Drain(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("admin", "secret", "the-admin-secret")
+	_, _, _, hub, _, server, shutdown := CreateBackendServerForTestFromConfig(t, config)
+	defer shutdown()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	if _, err := client.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// Ignore "join" events.
+	if err := client.DrainMessages(ctx); err != nil {
+		t.Error(err)
+	}
+
+	// Draining requires the admin secret.
+	if res, body := performAdminRequest(t, "POST", server.URL+"/api/v1/drain", ""); res.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected forbidden, got %s: %s", res.Status, string(body))
+	}
+	if res, body := performAdminRequest(t, "POST", server.URL+"/api/v1/drain", "invalid-secret"); res.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected forbidden, got %s: %s", res.Status, string(body))
+	}
+	if hub.IsDraining() {
+		t.Error("Hub should not be draining")
+	}
+
+	if res, body := performAdminRequest(t, "POST", server.URL+"/api/v1/drain", "the-admin-secret"); res.StatusCode != http.StatusOK {
+		t.Errorf("Expected successful request, got %s: %s", res.Status, string(body))
+	} else if res.Header.Get("Content-Type") != "application/json; charset=utf-8" {
+		t.Errorf("Expected JSON response, got %s: %s", res.Header.Get("Content-Type"), string(body))
+	}
+
+	if !hub.IsDraining() {
+		t.Error("Expected hub to be draining")
+	}
+	if hub.Drain() {
+		t.Error("Should not be able to drain twice")
+	}
+
+	if message, err := client.RunUntilMessage(ctx); err != nil {
+		t.Error(err)
+	} else if err := checkMessageType(message, "bye"); err != nil {
+		t.Error(err)
+	} else if message.Bye.Reason != ByeReasonDraining {
+		t.Errorf("Expected reason %s, got %+v", ByeReasonDraining, message.Bye)
+	} else if message.Bye.Reconnect == nil || !message.Bye.Reconnect.Resume {
+		t.Errorf("Expected resumable reconnect, got %+v", message.Bye)
+	}
+
+	// No new connections are accepted while draining.
+	if conn, res, err := websocket.DefaultDialer.Dial(getWebsocketUrl(server.URL), nil); err == nil {
+		conn.Close()
+		t.Error("Expected connection to be rejected")
+	} else if res == nil || res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %+v", http.StatusServiceUnavailable, res)
+	}
+
+	// The room is kept while the session could still be resumed.
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel2()
+	if err := hub.WaitUntilDrained(ctx2); err != context.DeadlineExceeded {
+		t.Errorf("Expected timeout while waiting for rooms to close, got %v", err)
+	}
+
+	performHousekeeping(hub, time.Now().Add(sessionExpireDuration+time.Second)).Wait()
+
+	if err := hub.WaitUntilDrained(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func performRecordingRequest(t *testing.T, server *httptest.Server, roomId string, action string) *http.Response {
+	msg := &BackendServerRoomRequest{
+		Type: "recording",
+		Recording: &BackendRoomRecordingRequest{
+			Action: action,
+		},
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := performBackendRequest(server.URL+"/api/v1/room/"+roomId, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func checkMessageRecording(message *ServerMessage, roomId string, recording bool) error {
+	if err := checkMessageType(message, "event"); err != nil {
+		return err
+	} else if message.Event.Target != "room" || message.Event.Type != "recording" || message.Event.Recording == nil {
+		return fmt.Errorf("Expected recording event, got %+v", message.Event)
+	} else if message.Event.Recording.RoomId != roomId || message.Event.Recording.Recording != recording {
+		return fmt.Errorf("Expected recording %t in room %s, got %+v", recording, roomId, message.Event.Recording)
+	}
+
+	return nil
+}
+
+func runUntilRecordingIgnoringJoin(ctx context.Context, client *TestClient, roomId string, recording bool) error {
+	for {
+		msg, err := client.RunUntilMessage(ctx)
+		if err != nil {
+			return err
+		}
+
+		if msg.Type == "event" && msg.Event.Target == "room" && msg.Event.Type == "join" {
+			continue
+		}
+
+		return checkMessageRecording(msg, roomId, recording)
+	}
+}
+
+func waitForRecordingRequests(ctx context.Context, roomId string, count int) ([]*BackendClientRecordingRequest, error) {
+	for {
+		requests := getRecordingRequests(roomId)
+		if len(requests) >= count {
+			return requests, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return requests, ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestBackendServer_Recording(t *testing.T) {
+	_, _, _, hub, _, server, shutdown := CreateBackendServerForTest(t)
+	defer shutdown()
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room-recording"
+	clearRecordingRequests(roomId)
+
+	// The request fails if no server is hosting the room.
+	if res := performRecordingRequest(t, server, roomId, "start"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected not found for inactive room, got %s", res.Status)
+	} else {
+		var response BackendServerRoomResponse
+		if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+			t.Error(err)
+		} else if response.Error == nil || response.Error.Code != "no_such_room" {
+			t.Errorf("Expected no_such_room error, got %+v", response)
+		}
+	}
+
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	session1.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_AUDIO, PERMISSION_MAY_PUBLISH_VIDEO})
+
+	if err := client1.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "offer",
+		Sid:      "54321",
+		RoomType: "video",
+		Payload: map[string]interface{}{
+			"sdp": MockSdpOfferAudioAndVideo,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client1.RunUntilAnswer(ctx, MockSdpAnswerAudioAndVideo); err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := mcu.GetPublisher(hello1.Hello.SessionId)
+	if publisher == nil {
+		t.Fatalf("No publisher for %s found", hello1.Hello.SessionId)
+	}
+
+	if res := performRecordingRequest(t, server, roomId, "invalid"); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected bad request for invalid action, got %s", res.Status)
+	}
+
+	res := performRecordingRequest(t, server, roomId, "start")
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected successful request, got %s", res.Status)
+	}
+
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageRecording(msg, roomId, true); err != nil {
+		t.Error(err)
+	}
+
+	if requests, err := waitForRecordingRequests(ctx, roomId, 1); err != nil {
+		t.Fatal(err)
+	} else if r := requests[0]; r.Action != "started" || r.StreamType != streamTypeVideo || !strings.HasPrefix(r.Filename, roomId+"-") {
+		t.Errorf("Expected started recording of video stream, got %+v", r)
+	} else if recording, filename := publisher.IsRecording(); !recording || filename != r.Filename {
+		t.Errorf("Expected publisher to be recording as %s, got %t / %s", r.Filename, recording, filename)
+	}
+
+	// Sessions joining later are notified about the recording.
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// The "join" events and the recording event may be received in any order.
+	if err := runUntilRecordingIgnoringJoin(ctx, client2, roomId, true); err != nil {
+		t.Error(err)
+	}
+	if err := client1.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+
+	res = performRecordingRequest(t, server, roomId, "stop")
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected successful request, got %s", res.Status)
+	}
+
+	for _, client := range []*TestClient{client1, client2} {
+		if err := runUntilRecordingIgnoringJoin(ctx, client, roomId, false); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if requests, err := waitForRecordingRequests(ctx, roomId, 2); err != nil {
+		t.Fatal(err)
+	} else if r := requests[1]; r.Action != "stopped" || r.StreamType != streamTypeVideo {
+		t.Errorf("Expected stopped recording of video stream, got %+v", r)
+	} else if recording, _ := publisher.IsRecording(); recording {
+		t.Error("Expected publisher to no longer be recording")
+	}
+}
+
+func performAdminRequest(t *testing.T, method string, url string, secret string) (*http.Response, []byte) {
+	request, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret != "" {
+		request.Header.Set("Authorization", "Bearer "+secret)
+	}
+	res, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, body
+}
+
+func checkAdminError(body []byte, code string) error {
+	var response BackendServerRoomResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return fmt.Errorf("Could not decode error response %s: %s", string(body), err)
+	} else if response.Error == nil || response.Error.Code != code {
+		return fmt.Errorf("Expected error %s, got %s", code, string(body))
+	}
+	return nil
+}
+
+func TestBackendServer_AdminSecret(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("admin", "secret", "the-admin-secret")
+	_, _, _, _, _, server, shutdown := CreateBackendServerForTestFromConfig(t, config)
+	defer shutdown()
+
+	if res, body := performAdminRequest(t, "GET", server.URL+"/api/v1/admin/rooms", ""); res.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected forbidden without secret, got %s: %s", res.Status, string(body))
+	} else if err := checkAdminError(body, "authentication_failed"); err != nil {
+		t.Error(err)
+	}
+	if res, body := performAdminRequest(t, "GET", server.URL+"/api/v1/admin/rooms", "invalid-secret"); res.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected forbidden with invalid secret, got %s: %s", res.Status, string(body))
+	}
+	if res, body := performAdminRequest(t, "GET", server.URL+"/api/v1/admin/rooms", "the-admin-secret"); res.StatusCode != http.StatusOK {
+		t.Errorf("Expected successful request, got %s: %s", res.Status, string(body))
+	} else {
+		var response AdminRoomsResponse
+		if err := json.Unmarshal(body, &response); err != nil {
+			t.Fatal(err)
+		} else if len(response.Rooms) != 0 {
+			t.Errorf("Expected no rooms, got %+v", response.Rooms)
+		}
+	}
+}
+
+func TestBackendServer_AdminClustered(t *testing.T) {
+	hub1, hub2, server1, server2, shutdown := CreateClusteredHubsForTest(t)
+	defer shutdown()
+
+	client1 := NewTestClient(t, server1, hub1)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	client2 := NewTestClient(t, server2, hub2)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+	if err := client2.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+
+	start := time.Now()
+	res, body := performAdminRequest(t, "GET", server1.URL+"/api/v1/admin/rooms", "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected successful request, got %s: %s", res.Status, string(body))
+	}
+	// All servers respond, no need to wait for the timeout.
+	if duration := time.Since(start); duration >= adminTimeout {
+		t.Errorf("Expected response before timeout, took %s", duration)
+	}
+	var rooms AdminRoomsResponse
+	if err := json.Unmarshal(body, &rooms); err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms.Rooms) != 1 {
+		t.Fatalf("Expected one room, got %+v", rooms.Rooms)
+	} else if room := rooms.Rooms[0]; room.RoomId != roomId || len(room.Sessions) != 2 {
+		t.Errorf("Expected room %s with two sessions, got %+v", roomId, room)
+	} else {
+		for _, hello := range []*HelloServerMessage{hello1.Hello, hello2.Hello} {
+			found := false
+			for _, session := range room.Sessions {
+				if session.SessionId == hello.SessionId {
+					found = true
+					if session.UserId != hello.UserId {
+						t.Errorf("Expected user %s, got %+v", hello.UserId, session)
+					}
+				}
+			}
+			if !found {
+				t.Errorf("Session %s not found in %+v", hello.SessionId, room.Sessions)
+			}
+		}
+	}
+
+	if res, body := performAdminRequest(t, "GET", server1.URL+"/api/v1/admin/rooms/unknown-room", ""); res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected unknown room, got %s: %s", res.Status, string(body))
+	} else if err := checkAdminError(body, "no_such_room"); err != nil {
+		t.Error(err)
+	}
+
+	// The session is connected to the other server.
+	res, body = performAdminRequest(t, "GET", server1.URL+"/api/v1/admin/sessions/"+hello2.Hello.SessionId, "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected successful request, got %s: %s", res.Status, string(body))
+	}
+	var session AdminSessionEntry
+	if err := json.Unmarshal(body, &session); err != nil {
+		t.Fatal(err)
+	}
+	if session.SessionId != hello2.Hello.SessionId || session.ServerId != hub2.serverId || session.UserId != hello2.Hello.UserId ||
+		session.ClientType != HelloClientTypeClient || !session.Connected || session.RoomId != roomId {
+		t.Errorf("Unexpected session %+v", session)
+	}
+
+	if res, body := performAdminRequest(t, "GET", server1.URL+"/api/v1/admin/sessions/unknown-session", ""); res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected unknown session, got %s: %s", res.Status, string(body))
+	} else if err := checkAdminError(body, "no_such_session"); err != nil {
+		t.Error(err)
+	}
+
+	if res, body := performAdminRequest(t, "DELETE", server1.URL+"/api/v1/admin/sessions/"+hello2.Hello.SessionId, ""); res.StatusCode != http.StatusOK {
+		t.Errorf("Expected successful request, got %s: %s", res.Status, string(body))
+	}
+	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Error(err)
+	} else if err := checkMessageType(msg, "bye"); err != nil {
+		t.Error(err)
+	} else if msg.Bye.Reason != "session_closed" {
+		t.Errorf("Expected reason session_closed, got %+v", msg.Bye)
+	}
+	// The closed session left the room.
+	if rooms := hub2.getLocalAdminRooms(); len(rooms) != 0 {
+		t.Errorf("Expected no rooms on second server, got %+v", rooms)
+	}
+	if res, body := performAdminRequest(t, "GET", server2.URL+"/api/v1/admin/sessions/"+hello2.Hello.SessionId, ""); res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected closed session, got %s: %s", res.Status, string(body))
+	}
+
+	if res, body := performAdminRequest(t, "DELETE", server2.URL+"/api/v1/admin/rooms/"+roomId, ""); res.StatusCode != http.StatusOK {
+		t.Errorf("Expected successful request, got %s: %s", res.Status, string(body))
+	}
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Error(err)
+	} else if err := checkMessageRoomId(msg, ""); err != nil {
+		t.Error(err)
 	}
 }
@@ -24,6 +24,7 @@ package signaling
 import (
 	"bytes"
 	"encoding/json"
+	"io"
 	"log"
 	"strconv"
 	"strings"
@@ -101,19 +102,28 @@ type Client struct {
 	country *string
 	logRTT  bool
 
+	// Messages are exchanged as MessagePack in binary frames if non-zero.
+	messagePack uint32
+
 	session unsafe.Pointer
 
 	mu sync.Mutex
 
 	closeChan         chan bool
 	messagesDone      sync.WaitGroup
-	messageChan       chan *bytes.Buffer
+	messageChan       chan *receivedMessage
 	messageProcessing uint32
 
-	OnLookupCountry   func(*Client) string
-	OnClosed          func(*Client)
-	OnMessageReceived func(*Client, []byte)
-	OnRTTReceived     func(*Client, time.Duration)
+	OnLookupCountry       func(*Client) string
+	OnClosed              func(*Client)
+	OnMessageReceived     func(*Client, []byte)
+	OnMessagePackReceived func(*Client, []byte)
+	OnRTTReceived         func(*Client, time.Duration)
+}
+
+type receivedMessage struct {
+	buffer *bytes.Buffer
+	binary bool
 }
 
 func NewClient(conn *websocket.Conn, remoteAddress string, agent string) (*Client, error) {
@@ -132,12 +142,13 @@ func NewClient(conn *websocket.Conn, remoteAddress string, agent string) (*Clien
 		logRTT: true,
 
 		closeChan:   make(chan bool, 1),
-		messageChan: make(chan *bytes.Buffer, 16),
+		messageChan: make(chan *receivedMessage, 16),
 
-		OnLookupCountry:   func(client *Client) string { return unknownCountry },
-		OnClosed:          func(client *Client) {},
-		OnMessageReceived: func(client *Client, data []byte) {},
-		OnRTTReceived:     func(client *Client, rtt time.Duration) {},
+		OnLookupCountry:       func(client *Client) string { return unknownCountry },
+		OnClosed:              func(client *Client) {},
+		OnMessageReceived:     func(client *Client, data []byte) {},
+		OnMessagePackReceived: func(client *Client, data []byte) {},
+		OnRTTReceived:         func(client *Client, rtt time.Duration) {},
 	}
 	return client, nil
 }
@@ -146,10 +157,11 @@ func (c *Client) SetConn(conn *websocket.Conn, remoteAddress string) {
 	c.conn = conn
 	c.addr = remoteAddress
 	c.closeChan = make(chan bool, 1)
-	c.messageChan = make(chan *bytes.Buffer, 16)
+	c.messageChan = make(chan *receivedMessage, 16)
 	c.OnLookupCountry = func(client *Client) string { return unknownCountry }
 	c.OnClosed = func(client *Client) {}
 	c.OnMessageReceived = func(client *Client, data []byte) {}
+	c.OnMessagePackReceived = func(client *Client, data []byte) {}
 }
 
 func (c *Client) IsConnected() bool {
@@ -168,6 +180,20 @@ func (c *Client) SetSession(session *ClientSession) {
 	atomic.StorePointer(&c.session, unsafe.Pointer(session))
 }
 
+// SetMessagePack switches the encoding of messages sent to the client. Text
+// frames always contain JSON, binary frames contain MessagePack.
+func (c *Client) SetMessagePack(enabled bool) {
+	if enabled {
+		atomic.StoreUint32(&c.messagePack, 1)
+	} else {
+		atomic.StoreUint32(&c.messagePack, 0)
+	}
+}
+
+func (c *Client) UsesMessagePack() bool {
+	return atomic.LoadUint32(&c.messagePack) != 0
+}
+
 func (c *Client) RemoteAddr() string {
 	return c.addr
 }
@@ -306,7 +332,7 @@ func (c *Client) ReadPump() {
 			break
 		}
 
-		if messageType != websocket.TextMessage {
+		if messageType != websocket.TextMessage && (messageType != websocket.BinaryMessage || !c.UsesMessagePack()) {
 			if session := c.GetSession(); session != nil {
 				log.Printf("Unsupported message type %v from client %s", messageType, session.PublicId())
 			} else {
@@ -335,22 +361,29 @@ func (c *Client) ReadPump() {
 		}
 
 		c.messagesDone.Add(1)
-		c.messageChan <- decodeBuffer
+		c.messageChan <- &receivedMessage{
+			buffer: decodeBuffer,
+			binary: messageType == websocket.BinaryMessage,
+		}
 	}
 }
 
 func (c *Client) processMessages() {
 	for {
-		buffer := <-c.messageChan
-		if buffer == nil {
+		message := <-c.messageChan
+		if message == nil {
 			break
 		}
 
 		atomic.StoreUint32(&c.messageProcessing, 1)
-		c.OnMessageReceived(c, buffer.Bytes())
+		if message.binary {
+			c.OnMessagePackReceived(c, message.buffer.Bytes())
+		} else {
+			c.OnMessageReceived(c, message.buffer.Bytes())
+		}
 		atomic.StoreUint32(&c.messageProcessing, 0)
 		c.messagesDone.Done()
-		bufferPool.Put(buffer)
+		bufferPool.Put(message.buffer)
 	}
 
 	if atomic.LoadUint32(&c.closed) == 2 {
@@ -362,16 +395,22 @@ func (c *Client) writeInternal(message json.Marshaler) bool {
 	var closeData []byte
 
 	c.conn.SetWriteDeadline(time.Now().Add(writeWait)) // nolint
-	writer, err := c.conn.NextWriter(websocket.TextMessage)
-	if err == nil {
-		if m, ok := (interface{}(message)).(easyjson.Marshaler); ok {
-			_, err = easyjson.MarshalToWriter(m, writer)
-		} else {
-			err = json.NewEncoder(writer).Encode(message)
+	var err error
+	if c.UsesMessagePack() {
+		err = c.writeMessagePack(message)
+	} else {
+		var writer io.WriteCloser
+		writer, err = c.conn.NextWriter(websocket.TextMessage)
+		if err == nil {
+			if m, ok := (interface{}(message)).(easyjson.Marshaler); ok {
+				_, err = easyjson.MarshalToWriter(m, writer)
+			} else {
+				err = json.NewEncoder(writer).Encode(message)
+			}
+		}
+		if err == nil {
+			err = writer.Close()
 		}
-	}
-	if err == nil {
-		err = writer.Close()
 	}
 	if err != nil {
 		if err == websocket.ErrCloseSent {
@@ -401,6 +440,18 @@ close:
 	return false
 }
 
+func (c *Client) writeMessagePack(message json.Marshaler) error {
+	buffer := bufferPool.Get().(*bytes.Buffer)
+	buffer.Reset()
+	defer bufferPool.Put(buffer)
+
+	if err := encodeMessagePack(buffer, message); err != nil {
+		return err
+	}
+
+	return c.conn.WriteMessage(websocket.BinaryMessage, buffer.Bytes())
+}
+
 func (c *Client) writeError(e error) bool { // nolint
 	message := &ServerMessage{
 		Type:  "error",
@@ -447,7 +498,7 @@ func (c *Client) writeMessageLocked(message WritableClientMessage) bool {
 	if message.CloseAfterSend(session) {
 		c.conn.SetWriteDeadline(time.Now().Add(writeWait))    // nolint
 		c.conn.WriteMessage(websocket.CloseMessage, []byte{}) // nolint
-		if session != nil {
+		if session != nil && !isResumableBye(message) {
 			go session.Close()
 		}
 		go c.Close()
@@ -457,6 +508,16 @@ func (c *Client) writeMessageLocked(message WritableClientMessage) bool {
 	return true
 }
 
+func isResumableBye(message WritableClientMessage) bool {
+	msg, ok := message.(*ServerMessage)
+	if !ok || msg.Type != "bye" || msg.Bye == nil {
+		return false
+	}
+
+	// Sessions must be kept if the client should resume them after reconnecting.
+	return msg.Bye.Reconnect != nil && msg.Bye.Reconnect.Resume
+}
+
 func (c *Client) sendPing() bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -44,6 +44,9 @@ var (
 	// Warn if a session has 32 or more pending messages.
 	warnPendingMessagesCount = 32
 
+	// Keep at most 256 unacknowledged messages for replaying on resume.
+	maxReplayMessagesCount = 256
+
 	PathToOcsSignalingBackend = "ocs/v2.php/apps/spreed/api/v1/signaling/backend"
 )
 
@@ -85,11 +88,21 @@ type ClientSession struct {
 
 	publishers  map[string]McuPublisher
 	subscribers map[string]McuSubscriber
+	// Number of publishers that are currently being created.
+	pendingPublishers int
+	// Publishers and subscribers of a handed over session that are kept by
+	// the previous server until they are replaced.
+	handoverPublishers  map[string]bool
+	handoverSubscribers map[string]bool
 
 	pendingClientMessages        []*ServerMessage
 	hasPendingChat               bool
 	hasPendingParticipantsUpdate bool
 
+	supportsSequence bool
+	lastSeq          uint64
+	replayMessages   []*ServerMessage
+
 	virtualSessions map[*VirtualSession]bool
 }
 
@@ -111,6 +124,7 @@ func NewClientSession(hub *Hub, privateId string, publicId string, data *Session
 		stopRun:      make(chan bool, 1),
 		runStopped:   make(chan bool, 1),
 	}
+	s.supportsSequence = s.HasFeature(ClientFeatureSequence)
 	if s.clientType == HelloClientTypeInternal {
 		s.backendUrl = hello.Auth.internalParams.Backend
 		s.parsedBackendUrl = hello.Auth.internalParams.parsedBackend
@@ -252,14 +266,89 @@ func (s *ClientSession) SetPermissions(permissions []Permission) {
 	}
 
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	if s.supportsPermissions && permissionsEqual(s.permissions, p) {
+		s.mu.Unlock()
 		return
 	}
 
 	s.permissions = p
 	s.supportsPermissions = true
 	log.Printf("Permissions of session %s changed: %s", s.PublicId(), permissions)
+	revoked := s.revokePublishersLocked()
+	s.mu.Unlock()
+
+	for streamType, media := range revoked {
+		s.notifyPublisherRevoked(streamType, media)
+	}
+}
+
+// getRevokedMediaLocked returns the media of a publisher that the session is
+// no longer allowed to publish.
+func (s *ClientSession) getRevokedMediaLocked(streamType string, publisher McuPublisher) []string {
+	if streamType == streamTypeScreen {
+		if !s.hasPermissionLocked(PERMISSION_MAY_PUBLISH_SCREEN) {
+			return []string{"screen"}
+		}
+		return nil
+	}
+
+	if s.hasPermissionLocked(PERMISSION_MAY_PUBLISH_MEDIA) {
+		return nil
+	}
+
+	var media []string
+	if publisher.HasMedia(MediaTypeAudio) && !s.hasPermissionLocked(PERMISSION_MAY_PUBLISH_AUDIO) {
+		media = append(media, "audio")
+	}
+	if publisher.HasMedia(MediaTypeVideo) && !s.hasPermissionLocked(PERMISSION_MAY_PUBLISH_VIDEO) {
+		media = append(media, "video")
+	}
+	return media
+}
+
+// revokePublishersLocked closes all publishers that contain media the session
+// is no longer allowed to publish. Returns the revoked media per stream type.
+func (s *ClientSession) revokePublishersLocked() map[string][]string {
+	var revoked map[string][]string
+	for streamType, publisher := range s.publishers {
+		media := s.getRevokedMediaLocked(streamType, publisher)
+		if len(media) == 0 {
+			continue
+		}
+
+		delete(s.publishers, streamType)
+		log.Printf("Session %s is no longer allowed to publish %s, closing publisher %s", s.PublicId(), media, publisher.Id())
+		s.sendPublisherEvent(BackendEventPublisherStopped, streamType)
+		go func(publisher McuPublisher) {
+			publisher.Close(context.Background())
+		}(publisher)
+		if revoked == nil {
+			revoked = make(map[string][]string)
+		}
+		revoked[streamType] = media
+	}
+	return revoked
+}
+
+func (s *ClientSession) notifyPublisherRevoked(streamType string, media []string) {
+	if room := s.GetRoom(); room != nil {
+		// The session will also receive the event through the room.
+		room.publishPublisherRevoked(s, streamType, media)
+		return
+	}
+
+	s.SendMessage(&ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "participants",
+			Type:   "revoked",
+			Revoked: &RoomRevokedServerMessage{
+				SessionId:  s.PublicId(),
+				StreamType: streamType,
+				Media:      media,
+			},
+		},
+	})
 }
 
 func (s *ClientSession) Backend() *Backend {
@@ -339,8 +428,19 @@ func (s *ClientSession) getRoomJoinTime() time.Time {
 	return time.Unix(0, atomic.LoadInt64(&s.roomJoinTime))
 }
 
-func (s *ClientSession) releaseMcuObjects() {
+func (s *ClientSession) sendPublisherEvent(eventType string, streamType string) {
+	event := newWebhookEvent(eventType, "", s)
+	event.StreamType = streamType
+	s.hub.webhooks.Send(s.backend, event)
+}
+
+func (s *ClientSession) releaseMcuObjects(notify bool) {
 	if len(s.publishers) > 0 {
+		if notify {
+			for streamType := range s.publishers {
+				s.sendPublisherEvent(BackendEventPublisherStopped, streamType)
+			}
+		}
 		go func(publishers map[string]McuPublisher) {
 			ctx := context.TODO()
 			for _, publisher := range publishers {
@@ -387,7 +487,12 @@ func (s *ClientSession) closeAndWait(wait bool) {
 		}
 	}(s.virtualSessions)
 	s.virtualSessions = nil
-	s.releaseMcuObjects()
+	s.releaseMcuObjects(true)
+	if len(s.handoverPublishers) > 0 || len(s.handoverSubscribers) > 0 {
+		s.releaseHandoverMcuObjectsLocked(nil, nil)
+		s.handoverPublishers = nil
+		s.handoverSubscribers = nil
+	}
 	s.clearClientLocked(nil)
 	s.backend.RemoveSession(s)
 	if atomic.CompareAndSwapInt32(&s.running, 1, 0) {
@@ -410,6 +515,14 @@ func GetSubjectForUserId(userId string, backend *Backend) string {
 	}
 }
 
+func GetSubjectForBackendId(backend *Backend) string {
+	if backend == nil {
+		return GetEncodedSubject("backend", "")
+	} else {
+		return GetEncodedSubject("backend", backend.Id())
+	}
+}
+
 func (s *ClientSession) SubscribeNats(n NatsClient) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -448,6 +561,46 @@ func (s *ClientSession) SubscribeRoomNats(n NatsClient, roomid string, roomSessi
 	return nil
 }
 
+// isInCall returns true if the session is in the call of its current room.
+func (s *ClientSession) isInCall() bool {
+	room := s.GetRoom()
+	if room == nil {
+		return false
+	}
+
+	if room.IsSessionInCall(s) {
+		return true
+	}
+
+	if s.ClientType() != HelloClientTypeInternal {
+		return false
+	}
+
+	// Internal sessions receive the messages of the virtual sessions they
+	// manage, so they are part of the call if one of them is. Internal
+	// sessions without virtual sessions are always in the call (this is
+	// also how they are reported to the other participants).
+	s.mu.Lock()
+	virtualSessions := make([]*VirtualSession, 0, len(s.virtualSessions))
+	for session := range s.virtualSessions {
+		if session.GetRoom() == room {
+			virtualSessions = append(virtualSessions, session)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(virtualSessions) == 0 {
+		return true
+	}
+
+	for _, session := range virtualSessions {
+		if room.IsSessionInCall(session) {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *ClientSession) LeaveCall() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -458,7 +611,7 @@ func (s *ClientSession) LeaveCall() {
 	}
 
 	log.Printf("Session %s left call %s", s.PublicId(), room.Id())
-	s.releaseMcuObjects()
+	s.releaseMcuObjects(true)
 }
 
 func (s *ClientSession) LeaveRoom(notify bool) *Room {
@@ -471,9 +624,9 @@ func (s *ClientSession) LeaveRoom(notify bool) *Room {
 	}
 
 	s.doUnsubscribeRoomNats(notify)
+	s.releaseMcuObjects(notify)
 	s.SetRoom(nil)
-	s.releaseMcuObjects()
-	room.RemoveSession(s)
+	room.RemoveSession(s, notify)
 	return room
 }
 
@@ -555,6 +708,7 @@ func (s *ClientSession) SetClient(client *Client) *Client {
 	}
 
 	client.SetSession(s)
+	client.SetMessagePack(s.HasFeature(ClientFeatureMessagePack))
 	prev := s.client
 	if prev != nil {
 		s.clearClientLocked(prev)
@@ -592,7 +746,47 @@ func (s *ClientSession) sendCandidate(client McuClient, sender string, streamTyp
 	s.sendMessageUnlocked(response_message)
 }
 
+func (s *ClientSession) addSequenceLocked(message *ServerMessage) *ServerMessage {
+	if !s.supportsSequence || message.Type == "hello" {
+		// The "hello" response is not part of the sequence, so it can be
+		// sent before replaying messages on resume.
+		return message
+	}
+
+	// Messages could be sent to multiple sessions, so use a copy.
+	m := *message
+	s.lastSeq++
+	m.Seq = s.lastSeq
+	s.replayMessages = append(s.replayMessages, &m)
+	if len(s.replayMessages) > maxReplayMessagesCount {
+		s.replayMessages = s.replayMessages[len(s.replayMessages)-maxReplayMessagesCount:]
+	}
+	return &m
+}
+
+// AckMessages removes all messages up to the given sequence number from the
+// replay buffer.
+func (s *ClientSession) AckMessages(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ackMessagesLocked(seq)
+}
+
+func (s *ClientSession) ackMessagesLocked(seq uint64) {
+	idx := 0
+	for idx < len(s.replayMessages) && s.replayMessages[idx].Seq <= seq {
+		idx++
+	}
+	if idx == len(s.replayMessages) {
+		s.replayMessages = nil
+	} else if idx > 0 {
+		s.replayMessages = s.replayMessages[idx:]
+	}
+}
+
 func (s *ClientSession) sendMessageUnlocked(message *ServerMessage) bool {
+	message = s.addSequenceLocked(message)
 	if c := s.getClientUnlocked(); c != nil {
 		if c.SendMessage(message) {
 			return true
@@ -659,14 +853,79 @@ func (s *ClientSession) OnIceCompleted(client McuClient) {
 
 func (s *ClientSession) PublisherClosed(publisher McuPublisher) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	for id, p := range s.publishers {
 		if p == publisher {
 			delete(s.publishers, id)
+			s.sendPublisherEvent(BackendEventPublisherStopped, id)
 			break
 		}
 	}
+	publishing := len(s.publishers) > 0 || s.pendingPublishers > 0
+	s.mu.Unlock()
+
+	if room := s.GetRoom(); room != nil && !publishing {
+		room.RemovePublisher(s)
+	}
+
+	// The MCU doesn't notify if a closed publisher stopped talking.
+	s.PublisherTalking(publisher, false)
+}
+
+func (s *ClientSession) PublisherTalking(publisher McuPublisher, talking bool) {
+	if publisher.StreamType() != streamTypeVideo {
+		// Only the audio of regular streams is monitored.
+		return
+	}
+
+	if room := s.GetRoom(); room != nil {
+		room.SetSessionSpeaking(s, talking)
+	}
+}
+
+// SetRecording starts or stops recording all publishers of the session.
+func (s *ClientSession) SetRecording(room *Room, recording bool) {
+	s.mu.Lock()
+	publishers := make([]McuPublisher, 0, len(s.publishers))
+	for _, publisher := range s.publishers {
+		publishers = append(publishers, publisher)
+	}
+	s.mu.Unlock()
+
+	for _, publisher := range publishers {
+		go s.setPublisherRecording(room, publisher, recording)
+	}
+}
+
+func (s *ClientSession) setPublisherRecording(room *Room, publisher McuPublisher, recording bool) {
+	var filename string
+	if recording {
+		filename = fmt.Sprintf("%s-%s-%s-%s", room.Id(), time.Now().Format("20060102-150405"), publisher.StreamType(), newRandomString(8))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.hub.mcuTimeout)
+	defer cancel()
+
+	action := "stopped"
+	if recording {
+		action = "started"
+	}
+	if err := publisher.SetRecording(ctx, recording, filename); err != nil {
+		log.Printf("Could not change recording of %s publisher %s in session %s to %t: %s", publisher.StreamType(), publisher.Id(), s.PublicId(), recording, err)
+		action = "failed"
+		filename = ""
+	} else if recording {
+		log.Printf("Recording %s publisher %s of session %s as %s", publisher.StreamType(), publisher.Id(), s.PublicId(), filename)
+	} else {
+		log.Printf("Stopped recording %s publisher %s of session %s", publisher.StreamType(), publisher.Id(), s.PublicId())
+	}
+
+	request := NewBackendClientRecordingRequest(room.Id(), action, s.RoomSessionId(), s.UserId(), publisher.StreamType(), filename)
+	var response BackendClientResponse
+	if err := s.hub.backend.PerformJSONRequest(ctx, s.ParsedBackendUrl(), request, &response); err != nil {
+		log.Printf("Could not notify backend about recording %s of session %s in room %s: %s", action, s.PublicId(), room.Id(), err)
+	} else if response.Type == "error" {
+		log.Printf("Backend returned error for recording %s of session %s in room %s: %+v", action, s.PublicId(), room.Id(), response.Error)
+	}
 }
 
 func (s *ClientSession) SubscriberClosed(subscriber McuSubscriber) {
@@ -817,9 +1076,22 @@ func (s *ClientSession) GetOrCreatePublisher(ctx context.Context, mcu Mcu, strea
 
 	publisher, found := s.publishers[streamType]
 	if !found {
+		room := s.GetRoom()
 		client := s.getClientUnlocked()
+		s.pendingPublishers++
 		s.mu.Unlock()
 
+		// The slot in the room is reserved before the publisher is created, so
+		// concurrent offers are checked against the limit atomically. The room
+		// must not be called while the session is locked.
+		if room != nil {
+			if err := room.AddPublisher(s); err != nil {
+				s.mu.Lock()
+				s.pendingPublishers--
+				return nil, err
+			}
+		}
+
 		bitrate := data.Bitrate
 		if backend := s.Backend(); backend != nil {
 			var maxBitrate int
@@ -837,7 +1109,13 @@ func (s *ClientSession) GetOrCreatePublisher(ctx context.Context, mcu Mcu, strea
 		var err error
 		publisher, err = mcu.NewPublisher(ctx, s, s.PublicId(), streamType, bitrate, mediaTypes, client)
 		s.mu.Lock()
+		s.pendingPublishers--
 		if err != nil {
+			if room != nil && len(s.publishers) == 0 && s.pendingPublishers == 0 {
+				s.mu.Unlock()
+				room.RemovePublisher(s)
+				s.mu.Lock()
+			}
 			return nil, err
 		}
 		if s.publishers == nil {
@@ -852,6 +1130,14 @@ func (s *ClientSession) GetOrCreatePublisher(ctx context.Context, mcu Mcu, strea
 			publisher = prev
 		} else {
 			s.publishers[streamType] = publisher
+			s.sendPublisherEvent(BackendEventPublisherStarted, streamType)
+			if s.handoverPublishers[streamType] {
+				delete(s.handoverPublishers, streamType)
+				s.releaseHandoverMcuObjectsLocked([]string{streamType}, nil)
+			}
+			if room != nil && room.IsRecording() {
+				go s.setPublisherRecording(room, publisher, true)
+			}
 		}
 		log.Printf("Publishing %s as %s for session %s", streamType, publisher.Id(), s.PublicId())
 	}
@@ -893,6 +1179,10 @@ func (s *ClientSession) GetOrCreateSubscriber(ctx context.Context, mcu Mcu, id s
 			subscriber = prev
 		} else {
 			s.subscribers[id+"|"+streamType] = subscriber
+			if s.handoverSubscribers[id+"|"+streamType] {
+				delete(s.handoverSubscribers, id+"|"+streamType)
+				s.releaseHandoverMcuObjectsLocked(nil, []string{id + "|" + streamType})
+			}
 		}
 		log.Printf("Subscribing %s from %s as %s in session %s", streamType, id, subscriber.Id(), s.PublicId())
 	}
@@ -917,34 +1207,32 @@ func (s *ClientSession) processClientMessage(msg *nats.Msg) {
 	switch message.Type {
 	case "permissions":
 		s.SetPermissions(message.Permissions)
-		go func() {
-			s.mu.Lock()
-			defer s.mu.Unlock()
-
-			if !s.hasPermissionLocked(PERMISSION_MAY_PUBLISH_MEDIA) {
-				if publisher, found := s.publishers[streamTypeVideo]; found {
-					if (publisher.HasMedia(MediaTypeAudio) && !s.hasPermissionLocked(PERMISSION_MAY_PUBLISH_AUDIO)) ||
-						(publisher.HasMedia(MediaTypeVideo) && !s.hasPermissionLocked(PERMISSION_MAY_PUBLISH_VIDEO)) {
-						delete(s.publishers, streamTypeVideo)
-						log.Printf("Session %s is no longer allowed to publish media, closing publisher %s", s.PublicId(), publisher.Id())
-						go func() {
-							publisher.Close(context.Background())
-						}()
-						return
-					}
-				}
-			}
-			if !s.hasPermissionLocked(PERMISSION_MAY_PUBLISH_SCREEN) {
-				if publisher, found := s.publishers[streamTypeScreen]; found {
-					delete(s.publishers, streamTypeScreen)
-					log.Printf("Session %s is no longer allowed to publish screen, closing publisher %s", s.PublicId(), publisher.Id())
-					go func() {
-						publisher.Close(context.Background())
-					}()
-					return
-				}
-			}
-		}()
+		return
+	case "sendoffer":
+		if message.SendOffer == nil || message.SendOffer.Data == nil {
+			log.Printf("Received NATS offer without payload: %+v", message)
+			return
+		}
+
+		// Process asynchronously to avoid blocking regular message processing
+		// for this session.
+		go s.hub.processRemoteSendOffer(s, message.SendOffer)
+		return
+	case "kick":
+		if message.Kick == nil {
+			log.Printf("Received NATS kick without payload: %+v", message)
+			return
+		}
+
+		s.hub.processKick(s, message.Kick)
+		return
+	case "lobby":
+		if message.Lobby == nil {
+			log.Printf("Received NATS lobby decision without payload: %+v", message)
+			return
+		}
+
+		s.hub.processLobbyDecision(s, message.Lobby)
 		return
 	case "message":
 		if message.Message.Type == "bye" && message.Message.Bye.Reason == "room_session_reconnected" {
@@ -999,6 +1287,13 @@ func (s *ClientSession) processNatsMessage(msg *NatsMessage) *ServerMessage {
 				// Don't send message back to sender (can happen if sent to user or room)
 				return nil
 			}
+			if msg.Message.Message != nil &&
+				msg.Message.Message.Sender != nil &&
+				msg.Message.Message.Sender.Type == RecipientTypeCall &&
+				!s.isInCall() {
+				// Session is not in the call, ignore message to call participants.
+				return nil
+			}
 		case "control":
 			if msg.Message.Control != nil &&
 				msg.Message.Control.Sender != nil &&
@@ -1006,6 +1301,13 @@ func (s *ClientSession) processNatsMessage(msg *NatsMessage) *ServerMessage {
 				// Don't send message back to sender (can happen if sent to user or room)
 				return nil
 			}
+			if msg.Message.Control != nil &&
+				msg.Message.Control.Sender != nil &&
+				msg.Message.Control.Sender.Type == RecipientTypeCall &&
+				!s.isInCall() {
+				// Session is not in the call, ignore message to call participants.
+				return nil
+			}
 		case "event":
 			if msg.Message.Event.Target == "participants" &&
 				msg.Message.Event.Type == "update" {
@@ -1023,6 +1325,11 @@ func (s *ClientSession) processNatsMessage(msg *NatsMessage) *ServerMessage {
 				// TODO(jojo): Only send all users if current session id has
 				// changed its "inCall" flag to true.
 				m.Changed = nil
+			} else if msg.Message.Event.Target == "room" && msg.Message.Event.Type == "joinrequest" {
+				if !isAllowedToControl(s) {
+					// Only moderators can approve / deny join requests.
+					return nil
+				}
 			} else if msg.Message.Event.Target == "room" {
 				// Can happen mostly during tests where an older room NATS message
 				// could be received by a subscriber that joined after it was sent.
@@ -1040,8 +1347,52 @@ func (s *ClientSession) processNatsMessage(msg *NatsMessage) *ServerMessage {
 	}
 }
 
-func (s *ClientSession) NotifySessionResumed(client *Client) {
+// replayMessagesLocked returns the messages after the given sequence number
+// or false if some of them are no longer available.
+func (s *ClientSession) replayMessagesLocked(lastSeq uint64) ([]*ServerMessage, bool) {
+	if !s.supportsSequence || lastSeq == 0 || lastSeq > s.lastSeq {
+		return nil, false
+	}
+
+	s.ackMessagesLocked(lastSeq)
+	if lastSeq == s.lastSeq {
+		return nil, true
+	}
+
+	if len(s.replayMessages) == 0 || s.replayMessages[0].Seq != lastSeq+1 {
+		// Some messages have been dropped from the replay buffer.
+		return nil, false
+	}
+
+	messages := make([]*ServerMessage, len(s.replayMessages))
+	copy(messages, s.replayMessages)
+	return messages, true
+}
+
+func (s *ClientSession) NotifySessionResumed(client *Client, lastSeq uint64) {
 	s.mu.Lock()
+	if messages, ok := s.replayMessagesLocked(lastSeq); ok {
+		// The replayed messages include all pending messages.
+		s.pendingClientMessages = nil
+		s.hasPendingChat = false
+		if len(messages) > 0 {
+			log.Printf("Replay %d messages after %d to session %s", len(messages), lastSeq, s.PublicId())
+			// Send while locked so new messages are not sent before the
+			// replayed ones.
+			for _, message := range messages {
+				// Messages already have a sequence number and are still in
+				// the replay buffer if sending fails.
+				if !client.SendMessage(message) {
+					break
+				}
+			}
+		}
+		s.mu.Unlock()
+		return
+	} else if lastSeq != 0 {
+		log.Printf("Could not replay messages after %d to session %s, sending pending messages", lastSeq, s.PublicId())
+	}
+
 	if len(s.pendingClientMessages) == 0 {
 		s.mu.Unlock()
 		if room := s.GetRoom(); room != nil {
@@ -0,0 +1,118 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2021 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ByeReasonDraining = "draining"
+
+	// Clients will reconnect after a random delay up to this value so they
+	// don't hit the other servers at the same time.
+	maxDrainReconnectDelay = 5 * time.Second
+)
+
+var (
+	// Interval to check if all rooms are closed while draining.
+	drainCheckInterval = 100 * time.Millisecond
+)
+
+// IsDraining returns true if the hub no longer accepts new connections.
+func (h *Hub) IsDraining() bool {
+	return atomic.LoadInt32(&h.draining) != 0
+}
+
+// DrainChan returns a channel that will be closed once draining started.
+func (h *Hub) DrainChan() <-chan bool {
+	return h.drainChan
+}
+
+// Drain stops accepting new connections and asks all connected clients to
+// reconnect (to a different server), where they can resume their sessions.
+// Returns false if the hub is already draining.
+func (h *Hub) Drain() bool {
+	if !atomic.CompareAndSwapInt32(&h.draining, 0, 1) {
+		return false
+	}
+
+	close(h.drainChan)
+	h.mu.RLock()
+	clients := make([]*Client, 0, len(h.clients)+len(h.expectHelloClients))
+	for _, client := range h.clients {
+		clients = append(clients, client)
+	}
+	for client := range h.expectHelloClients {
+		clients = append(clients, client)
+	}
+	h.mu.RUnlock()
+
+	log.Printf("Draining, asking %d clients to reconnect", len(clients))
+	for _, client := range clients {
+		response := &ServerMessage{
+			Type: "bye",
+			Bye: &ByeServerMessage{
+				Reason: ByeReasonDraining,
+				Reconnect: &ByeServerMessageReconnect{
+					// The session will be kept until it expires or is
+					// resumed on a different server.
+					Resume: client.GetSession() != nil,
+					Delay:  rand.Int63n(int64(maxDrainReconnectDelay / time.Millisecond)),
+				},
+			},
+		}
+		// This will close the client connection.
+		client.SendMessage(response)
+	}
+	return true
+}
+
+func (h *Hub) countRooms() int {
+	h.ru.RLock()
+	defer h.ru.RUnlock()
+	return len(h.rooms)
+}
+
+// WaitUntilDrained waits until all rooms on this server are closed, i.e. all
+// sessions left, expired or were resumed on a different server.
+func (h *Hub) WaitUntilDrained(ctx context.Context) error {
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	for {
+		count := h.countRooms()
+		if count == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Printf("Stop waiting for %d rooms to close: %s", count, ctx.Err())
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
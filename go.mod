@@ -17,6 +17,7 @@ require (
 	github.com/oschwald/maxminddb-golang v1.8.0
 	github.com/pion/sdp v1.3.0
 	github.com/prometheus/client_golang v1.11.0
+	github.com/vmihailenco/msgpack/v5 v5.3.5
 	go.etcd.io/etcd v0.5.0-alpha.5.0.20210226220824-aa7126864d82
 	go.uber.org/zap v1.13.0 // indirect
 	golang.org/x/tools v0.0.0-20200103221440-774c71fcf114 // indirect
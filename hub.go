@@ -23,7 +23,9 @@ package signaling
 
 import (
 	"context"
+	"crypto/ecdsa"
 	"crypto/hmac"
+	"crypto/rsa"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
@@ -39,9 +41,11 @@ import (
 	"time"
 
 	"github.com/dlintw/goconf"
+	"github.com/golang-jwt/jwt"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/securecookie"
 	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
 )
 
 var (
@@ -52,7 +56,14 @@ var (
 	InvalidClientType = NewError("invalid_client_type", "The client type is not supported.")
 	InvalidBackendUrl = NewError("invalid_backend", "The backend URL is not supported.")
 	InvalidToken      = NewError("invalid_token", "The passed token is invalid.")
+	TokenExpired      = NewError("token_expired", "The token is expired.")
+	TokenNotSupported = NewError("token_not_supported", "The backend doesn't support tokens.")
 	NoSuchSession     = NewError("no_such_session", "The session to resume does not exist.")
+	NotInRoom         = NewError("not_in_room", "No room joined yet.")
+	BannedFromRoom    = NewError("banned", "You are not allowed to join this room.")
+
+	McuClientNotFound   = NewError("client_not_found", "No MCU client found to send message to.")
+	McuProcessingFailed = NewError("processing_failed", "Processing of the message failed, please check server logs.")
 
 	// Maximum number of concurrent requests to a backend.
 	defaultMaxConcurrentRequestsPerHost = 8
@@ -103,6 +114,9 @@ type Hub struct {
 	// 64-bit members that are accessed atomically must be 64-bit aligned.
 	sid uint64
 
+	// Random id to identify this server in messages to other servers.
+	serverId string
+
 	nats         NatsClient
 	upgrader     websocket.Upgrader
 	cookie       *securecookie.SecureCookie
@@ -114,11 +128,28 @@ type Hub struct {
 	readPumpActive  uint32
 	writePumpActive uint32
 
+	draining  int32
+	drainChan chan bool
+
 	roomUpdated      chan *BackendServerRoomRequest
 	roomDeleted      chan *BackendServerRoomRequest
 	roomInCall       chan *BackendServerRoomRequest
 	roomParticipants chan *BackendServerRoomRequest
 
+	// Broadcasts to the sessions of a backend, one subscription per backend.
+	backendReceiver      chan *nats.Msg
+	backendSubscriptions map[string]NatsSubscription
+	backendSubsLock      sync.Mutex
+
+	// Other servers of the cluster, they announce themselves on the admin
+	// subject.
+	remoteServers     map[string]bool
+	remoteServersLock sync.Mutex
+
+	// MCU objects of sessions that were handed over to other servers.
+	handoverMcu     map[string]*handoverMcuObjects
+	handoverMcuLock sync.Mutex
+
 	mu sync.RWMutex
 	ru sync.RWMutex
 
@@ -128,28 +159,37 @@ type Hub struct {
 
 	roomSessions    RoomSessions
 	virtualSessions map[string]uint64
+	// Users / room sessions that may not join a room until the given time.
+	roomBans map[string]time.Time
+	// Sessions waiting in the lobby of a room.
+	lobby map[string]map[*ClientSession]*lobbyEntry
 
 	decodeCaches []*LruCache
 
+	rateLimiter *RateLimiter
+
 	mcu                   Mcu
 	mcuTimeout            time.Duration
 	internalClientsSecret []byte
 
 	allowSubscribeAnyStream bool
 
+	roomHistorySize int
+
 	expiredSessions    map[Session]bool
 	expectHelloClients map[*Client]time.Time
 	anonymousClients   map[*Client]time.Time
 
 	backendTimeout time.Duration
 	backend        *BackendClient
+	webhooks       *WebhookSender
 
 	geoip          *GeoLookup
 	geoipOverrides map[*net.IPNet]string
 	geoipUpdating  int32
 }
 
-func NewHub(config *goconf.ConfigFile, nats NatsClient, r *mux.Router, version string) (*Hub, error) {
+func NewHub(config *goconf.ConfigFile, n NatsClient, r *mux.Router, version string) (*Hub, error) {
 	hashKey, _ := config.GetString("sessions", "hashkey")
 	switch len(hashKey) {
 	case 32:
@@ -199,6 +239,26 @@ func NewHub(config *goconf.ConfigFile, nats NatsClient, r *mux.Router, version s
 	}
 	mcuTimeout := time.Duration(mcuTimeoutSeconds) * time.Second
 
+	websocketCompression, _ := config.GetBool("clients", "compression")
+	if websocketCompression {
+		log.Printf("Websocket compression is enabled")
+	}
+
+	rateLimiter, err := NewRateLimiter(config)
+	if err != nil {
+		return nil, err
+	}
+
+	roomHistorySize, err := config.GetInt("app", "roomhistory")
+	if err != nil {
+		roomHistorySize = defaultRoomHistorySize
+	}
+	if roomHistorySize > 0 {
+		log.Printf("Keeping the last %d messages of rooms for joining sessions", roomHistorySize)
+	} else {
+		log.Printf("Room message history is disabled")
+	}
+
 	allowSubscribeAnyStream, _ := config.GetBool("app", "allowsubscribeany")
 	if allowSubscribeAnyStream {
 		log.Printf("WARNING: Allow subscribing any streams, this is insecure and should only be enabled for testing")
@@ -286,10 +346,11 @@ func NewHub(config *goconf.ConfigFile, nats NatsClient, r *mux.Router, version s
 	}
 
 	hub := &Hub{
-		nats: nats,
+		nats: n,
 		upgrader: websocket.Upgrader{
-			ReadBufferSize:  websocketReadBufferSize,
-			WriteBufferSize: websocketWriteBufferSize,
+			ReadBufferSize:    websocketReadBufferSize,
+			WriteBufferSize:   websocketWriteBufferSize,
+			EnableCompression: websocketCompression,
 		},
 		cookie: securecookie.New([]byte(hashKey), blockBytes).MaxAge(0),
 		info: &HelloServerMessageServer{
@@ -303,36 +364,54 @@ func NewHub(config *goconf.ConfigFile, nats NatsClient, r *mux.Router, version s
 
 		stopChan: make(chan bool),
 
+		drainChan: make(chan bool),
+
 		roomUpdated:      make(chan *BackendServerRoomRequest),
 		roomDeleted:      make(chan *BackendServerRoomRequest),
 		roomInCall:       make(chan *BackendServerRoomRequest),
 		roomParticipants: make(chan *BackendServerRoomRequest),
 
+		backendReceiver:      make(chan *nats.Msg, 64),
+		backendSubscriptions: make(map[string]NatsSubscription),
+		remoteServers:        make(map[string]bool),
+		handoverMcu:          make(map[string]*handoverMcuObjects),
+
 		clients:  make(map[uint64]*Client),
 		sessions: make(map[uint64]Session),
 		rooms:    make(map[string]*Room),
 
 		roomSessions:    roomSessions,
 		virtualSessions: make(map[string]uint64),
+		roomBans:        make(map[string]time.Time),
+		lobby:           make(map[string]map[*ClientSession]*lobbyEntry),
 
 		decodeCaches: decodeCaches,
 
+		rateLimiter: rateLimiter,
+
 		mcuTimeout:            mcuTimeout,
 		internalClientsSecret: []byte(internalClientsSecret),
 
 		allowSubscribeAnyStream: allowSubscribeAnyStream,
 
+		roomHistorySize: roomHistorySize,
+
 		expiredSessions:    make(map[Session]bool),
 		anonymousClients:   make(map[*Client]time.Time),
 		expectHelloClients: make(map[*Client]time.Time),
 
 		backendTimeout: backendTimeout,
 		backend:        backend,
+		webhooks:       NewWebhookSender(backend),
 
 		geoip:          geoip,
 		geoipOverrides: geoipOverrides,
 	}
 	backend.hub = hub
+	// Sessions ids must be unique across all servers so sessions can be
+	// handed over between them.
+	hub.sid = getInitialSessionId()
+	hub.serverId = newRandomString(16)
 	hub.upgrader.CheckOrigin = hub.checkOrigin
 	r.HandleFunc("/spreed", func(w http.ResponseWriter, r *http.Request) {
 		hub.serveWs(w, r)
@@ -373,12 +452,20 @@ func (h *Hub) SetMcu(mcu Mcu) {
 		removeFeature(h.info, ServerFeatureSimulcast)
 		removeFeature(h.infoInternal, ServerFeatureMcu)
 		removeFeature(h.infoInternal, ServerFeatureSimulcast)
+		removeFeature(h.info, ServerFeatureSpeaking)
+		removeFeature(h.infoInternal, ServerFeatureSpeaking)
+		removeFeature(h.info, ServerFeatureRecording)
+		removeFeature(h.infoInternal, ServerFeatureRecording)
 	} else {
 		log.Printf("Using a timeout of %s for MCU requests", h.mcuTimeout)
 		addFeature(h.info, ServerFeatureMcu)
 		addFeature(h.info, ServerFeatureSimulcast)
 		addFeature(h.infoInternal, ServerFeatureMcu)
 		addFeature(h.infoInternal, ServerFeatureSimulcast)
+		addFeature(h.info, ServerFeatureSpeaking)
+		addFeature(h.infoInternal, ServerFeatureSpeaking)
+		addFeature(h.info, ServerFeatureRecording)
+		addFeature(h.infoInternal, ServerFeatureRecording)
 	}
 }
 
@@ -428,6 +515,27 @@ func (h *Hub) Run() {
 	housekeeping := time.NewTicker(housekeepingInterval)
 	geoipUpdater := time.NewTicker(24 * time.Hour)
 
+	natsReceiver := make(chan *nats.Msg, 64)
+	handoverSubscription, err := h.nats.Subscribe(handoverSubject, natsReceiver)
+	if err != nil {
+		log.Printf("Could not subscribe to session handover requests: %s", err)
+	}
+	banSubscription, err := h.nats.Subscribe(roomBanSubject, natsReceiver)
+	if err != nil {
+		log.Printf("Could not subscribe to room bans: %s", err)
+	}
+	adminSubscription, err := h.nats.Subscribe(adminSubject, natsReceiver)
+	if err != nil {
+		log.Printf("Could not subscribe to admin requests: %s", err)
+	} else {
+		h.announceAdminServer(true, true)
+	}
+	lobbySubscription, err := h.nats.Subscribe(lobbySubject, natsReceiver)
+	if err != nil {
+		log.Printf("Could not subscribe to lobby requests: %s", err)
+	}
+	h.updateBackendSubscriptions()
+
 loop:
 	for {
 		select {
@@ -440,6 +548,11 @@ loop:
 			h.processRoomInCallChanged(message)
 		case message := <-h.roomParticipants:
 			h.processRoomParticipants(message)
+		// Requests from other servers.
+		case message := <-natsReceiver:
+			h.processNatsMessage(message)
+		case message := <-h.backendReceiver:
+			h.processNatsMessage(message)
 		// Periodic internal housekeeping.
 		case now := <-housekeeping.C:
 			h.performHousekeeping(now)
@@ -449,11 +562,102 @@ loop:
 			break loop
 		}
 	}
+	if handoverSubscription != nil {
+		if err := handoverSubscription.Unsubscribe(); err != nil {
+			log.Printf("Error closing session handover subscription: %s", err)
+		}
+	}
+	if banSubscription != nil {
+		if err := banSubscription.Unsubscribe(); err != nil {
+			log.Printf("Error closing room ban subscription: %s", err)
+		}
+	}
+	if adminSubscription != nil {
+		h.announceAdminServer(false, false)
+		if err := adminSubscription.Unsubscribe(); err != nil {
+			log.Printf("Error closing admin subscription: %s", err)
+		}
+	}
+	if lobbySubscription != nil {
+		if err := lobbySubscription.Unsubscribe(); err != nil {
+			log.Printf("Error closing lobby subscription: %s", err)
+		}
+	}
+	h.closeBackendSubscriptions()
+	h.webhooks.Close()
 	if h.geoip != nil {
 		h.geoip.Close()
 	}
 }
 
+func (h *Hub) processNatsMessage(message *nats.Msg) {
+	var msg NatsMessage
+	if err := h.nats.Decode(message, &msg); err != nil {
+		log.Printf("Could not decode nats message %+v, %s", message, err)
+		return
+	}
+
+	switch msg.Type {
+	case "handover":
+		if msg.Handover == nil || msg.Handover.ReplyTo == "" {
+			log.Printf("Received NATS handover request without payload: %+v", msg)
+			return
+		} else if msg.Handover.ServerId == h.serverId {
+			// Ignore our own requests.
+			return
+		}
+
+		go h.processHandoverRequest(msg.Handover)
+	case "handoverrelease":
+		if msg.HandoverRelease == nil {
+			log.Printf("Received NATS handover release without payload: %+v", msg)
+			return
+		}
+
+		// Also processed for our own messages, the session could have been
+		// handed back to this server.
+		h.processHandoverRelease(msg.HandoverRelease)
+	case "ban":
+		if msg.Ban == nil {
+			log.Printf("Received NATS ban without payload: %+v", msg)
+			return
+		}
+
+		h.addRoomBan(msg.Ban)
+	case "admin":
+		if msg.Admin == nil || (msg.Admin.Type != "announce" && msg.Admin.ReplyTo == "") {
+			log.Printf("Received NATS admin request without payload: %+v", msg)
+			return
+		} else if msg.Admin.ServerId == h.serverId {
+			// Ignore our own requests, they are processed locally.
+			return
+		}
+
+		if msg.Admin.Type == "announce" {
+			h.processAdminAnnounce(msg.Admin)
+			return
+		}
+
+		go h.processAdminRequest(msg.Admin)
+	case "lobbyrequests":
+		if msg.LobbyRequests == nil {
+			log.Printf("Received NATS lobby requests without payload: %+v", msg)
+			return
+		}
+
+		h.processLobbyJoinRequests(msg.LobbyRequests)
+	case "broadcast":
+		if msg.Broadcast == nil || msg.Broadcast.Message == nil {
+			log.Printf("Received NATS broadcast without payload: %+v", msg)
+			return
+		}
+
+		h.processBackendBroadcast(msg.Broadcast)
+	default:
+		log.Printf("Unsupported NATS hub request with type %s: %+v", msg.Type, msg)
+	}
+}
+
 func (h *Hub) Stop() {
 	atomic.StoreInt32(&h.stopped, 1)
 	select {
@@ -467,6 +671,91 @@ func (h *Hub) Reload(config *goconf.ConfigFile) {
 		h.mcu.Reload(config)
 	}
 	h.backend.Reload(config)
+	h.rateLimiter.Reload(config)
+	h.updateBackendSubscriptions()
+}
+
+// updateBackendSubscriptions subscribes to the broadcasts of all configured
+// backends and unsubscribes from backends that were removed.
+func (h *Hub) updateBackendSubscriptions() {
+	backends := h.backend.GetBackends()
+	if compatBackend := h.backend.GetCompatBackend(); compatBackend != nil {
+		backends = append(backends, compatBackend)
+	}
+
+	h.backendSubsLock.Lock()
+	defer h.backendSubsLock.Unlock()
+
+	ids := make(map[string]bool, len(backends))
+	for _, backend := range backends {
+		id := backend.Id()
+		ids[id] = true
+		if _, found := h.backendSubscriptions[id]; found {
+			continue
+		}
+
+		subscription, err := h.nats.Subscribe(GetSubjectForBackendId(backend), h.backendReceiver)
+		if err != nil {
+			log.Printf("Could not subscribe to broadcasts of backend %s: %s", id, err)
+			continue
+		}
+		h.backendSubscriptions[id] = subscription
+	}
+
+	for id, subscription := range h.backendSubscriptions {
+		if ids[id] {
+			continue
+		}
+
+		if err := subscription.Unsubscribe(); err != nil {
+			log.Printf("Error closing broadcast subscription of backend %s: %s", id, err)
+		}
+		delete(h.backendSubscriptions, id)
+	}
+}
+
+func (h *Hub) closeBackendSubscriptions() {
+	h.backendSubsLock.Lock()
+	defer h.backendSubsLock.Unlock()
+
+	for id, subscription := range h.backendSubscriptions {
+		if err := subscription.Unsubscribe(); err != nil {
+			log.Printf("Error closing broadcast subscription of backend %s: %s", id, err)
+		}
+		delete(h.backendSubscriptions, id)
+	}
+}
+
+func (h *Hub) processBackendBroadcast(message *NatsBroadcastMessage) {
+	var userIds map[string]bool
+	if len(message.UserIds) > 0 {
+		userIds = make(map[string]bool, len(message.UserIds))
+		for _, userId := range message.UserIds {
+			userIds[userId] = true
+		}
+	}
+
+	h.mu.RLock()
+	var sessions []*ClientSession
+	for _, s := range h.sessions {
+		session, ok := s.(*ClientSession)
+		if !ok || session.Backend() == nil || session.Backend().Id() != message.BackendId {
+			continue
+		}
+
+		if userIds != nil {
+			if userId := session.AuthUserId(); userId == "" || !userIds[userId] {
+				continue
+			}
+		}
+		sessions = append(sessions, session)
+	}
+	h.mu.RUnlock()
+
+	for _, session := range sessions {
+		m := *message.Message
+		session.SendMessage(&m)
+	}
 }
 
 func reverseSessionId(s string) (string, error) {
@@ -562,6 +851,10 @@ func (h *Hub) GetSessionByPublicId(sessionId string) Session {
 	h.mu.Lock()
 	session := h.sessions[data.Sid]
 	h.mu.Unlock()
+	if session != nil && session.PublicId() != sessionId {
+		// Session was created on a different server and has the same sid.
+		return nil
+	}
 	return session
 }
 
@@ -570,6 +863,7 @@ func (h *Hub) checkExpiredSessions(now time.Time) {
 		if s.IsExpired(now) {
 			h.mu.Unlock()
 			log.Printf("Closing expired session %s (private=%s)", s.PublicId(), s.PrivateId())
+			h.webhooks.Send(s.Backend(), newWebhookEvent(BackendEventSessionExpired, "", s))
 			s.Close()
 			h.mu.Lock()
 			// Should already be deleted by the close code, but better be sure.
@@ -608,7 +902,9 @@ func (h *Hub) performHousekeeping(now time.Time) {
 	h.checkExpiredSessions(now)
 	h.checkAnonymousClients(now)
 	h.checkInitialHello(now)
+	h.checkExpiredRoomBans(now)
 	h.mu.Unlock()
+	h.rateLimiter.Cleanup(now)
 }
 
 func (h *Hub) removeSession(session Session) (removed bool) {
@@ -626,6 +922,9 @@ func (h *Hub) removeSession(session Session) (removed bool) {
 		}
 	}
 	delete(h.expiredSessions, session)
+	if clientSession, ok := session.(*ClientSession); ok {
+		h.removeLobbySessionLocked(clientSession)
+	}
 	h.mu.Unlock()
 	return
 }
@@ -791,13 +1090,35 @@ func (h *Hub) processUnregister(client *Client) *ClientSession {
 func (h *Hub) processMessage(client *Client, data []byte) {
 	var message ClientMessage
 	if err := message.UnmarshalJSON(data); err != nil {
-		if session := client.GetSession(); session != nil {
-			log.Printf("Error decoding message from client %s: %v", session.PublicId(), err)
-			session.SendError(InvalidFormat)
-		} else {
-			log.Printf("Error decoding message from %s: %v", client.RemoteAddr(), err)
-			client.SendError(InvalidFormat)
-		}
+		h.sendDecodeError(client, err)
+		return
+	}
+
+	h.processClientMessage(client, &message)
+}
+
+func (h *Hub) processMessagePack(client *Client, data []byte) {
+	var message ClientMessage
+	if err := decodeMessagePack(data, &message); err != nil {
+		h.sendDecodeError(client, err)
+		return
+	}
+
+	h.processClientMessage(client, &message)
+}
+
+func (h *Hub) sendDecodeError(client *Client, err error) {
+	if session := client.GetSession(); session != nil {
+		log.Printf("Error decoding message from client %s: %v", session.PublicId(), err)
+		session.SendError(InvalidFormat)
+	} else {
+		log.Printf("Error decoding message from %s: %v", client.RemoteAddr(), err)
+		client.SendError(InvalidFormat)
+	}
+}
+
+func (h *Hub) processClientMessage(client *Client, message *ClientMessage) {
+	if !h.checkRateLimits(client, message) {
 		return
 	}
 
@@ -819,21 +1140,27 @@ func (h *Hub) processMessage(client *Client, data []byte) {
 			return
 		}
 
-		h.processHello(client, &message)
+		h.processHello(client, message)
 		return
 	}
 
 	switch message.Type {
 	case "room":
-		h.processRoom(client, &message)
+		h.processRoom(client, message)
 	case "message":
-		h.processMessageMsg(client, &message)
+		h.processMessageMsg(client, message)
 	case "control":
-		h.processControlMsg(client, &message)
+		h.processControlMsg(client, message)
 	case "internal":
-		h.processInternalMsg(client, &message)
+		h.processInternalMsg(client, message)
+	case "transient":
+		h.processTransientMsg(client, message)
+	case "roster":
+		h.processRosterMsg(client, message)
+	case "ack":
+		session.AckMessages(message.Ack.Seq)
 	case "bye":
-		h.processByeMsg(client, &message)
+		h.processByeMsg(client, message)
 	case "hello":
 		log.Printf("Ignore hello %+v for already authenticated connection %s", message.Hello, session.PublicId())
 	default:
@@ -841,6 +1168,52 @@ func (h *Hub) processMessage(client *Client, data []byte) {
 	}
 }
 
+// checkRateLimits returns "false" if the message should not be processed
+// because the client sent too many messages.
+func (h *Hub) checkRateLimits(client *Client, message *ClientMessage) bool {
+	session := client.GetSession()
+	if session != nil && session.ClientType() == HelloClientTypeInternal {
+		// Internal clients are trusted and not limited.
+		return true
+	}
+
+	now := time.Now()
+	if wait, disconnect := h.rateLimiter.AllowIP(client.RemoteAddr(), now); wait > 0 {
+		h.rejectRateLimited(client, message, RateLimitScopeIP, "", wait, disconnect)
+		return false
+	}
+	if session == nil {
+		return true
+	}
+
+	if wait, disconnect := h.rateLimiter.AllowSession(session.PublicId(), now); wait > 0 {
+		h.rejectRateLimited(client, message, RateLimitScopeSession, "", wait, disconnect)
+		return false
+	}
+	if wait, disconnect := h.rateLimiter.AllowType(session.PublicId(), message.Type, now); wait > 0 {
+		h.rejectRateLimited(client, message, RateLimitScopeType, message.Type, wait, disconnect)
+		return false
+	}
+	return true
+}
+
+func (h *Hub) rejectRateLimited(client *Client, message *ClientMessage, scope string, messageType string, wait time.Duration, disconnect bool) {
+	statsRateLimitRejectedTotal.WithLabelValues(scope, messageType).Inc()
+	if !disconnect {
+		client.SendMessage(message.NewErrorServerMessage(NewTooManyRequestsError(wait)))
+		return
+	}
+
+	statsRateLimitDisconnectedTotal.WithLabelValues(scope).Inc()
+	if session := client.GetSession(); session != nil {
+		log.Printf("Disconnecting client %s from %s after repeated rate limit violations (%s)", session.PublicId(), client.RemoteAddr(), scope)
+	} else {
+		log.Printf("Disconnecting client from %s after repeated rate limit violations (%s)", client.RemoteAddr(), scope)
+	}
+	client.SendByeResponseWithReason(message, "too_many_requests")
+	go client.Close()
+}
+
 func (h *Hub) sendHelloResponse(session *ClientSession, message *ClientMessage) bool {
 	response := &ServerMessage{
 		Id:   message.Id,
@@ -868,7 +1241,12 @@ func (h *Hub) processHello(client *Client, message *ClientMessage) {
 
 		h.mu.Lock()
 		session, found := h.sessions[data.Sid]
-		if !found || resumeId != session.PrivateId() {
+		if !found {
+			// The session might be connected to a different server.
+			h.mu.Unlock()
+			h.processRemoteResume(client, message, data)
+			return
+		} else if resumeId != session.PrivateId() {
 			h.mu.Unlock()
 			statsHubSessionResumeFailed.Inc()
 			client.SendMessage(message.NewErrorServerMessage(NoSuchSession))
@@ -905,7 +1283,7 @@ func (h *Hub) processHello(client *Client, message *ClientMessage) {
 
 		statsHubSessionsResumedTotal.WithLabelValues(clientSession.Backend().Id(), clientSession.ClientType()).Inc()
 		h.sendHelloResponse(clientSession, message)
-		clientSession.NotifySessionResumed(client)
+		clientSession.NotifySessionResumed(client, message.Hello.LastSeq)
 		return
 	}
 
@@ -936,6 +1314,18 @@ func (h *Hub) processHelloClient(client *Client, message *ClientMessage) {
 		return
 	}
 
+	if message.Hello.Version == HelloVersionV2 {
+		// The token can be validated locally, no need to contact the backend.
+		auth, err := h.processHelloV2Token(backend, message.Hello.Auth.Url, &message.Hello.Auth.helloV2Params)
+		if err != nil {
+			client.SendMessage(message.NewWrappedErrorServerMessage(err))
+			return
+		}
+
+		h.processRegister(client, message, backend, auth)
+		return
+	}
+
 	// Run in timeout context to prevent blocking too long.
 	ctx, cancel := context.WithTimeout(context.Background(), h.backendTimeout)
 	defer cancel()
@@ -952,6 +1342,64 @@ func (h *Hub) processHelloClient(client *Client, message *ClientMessage) {
 	h.processRegister(client, message, backend, &auth)
 }
 
+func (h *Hub) processHelloV2Token(backend *Backend, backendUrl string, params *HelloV2AuthParams) (*BackendClientResponse, error) {
+	publicKey := backend.PublicKey()
+	if publicKey == nil {
+		return nil, TokenNotSupported
+	}
+
+	token, err := jwt.ParseWithClaims(params.Token, &HelloV2TokenClaims{}, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA:
+			if _, ok := publicKey.(*rsa.PublicKey); !ok {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+		case *jwt.SigningMethodECDSA:
+			if _, ok := publicKey.(*ecdsa.PublicKey); !ok {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+		default:
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return publicKey, nil
+	})
+	if err != nil {
+		if e, ok := err.(*jwt.ValidationError); ok && e.Errors&jwt.ValidationErrorExpired != 0 {
+			return nil, TokenExpired
+		}
+
+		log.Printf("Could not validate token for backend %s: %s", backend.Id(), err)
+		return nil, InvalidToken
+	}
+
+	claims, ok := token.Claims.(*HelloV2TokenClaims)
+	if !ok || !token.Valid {
+		return nil, InvalidToken
+	} else if claims.ExpiresAt == 0 {
+		// Tokens must expire.
+		return nil, InvalidToken
+	} else if claims.BackendId != backend.Id() {
+		log.Printf("Token for backend %s was used for backend %s", claims.BackendId, backend.Id())
+		return nil, InvalidToken
+	} else if !claims.VerifyAudience(backend.Id(), true) {
+		log.Printf("Token for audience %s was used for backend %s", claims.Audience, backend.Id())
+		return nil, InvalidToken
+	} else if strings.TrimSuffix(claims.Issuer, "/") != strings.TrimSuffix(backendUrl, "/") {
+		// The token must have been issued by the backend the client connects to.
+		log.Printf("Token issued by %s was used for %s of backend %s", claims.Issuer, backendUrl, backend.Id())
+		return nil, InvalidToken
+	}
+
+	return &BackendClientResponse{
+		Type: "auth",
+		Auth: &BackendClientAuthResponse{
+			Version: BackendVersion,
+			UserId:  claims.Subject,
+			User:    claims.UserData,
+		},
+	}, nil
+}
+
 func (h *Hub) processHelloInternal(client *Client, message *ClientMessage) {
 	defer h.startExpectHello(client)
 	if len(h.internalClientsSecret) == 0 {
@@ -1039,6 +1487,10 @@ func (h *Hub) sendRoom(session *ClientSession, message *ClientMessage, room *Roo
 
 func (h *Hub) processRoom(client *Client, message *ClientMessage) {
 	session := client.GetSession()
+	if session != nil {
+		// Joining a different room (or leaving) cancels waiting in the lobby.
+		h.removeLobbySession(session)
+	}
 	roomId := message.Room.RoomId
 	if roomId == "" {
 		if session == nil {
@@ -1077,6 +1529,12 @@ func (h *Hub) processRoom(client *Client, message *ClientMessage) {
 		ctx, cancel := context.WithTimeout(context.Background(), h.backendTimeout)
 		defer cancel()
 
+		if h.isBannedFromRoom(roomId, session.Backend(), session.UserId(), message.Room.SessionId, time.Now()) {
+			log.Printf("Session %s is banned from room %s", session.PublicId(), roomId)
+			session.SendMessage(message.NewErrorServerMessage(BannedFromRoom))
+			return
+		}
+
 		sessionId := message.Room.SessionId
 		if sessionId == "" {
 			// TODO(jojo): Better make the session id required in the request.
@@ -1143,6 +1601,11 @@ func (h *Hub) processJoinRoom(session *ClientSession, message *ClientMessage, ro
 
 	session.LeaveRoom(true)
 
+	if room.Room.Waiting {
+		h.addLobbySession(session, message, room)
+		return
+	}
+
 	roomId := room.Room.RoomId
 	internalRoomId := getRoomIdForBackend(roomId, session.Backend())
 	if err := session.SubscribeRoomNats(h.nats, roomId, message.Room.SessionId); err != nil {
@@ -1165,6 +1628,7 @@ func (h *Hub) processJoinRoom(session *ClientSession, message *ClientMessage, ro
 			return
 		}
 	}
+	r.SetLimits(room.Room.MaxSessions, room.Room.MaxPublishers)
 	h.ru.Unlock()
 
 	h.mu.Lock()
@@ -1178,12 +1642,29 @@ func (h *Hub) processJoinRoom(session *ClientSession, message *ClientMessage, ro
 		session.SetPermissions(*room.Room.Permissions)
 	}
 	h.sendRoom(session, message, r)
-	h.notifyUserJoinedRoom(r, session, room.Room.Session)
+	if err := h.notifyUserJoinedRoom(r, session, room.Room.Session); err != nil {
+		// The limits are checked when adding the session to the room.
+		log.Printf("Session %s could not join room %s: %s", session.PublicId(), roomId, err)
+		session.SendMessage(message.NewWrappedErrorServerMessage(err))
+		session.LeaveRoom(true)
+		h.sendRoom(session, nil, nil)
+		return
+	}
+
+	if isAllowedToControl(session) {
+		// Moderators must also see the sessions that were already waiting.
+		h.requestLobbyJoinRequests(r, session)
+	}
 }
 
-func (h *Hub) notifyUserJoinedRoom(room *Room, session *ClientSession, sessionData *json.RawMessage) {
+func (h *Hub) notifyUserJoinedRoom(room *Room, session *ClientSession, sessionData *json.RawMessage) error {
 	// Register session with the room
-	if sessions := room.AddSession(session, sessionData); len(sessions) > 0 {
+	sessions, err := room.AddSession(session, sessionData)
+	if err != nil {
+		return err
+	}
+
+	if len(sessions) > 0 {
 		events := make([]*EventServerMessageSessionEntry, 0, len(sessions))
 		for _, s := range sessions {
 			entry := &EventServerMessageSessionEntry{
@@ -1237,6 +1718,10 @@ func (h *Hub) notifyUserJoinedRoom(room *Room, session *ClientSession, sessionDa
 			session.SendMessage(msg)
 		}
 	}
+
+	room.SendHistory(session)
+	room.SendRecording(session)
+	return nil
 }
 
 func (h *Hub) processMessageMsg(client *Client, message *ClientMessage) {
@@ -1267,6 +1752,11 @@ func (h *Hub) processMessageMsg(client *Client, message *ClientMessage) {
 					clientData = &data
 					switch data.Type {
 					case "requestoffer":
+						if wait, disconnect := h.rateLimiter.AllowType(session.PublicId(), data.Type, time.Now()); wait > 0 {
+							h.rejectRateLimited(client, message, RateLimitScopeType, data.Type, wait, disconnect)
+							return
+						}
+
 						// Process asynchronously to avoid blocking regular
 						// message processing for this client.
 						go h.processMcuMessage(session, session, message, msg, &data)
@@ -1293,11 +1783,11 @@ func (h *Hub) processMessageMsg(client *Client, message *ClientMessage) {
 
 			subject = "session." + msg.Recipient.SessionId
 			h.mu.RLock()
-			recipient = h.clients[data.Sid]
-			if recipient == nil {
-				// Send to client connection for virtual sessions.
-				sess := h.sessions[data.Sid]
-				if sess != nil && sess.ClientType() == HelloClientTypeVirtual {
+			// Sessions on other servers could have the same sid.
+			if sess := h.sessions[data.Sid]; sess != nil && sess.PublicId() == msg.Recipient.SessionId {
+				recipient = h.clients[data.Sid]
+				if recipient == nil && sess.ClientType() == HelloClientTypeVirtual {
+					// Send to client connection for virtual sessions.
 					virtualSession := sess.(*VirtualSession)
 					clientSession := virtualSession.Session()
 					subject = "session." + clientSession.PublicId()
@@ -1313,16 +1803,16 @@ func (h *Hub) processMessageMsg(client *Client, message *ClientMessage) {
 		}
 	case RecipientTypeUser:
 		if msg.Recipient.UserId != "" {
-			if msg.Recipient.UserId == session.UserId() {
-				// Don't loop messages to the sender.
-				// TODO(jojo): Should we allow users to send messages to their
-				// other sessions?
+			if msg.Recipient.UserId == session.UserId() && !session.HasFeature(ClientFeatureOwnSessions) {
+				// Don't loop messages to the sender. Clients must opt-in to send
+				// messages to their other sessions, the sending session will be
+				// skipped by the receivers.
 				return
 			}
 
 			subject = GetSubjectForUserId(msg.Recipient.UserId, session.Backend())
 		}
-	case RecipientTypeRoom:
+	case RecipientTypeRoom, RecipientTypeCall:
 		if session != nil {
 			if room := session.GetRoom(); room != nil {
 				subject = GetSubjectForRoomId(room.Id(), room.Backend())
@@ -1396,16 +1886,47 @@ func (h *Hub) processMessageMsg(client *Client, message *ClientMessage) {
 			}
 			return
 		}
-		recipient.SendMessage(response)
+		h.sendToLocalClient(recipient, response)
 	} else {
 		if clientData != nil && clientData.Type == "sendoffer" {
-			// TODO(jojo): Implement this.
-			log.Printf("Sending offers to remote clients is not supported yet (client %s)", session.PublicId())
+			if msg.Recipient.Type != RecipientTypeSession {
+				log.Printf("Ignore offer from %s to non-session recipient %+v", session.PublicId(), msg.Recipient)
+				return
+			}
+
+			if err := session.IsAllowedToSend(clientData); err != nil {
+				log.Printf("Session %s is not allowed to send offer for %s, ignoring (%s)", session.PublicId(), clientData.RoomType, err)
+				sendNotAllowed(session, message, "Not allowed to send offer")
+				return
+			}
+
+			// The recipient is connected to a different instance which will
+			// create the subscriber and send the offer to the client.
+			offer := &NatsMessage{
+				SendTime: time.Now(),
+				Type:     "sendoffer",
+				SendOffer: &NatsSendOfferMessage{
+					MessageId: message.Id,
+					SessionId: session.PublicId(),
+					Data:      clientData,
+				},
+			}
+			if err := h.nats.PublishNats(subject, offer); err != nil {
+				log.Printf("Error publishing offer to remote session: %s", err)
+				sendMcuProcessingFailed(session, message)
+			}
 			return
 		}
 		if err := h.nats.PublishMessage(subject, response); err != nil {
 			log.Printf("Error publishing message to remote session: %s", err)
 		}
+		if msg.Persistent && msg.Recipient.Type == RecipientTypeRoom {
+			if room := session.GetRoom(); room != nil {
+				if err := room.AddPersistentMessage(response); err != nil {
+					log.Printf("Could not add persistent message from %s to room %s: %s", session.PublicId(), room.Id(), err)
+				}
+			}
+		}
 	}
 }
 
@@ -1423,6 +1944,16 @@ func isAllowedToControl(session Session) bool {
 	return false
 }
 
+func (h *Hub) sendToLocalClient(client *Client, message *ServerMessage) {
+	if session := client.GetSession(); session != nil {
+		// Send through session to handle connection interruptions.
+		session.SendMessage(message)
+		return
+	}
+
+	client.SendMessage(message)
+}
+
 func (h *Hub) processControlMsg(client *Client, message *ClientMessage) {
 	msg := message.Control
 	session := client.GetSession()
@@ -1434,6 +1965,11 @@ func (h *Hub) processControlMsg(client *Client, message *ClientMessage) {
 		return
 	}
 
+	if msg.Action != nil {
+		h.processControlAction(session, message)
+		return
+	}
+
 	var recipient *Client
 	var subject string
 	var serverRecipient *MessageClientMessageRecipient
@@ -1448,11 +1984,11 @@ func (h *Hub) processControlMsg(client *Client, message *ClientMessage) {
 
 			subject = "session." + msg.Recipient.SessionId
 			h.mu.RLock()
-			recipient = h.clients[data.Sid]
-			if recipient == nil {
-				// Send to client connection for virtual sessions.
-				sess := h.sessions[data.Sid]
-				if sess != nil && sess.ClientType() == HelloClientTypeVirtual {
+			// Sessions on other servers could have the same sid.
+			if sess := h.sessions[data.Sid]; sess != nil && sess.PublicId() == msg.Recipient.SessionId {
+				recipient = h.clients[data.Sid]
+				if recipient == nil && sess.ClientType() == HelloClientTypeVirtual {
+					// Send to client connection for virtual sessions.
 					virtualSession := sess.(*VirtualSession)
 					clientSession := virtualSession.Session()
 					subject = "session." + clientSession.PublicId()
@@ -1468,16 +2004,16 @@ func (h *Hub) processControlMsg(client *Client, message *ClientMessage) {
 		}
 	case RecipientTypeUser:
 		if msg.Recipient.UserId != "" {
-			if msg.Recipient.UserId == session.UserId() {
-				// Don't loop messages to the sender.
-				// TODO(jojo): Should we allow users to send messages to their
-				// other sessions?
+			if msg.Recipient.UserId == session.UserId() && !session.HasFeature(ClientFeatureOwnSessions) {
+				// Don't loop messages to the sender. Clients must opt-in to send
+				// messages to their other sessions, the sending session will be
+				// skipped by the receivers.
 				return
 			}
 
 			subject = GetSubjectForUserId(msg.Recipient.UserId, session.Backend())
 		}
-	case RecipientTypeRoom:
+	case RecipientTypeRoom, RecipientTypeCall:
 		if session != nil {
 			if room := session.GetRoom(); room != nil {
 				subject = GetSubjectForRoomId(room.Id(), room.Backend())
@@ -1502,7 +2038,7 @@ func (h *Hub) processControlMsg(client *Client, message *ClientMessage) {
 		},
 	}
 	if recipient != nil {
-		recipient.SendMessage(response)
+		h.sendToLocalClient(recipient, response)
 	} else {
 		if err := h.nats.PublishMessage(subject, response); err != nil {
 			log.Printf("Error publishing message to remote session: %s", err)
@@ -1588,7 +2124,9 @@ func (h *Hub) processInternalMsg(client *Client, message *ClientMessage) {
 		log.Printf("Session %s added virtual session %s with initial flags %d", session.PublicId(), sess.PublicId(), sess.Flags())
 		session.AddVirtualSession(sess)
 		sess.SetRoom(room)
-		room.AddSession(sess, nil)
+		if _, err := room.AddSession(sess, nil); err != nil {
+			log.Printf("Could not add virtual session %s to room %s: %s", sess.PublicId(), room.Id(), err)
+		}
 	case "updatesession":
 		msg := msg.UpdateSession
 		room := h.getRoomForBackend(msg.RoomId, session.Backend())
@@ -1656,18 +2194,74 @@ func (h *Hub) processInternalMsg(client *Client, message *ClientMessage) {
 	}
 }
 
-func sendNotAllowed(session *ClientSession, message *ClientMessage, reason string) {
-	response := message.NewErrorServerMessage(NewError("not_allowed", reason))
-	session.SendMessage(response)
+func isAllowedToUpdateTransientData(session Session) bool {
+	if session.ClientType() == HelloClientTypeInternal {
+		// Internal clients are always allowed.
+		return true
+	}
+
+	// Nextcloud doesn't send a separate permission for transient data, so it
+	// may be updated by sessions that can publish media or are moderators.
+	return session.HasPermission(PERMISSION_MAY_PUBLISH_MEDIA) ||
+		session.HasPermission(PERMISSION_MAY_CONTROL)
 }
 
-func sendMcuClientNotFound(session *ClientSession, message *ClientMessage) {
-	response := message.NewErrorServerMessage(NewError("client_not_found", "No MCU client found to send message to."))
+func (h *Hub) processTransientMsg(client *Client, message *ClientMessage) {
+	msg := message.TransientData
+	session := client.GetSession()
+	if session == nil {
+		// Client is not connected yet.
+		return
+	}
+
+	room := session.GetRoom()
+	if room == nil {
+		session.SendMessage(message.NewErrorServerMessage(NotInRoom))
+		return
+	}
+
+	switch msg.Type {
+	case "set":
+		if !isAllowedToUpdateTransientData(session) {
+			sendNotAllowed(session, message, "Not allowed to update transient data.")
+			return
+		}
+
+		var value interface{}
+		if msg.Value != nil {
+			if err := json.Unmarshal(*msg.Value, &value); err != nil {
+				log.Printf("Invalid transient value %s from %s: %s", string(*msg.Value), session.PublicId(), err)
+				session.SendMessage(message.NewErrorServerMessage(InvalidFormat))
+				return
+			}
+		}
+
+		if err := room.SetTransientData(msg.Key, value); err != nil {
+			log.Printf("Could not set transient data %s in room %s: %s", msg.Key, room.Id(), err)
+			session.SendMessage(message.NewWrappedErrorServerMessage(err))
+		}
+	case "remove":
+		if !isAllowedToUpdateTransientData(session) {
+			sendNotAllowed(session, message, "Not allowed to update transient data.")
+			return
+		}
+
+		if err := room.RemoveTransientData(msg.Key); err != nil {
+			log.Printf("Could not remove transient data %s in room %s: %s", msg.Key, room.Id(), err)
+			session.SendMessage(message.NewWrappedErrorServerMessage(err))
+		}
+	default:
+		log.Printf("Ignore unsupported transient message %+v from %s", msg, session.PublicId())
+	}
+}
+
+func sendNotAllowed(session *ClientSession, message *ClientMessage, reason string) {
+	response := message.NewErrorServerMessage(NewError("not_allowed", reason))
 	session.SendMessage(response)
 }
 
 func sendMcuProcessingFailed(session *ClientSession, message *ClientMessage) {
-	response := message.NewErrorServerMessage(NewError("processing_failed", "Processing of the message failed, please check server logs."))
+	response := message.NewErrorServerMessage(McuProcessingFailed)
 	session.SendMessage(response)
 }
 
@@ -1700,6 +2294,16 @@ func (h *Hub) isInSameCall(senderSession *ClientSession, recipientSessionId stri
 }
 
 func (h *Hub) processMcuMessage(senderSession *ClientSession, session *ClientSession, client_message *ClientMessage, message *MessageClientMessage, data *MessageClientMessageData) {
+	h.doProcessMcuMessage(senderSession, session, message, data, func(e *Error) {
+		senderSession.SendMessage(client_message.NewErrorServerMessage(e))
+	})
+}
+
+// doProcessMcuMessage processes a message for the MCU client of "session".
+// Errors are passed to "sendError" which must deliver them to the sender of
+// the message. The "senderSession" can be nil for "sendoffer" messages of
+// sessions on other instances.
+func (h *Hub) doProcessMcuMessage(senderSession *ClientSession, session *ClientSession, message *MessageClientMessage, data *MessageClientMessageData, sendError func(e *Error)) {
 	ctx, cancel := context.WithTimeout(context.Background(), h.mcuTimeout)
 	defer cancel()
 
@@ -1717,14 +2321,15 @@ func (h *Hub) processMcuMessage(senderSession *ClientSession, session *ClientSes
 		// as the other user and both have their "inCall" flag set.
 		if !h.allowSubscribeAnyStream && !h.isInSameCall(senderSession, message.Recipient.SessionId) {
 			log.Printf("Session %s is not in the same call as session %s, not requesting offer", session.PublicId(), message.Recipient.SessionId)
-			sendNotAllowed(senderSession, client_message, "Not allowed to request offer.")
+			sendError(NewError("not_allowed", "Not allowed to request offer."))
 			return
 		}
 
 		clientType = "subscriber"
 		mc, err = session.GetOrCreateSubscriber(ctx, h.mcu, message.Recipient.SessionId, data.RoomType)
 	case "sendoffer":
-		// Permissions have already been checked in "processMessageMsg".
+		// Permissions have already been checked in "processMessageMsg" (or by
+		// the instance of the sender for remote offers).
 		clientType = "subscriber"
 		mc, err = session.GetOrCreateSubscriber(ctx, h.mcu, message.Recipient.SessionId, data.RoomType)
 	case "offer":
@@ -1732,12 +2337,17 @@ func (h *Hub) processMcuMessage(senderSession *ClientSession, session *ClientSes
 		mc, err = session.GetOrCreatePublisher(ctx, h.mcu, data.RoomType, data)
 		if err, ok := err.(*PermissionError); ok {
 			log.Printf("Session %s is not allowed to offer %s, ignoring (%s)", session.PublicId(), data.RoomType, err)
-			sendNotAllowed(senderSession, client_message, "Not allowed to publish.")
+			sendError(NewError("not_allowed", "Not allowed to publish."))
 			return
 		}
 		if err, ok := err.(*SdpError); ok {
 			log.Printf("Session %s sent unsupported offer %s, ignoring (%s)", session.PublicId(), data.RoomType, err)
-			sendNotAllowed(senderSession, client_message, "Not allowed to publish.")
+			sendError(NewError("not_allowed", "Not allowed to publish."))
+			return
+		}
+		if err == TooManyPublishers {
+			log.Printf("Session %s may not publish %s: %s", session.PublicId(), data.RoomType, err)
+			sendError(TooManyPublishers)
 			return
 		}
 	case "selectStream":
@@ -1752,7 +2362,7 @@ func (h *Hub) processMcuMessage(senderSession *ClientSession, session *ClientSes
 		if session.PublicId() == message.Recipient.SessionId {
 			if err := session.IsAllowedToSend(data); err != nil {
 				log.Printf("Session %s is not allowed to send candidate for %s, ignoring (%s)", session.PublicId(), data.RoomType, err)
-				sendNotAllowed(senderSession, client_message, "Not allowed to send candidate.")
+				sendError(NewError("not_allowed", "Not allowed to send candidate."))
 				return
 			}
 
@@ -1765,18 +2375,18 @@ func (h *Hub) processMcuMessage(senderSession *ClientSession, session *ClientSes
 	}
 	if err != nil {
 		log.Printf("Could not create MCU %s for session %s to send %+v to %s: %s", clientType, session.PublicId(), data, message.Recipient.SessionId, err)
-		sendMcuClientNotFound(senderSession, client_message)
+		sendError(McuClientNotFound)
 		return
 	} else if mc == nil {
 		log.Printf("No MCU %s found for session %s to send %+v to %s", clientType, session.PublicId(), data, message.Recipient.SessionId)
-		sendMcuClientNotFound(senderSession, client_message)
+		sendError(McuClientNotFound)
 		return
 	}
 
 	mc.SendMessage(context.TODO(), message, data, func(err error, response map[string]interface{}) {
 		if err != nil {
 			log.Printf("Could not send MCU message %+v for session %s to %s: %s", data, session.PublicId(), message.Recipient.SessionId, err)
-			sendMcuProcessingFailed(senderSession, client_message)
+			sendError(McuProcessingFailed)
 			return
 		} else if response == nil {
 			// No response received
@@ -1787,6 +2397,37 @@ func (h *Hub) processMcuMessage(senderSession *ClientSession, session *ClientSes
 	})
 }
 
+func (h *Hub) sendRemoteMcuError(offer *NatsSendOfferMessage, e *Error) {
+	response := &ServerMessage{
+		Id:    offer.MessageId,
+		Type:  "error",
+		Error: e,
+	}
+	if err := h.nats.PublishMessage("session."+offer.SessionId, response); err != nil {
+		log.Printf("Could not send error %+v to remote session %s: %s", e, offer.SessionId, err)
+	}
+}
+
+// processRemoteSendOffer handles an offer that was sent by a session on a
+// different instance to the (local) session.
+func (h *Hub) processRemoteSendOffer(session *ClientSession, offer *NatsSendOfferMessage) {
+	if h.mcu == nil {
+		log.Printf("No MCU configured, can't process offer from %s in session %s", offer.SessionId, session.PublicId())
+		h.sendRemoteMcuError(offer, McuClientNotFound)
+		return
+	}
+
+	message := &MessageClientMessage{
+		Recipient: MessageClientMessageRecipient{
+			Type:      RecipientTypeSession,
+			SessionId: offer.SessionId,
+		},
+	}
+	h.doProcessMcuMessage(nil, session, message, offer.Data, func(e *Error) {
+		h.sendRemoteMcuError(offer, e)
+	})
+}
+
 func (h *Hub) sendMcuMessageResponse(session *ClientSession, message *MessageClientMessage, data *MessageClientMessageData, response map[string]interface{}) {
 	var response_message *ServerMessage
 	switch response["type"] {
@@ -1951,6 +2592,12 @@ func (h *Hub) serveWs(w http.ResponseWriter, r *http.Request) {
 	addr := getRealUserIP(r)
 	agent := r.Header.Get("User-Agent")
 
+	if h.IsDraining() {
+		log.Printf("Rejecting connection from %s while draining", addr)
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
 	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Could not upgrade request from %s: %s", addr, err)
@@ -1967,6 +2614,7 @@ func (h *Hub) serveWs(w http.ResponseWriter, r *http.Request) {
 		client.OnLookupCountry = h.lookupClientCountry
 	}
 	client.OnMessageReceived = h.processMessage
+	client.OnMessagePackReceived = h.processMessagePack
 	client.OnClosed = func(client *Client) {
 		h.processUnregister(client)
 	}
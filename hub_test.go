@@ -23,11 +23,19 @@ package signaling
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"reflect"
 	"strings"
 	"sync"
@@ -36,8 +44,10 @@ import (
 	"time"
 
 	"github.com/dlintw/goconf"
+	"github.com/golang-jwt/jwt"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
 )
 
 const (
@@ -148,6 +158,73 @@ func CreateHubWithMultipleBackendsForTest(t *testing.T) (*Hub, NatsClient, *mux.
 	return h, nats, r, server, shutdown
 }
 
+func CreateClusteredHubsForTestWithConfig(t *testing.T, getConfigFunc func(*httptest.Server) (*goconf.ConfigFile, error)) (*Hub, *Hub, *httptest.Server, *httptest.Server, func()) {
+	r1 := mux.NewRouter()
+	registerBackendHandler(t, r1)
+
+	server1 := httptest.NewServer(r1)
+	r2 := mux.NewRouter()
+	registerBackendHandler(t, r2)
+
+	server2 := httptest.NewServer(r2)
+	// Both hubs are connected to the same NATS server.
+	nats, err := NewLoopbackNatsClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config1, err := getConfigFunc(server1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h1, err := NewHub(config1, nats, r1, "no-version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config2, err := getConfigFunc(server2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := NewHub(config2, nats, r2, "no-version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1, err := NewBackendServer(config1, h1, "no-version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b1.Start(r1); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := NewBackendServer(config2, h2, "no-version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b2.Start(r2); err != nil {
+		t.Fatal(err)
+	}
+
+	go h1.Run()
+	go h2.Run()
+
+	shutdown := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+
+		WaitForHub(ctx, t, h1)
+		WaitForHub(ctx, t, h2)
+		(nats).(*LoopbackNatsClient).waitForSubscriptionsEmpty(ctx, t)
+		nats.Close()
+		server1.Close()
+		server2.Close()
+	}
+
+	return h1, h2, server1, server2, shutdown
+}
+
+func CreateClusteredHubsForTest(t *testing.T) (*Hub, *Hub, *httptest.Server, *httptest.Server, func()) {
+	return CreateClusteredHubsForTestWithConfig(t, getTestConfig)
+}
+
 func WaitForHub(ctx context.Context, t *testing.T, h *Hub) {
 	// Wait for any channel messages to be processed.
 	time.Sleep(10 * time.Millisecond)
@@ -295,9 +372,48 @@ func processRoomRequest(t *testing.T, w http.ResponseWriter, r *http.Request, re
 		}
 		response.Room.Session = (*json.RawMessage)(&tmp)
 	}
+	if request.Room.RoomId == "test-room-lobby" && request.Room.Action == "leave" {
+		lobbyLeaveRequestsLock.Lock()
+		lobbyLeaveRequests[request.Room.SessionId] = true
+		lobbyLeaveRequestsLock.Unlock()
+	}
+	if request.Room.RoomId == "test-room-lobby" && request.Room.Action == "" {
+		// The first user is the moderator, all others must wait in the lobby.
+		if request.Room.UserId == testDefaultUserId+"1" {
+			response.Room.Permissions = &[]Permission{PERMISSION_MAY_CONTROL}
+		} else {
+			response.Room.Waiting = true
+		}
+	}
+	if request.Room.RoomId == "test-room-limits" {
+		response.Room.MaxSessions = 2
+		response.Room.MaxPublishers = 1
+	}
 	return response
 }
 
+var (
+	lobbyLeaveRequestsLock sync.Mutex
+	lobbyLeaveRequests     = make(map[string]bool)
+)
+
+func waitForLobbyLeaveRequest(ctx context.Context, roomSessionId string) error {
+	for {
+		lobbyLeaveRequestsLock.Lock()
+		found := lobbyLeaveRequests[roomSessionId]
+		lobbyLeaveRequestsLock.Unlock()
+		if found {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("no leave request received for %s: %s", roomSessionId, ctx.Err())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
 func processSessionRequest(t *testing.T, w http.ResponseWriter, r *http.Request, request *BackendClientRequest) *BackendClientResponse {
 	if request.Type != "session" || request.Session == nil {
 		t.Fatalf("Expected an session backend request, got %+v", request)
@@ -315,6 +431,46 @@ func processSessionRequest(t *testing.T, w http.ResponseWriter, r *http.Request,
 	return response
 }
 
+var (
+	recordingRequestsLock sync.Mutex
+	recordingRequests     = make(map[string][]*BackendClientRecordingRequest)
+)
+
+func getRecordingRequests(roomId string) []*BackendClientRecordingRequest {
+	recordingRequestsLock.Lock()
+	defer recordingRequestsLock.Unlock()
+
+	result := make([]*BackendClientRecordingRequest, len(recordingRequests[roomId]))
+	copy(result, recordingRequests[roomId])
+	return result
+}
+
+func clearRecordingRequests(roomId string) {
+	recordingRequestsLock.Lock()
+	defer recordingRequestsLock.Unlock()
+
+	delete(recordingRequests, roomId)
+}
+
+func processRecordingRequest(t *testing.T, w http.ResponseWriter, r *http.Request, request *BackendClientRequest) *BackendClientResponse {
+	if request.Type != "recording" || request.Recording == nil {
+		t.Fatalf("Expected a recording backend request, got %+v", request)
+	}
+
+	recordingRequestsLock.Lock()
+	recordingRequests[request.Recording.RoomId] = append(recordingRequests[request.Recording.RoomId], request.Recording)
+	recordingRequestsLock.Unlock()
+
+	response := &BackendClientResponse{
+		Type: "recording",
+		Recording: &BackendClientRecordingResponse{
+			Version: BackendVersion,
+			RoomId:  request.Recording.RoomId,
+		},
+	}
+	return response
+}
+
 func processPingRequest(t *testing.T, w http.ResponseWriter, r *http.Request, request *BackendClientRequest) *BackendClientResponse {
 	if request.Type != "ping" || request.Ping == nil {
 		t.Fatalf("Expected an ping backend request, got %+v", request)
@@ -355,6 +511,8 @@ func registerBackendHandlerUrl(t *testing.T, router *mux.Router, url string) {
 			return processSessionRequest(t, w, r, request)
 		case "ping":
 			return processPingRequest(t, w, r, request)
+		case "recording":
+			return processRecordingRequest(t, w, r, request)
 		default:
 			t.Fatalf("Unsupported request received: %+v", request)
 			return nil
@@ -548,6 +706,216 @@ func TestClientHelloAllowAll(t *testing.T) {
 	}
 }
 
+func writeTestPublicKey(t *testing.T, key interface{}) string {
+	data, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "signaling-publickey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := pem.Encode(f, &pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: data,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func newTestHelloV2TokenClaims(server *httptest.Server, userId string, expires time.Time) *HelloV2TokenClaims {
+	userdata := json.RawMessage("{\"displayname\":\"Test user\"}")
+	return &HelloV2TokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    server.URL,
+			Audience:  "compat",
+			Subject:   userId,
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: expires.Unix(),
+		},
+		BackendId: "compat",
+		UserData:  &userdata,
+	}
+}
+
+func createTestHelloV2Token(t *testing.T, method jwt.SigningMethod, key interface{}, server *httptest.Server, userId string, expires time.Time) string {
+	return createTestHelloV2TokenWithClaims(t, method, key, newTestHelloV2TokenClaims(server, userId, expires))
+}
+
+func createTestHelloV2TokenWithClaims(t *testing.T, method jwt.SigningMethod, key interface{}, claims *HelloV2TokenClaims) string {
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestClientHelloV2(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := map[string]struct {
+		method     jwt.SigningMethod
+		privateKey interface{}
+		publicKey  interface{}
+	}{
+		"rsa": {
+			method:     jwt.SigningMethodRS256,
+			privateKey: rsaKey,
+			publicKey:  &rsaKey.PublicKey,
+		},
+		"ecdsa": {
+			method:     jwt.SigningMethodES256,
+			privateKey: ecdsaKey,
+			publicKey:  &ecdsaKey.PublicKey,
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			filename := writeTestPublicKey(t, tc.publicKey)
+			defer os.Remove(filename)
+
+			hub, _, _, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+				config, err := getTestConfig(server)
+				if err != nil {
+					return nil, err
+				}
+
+				config.AddOption("backend", "publickey", filename)
+				return config, nil
+			})
+			defer shutdown()
+
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			defer cancel()
+
+			client := NewTestClient(t, server, hub)
+			defer client.CloseWithBye()
+
+			token := createTestHelloV2Token(t, tc.method, tc.privateKey, server, testDefaultUserId, time.Now().Add(time.Minute))
+			if err := client.SendHelloV2(token); err != nil {
+				t.Fatal(err)
+			}
+
+			if hello, err := client.RunUntilHello(ctx); err != nil {
+				t.Error(err)
+			} else {
+				if hello.Hello.UserId != testDefaultUserId {
+					t.Errorf("Expected \"%s\", got %+v", testDefaultUserId, hello.Hello)
+				}
+				if hello.Hello.SessionId == "" {
+					t.Errorf("Expected session id, got %+v", hello.Hello)
+				}
+
+				session := hub.GetSessionByPublicId(hello.Hello.SessionId)
+				if session == nil {
+					t.Fatalf("Could not find session %s", hello.Hello.SessionId)
+				} else if data := session.UserData(); data == nil || string(*data) != "{\"displayname\":\"Test user\"}" {
+					t.Errorf("Expected user data, got %+v", data)
+				}
+			}
+
+			// Expired tokens are rejected.
+			client2 := NewTestClient(t, server, hub)
+			defer client2.CloseWithBye()
+
+			token = createTestHelloV2Token(t, tc.method, tc.privateKey, server, testDefaultUserId, time.Now().Add(-time.Minute))
+			if err := client2.SendHelloV2(token); err != nil {
+				t.Fatal(err)
+			}
+			if msg, err := client2.RunUntilMessage(ctx); err != nil {
+				t.Error(err)
+			} else if err := checkMessageError(msg, "token_expired"); err != nil {
+				t.Error(err)
+			}
+
+			// Tokens signed by other keys are rejected.
+			otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				t.Fatal(err)
+			}
+			token = createTestHelloV2Token(t, jwt.SigningMethodRS256, otherKey, server, testDefaultUserId, time.Now().Add(time.Minute))
+			if err := client2.SendHelloV2(token); err != nil {
+				t.Fatal(err)
+			}
+			if msg, err := client2.RunUntilMessage(ctx); err != nil {
+				t.Error(err)
+			} else if err := checkMessageError(msg, "invalid_token"); err != nil {
+				t.Error(err)
+			}
+
+			// Tokens must have been issued by the backend for the signaling server.
+			invalidClaims := map[string]func(claims *HelloV2TokenClaims){
+				"no backend id": func(claims *HelloV2TokenClaims) {
+					claims.BackendId = ""
+				},
+				"other backend id": func(claims *HelloV2TokenClaims) {
+					claims.BackendId = "other"
+				},
+				"no audience": func(claims *HelloV2TokenClaims) {
+					claims.Audience = ""
+				},
+				"other audience": func(claims *HelloV2TokenClaims) {
+					claims.Audience = "other"
+				},
+				"other issuer": func(claims *HelloV2TokenClaims) {
+					claims.Issuer = "https://domain.invalid"
+				},
+			}
+			for name, f := range invalidClaims {
+				claims := newTestHelloV2TokenClaims(server, testDefaultUserId, time.Now().Add(time.Minute))
+				f(claims)
+				token = createTestHelloV2TokenWithClaims(t, tc.method, tc.privateKey, claims)
+				if err := client2.SendHelloV2(token); err != nil {
+					t.Fatal(err)
+				}
+				if msg, err := client2.RunUntilMessage(ctx); err != nil {
+					t.Error(err)
+				} else if err := checkMessageError(msg, "invalid_token"); err != nil {
+					t.Errorf("%s: %s", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestClientHelloV2NotSupported(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+
+	token := createTestHelloV2Token(t, jwt.SigningMethodRS256, key, server, testDefaultUserId, time.Now().Add(time.Minute))
+	if err := client.SendHelloV2(token); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	if msg, err := client.RunUntilMessage(ctx); err != nil {
+		t.Error(err)
+	} else if err := checkMessageError(msg, "token_not_supported"); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestClientHelloSessionLimit(t *testing.T) {
 	hub, _, router, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
 		config, err := getTestConfig(server)
@@ -792,6 +1160,128 @@ func TestClientHelloResume(t *testing.T) {
 	}
 }
 
+func TestClientHelloResumeSequence(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHelloWithFeatures(testDefaultUserId+"1", []string{ClientFeatureSequence}); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if hello1.Seq != 0 {
+		t.Errorf("Hello response should not have a sequence number, got %+v", hello1)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recipient1 := MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}
+	for i := 1; i <= 3; i++ {
+		if err := client2.SendMessage(recipient1, i); err != nil {
+			t.Fatal(err)
+		}
+
+		var payload int
+		var sender *MessageServerMessageSender
+		if msg, err := client1.RunUntilMessage(ctx); err != nil {
+			t.Fatal(err)
+		} else if msg.Seq != uint64(i) {
+			t.Errorf("Expected sequence %d, got %+v", i, msg)
+		} else if err := checkMessageType(msg, "message"); err != nil {
+			t.Fatal(err)
+		} else if err := json.Unmarshal(*msg.Message.Data, &payload); err != nil {
+			t.Fatal(err)
+		} else if payload != i {
+			t.Errorf("Expected payload %d, got %d", i, payload)
+		} else {
+			sender = msg.Message.Sender
+		}
+		if sender == nil || sender.SessionId != hello2.Hello.SessionId {
+			t.Errorf("Expected sender %s, got %+v", hello2.Hello.SessionId, sender)
+		}
+	}
+
+	// Acknowledged messages are removed from the replay buffer.
+	if err := client1.SendAck(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Client 1 disconnects without having processed message 3.
+	client1.Close()
+	if err := client1.WaitForClientRemoved(ctx); err != nil {
+		t.Error(err)
+	}
+
+	session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	session1.mu.Lock()
+	if len(session1.replayMessages) != 2 {
+		t.Errorf("Expected 2 messages to replay, got %+v", session1.replayMessages)
+	}
+	session1.mu.Unlock()
+
+	if err := client2.SendMessage(recipient1, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	// Give message processing some time.
+	time.Sleep(10 * time.Millisecond)
+
+	client1 = NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHelloResumeWithSequence(hello1.Hello.ResumeId, 2); err != nil {
+		t.Fatal(err)
+	}
+	if hello, err := client1.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	} else if hello.Hello.SessionId != hello1.Hello.SessionId {
+		t.Errorf("Expected session id %s, got %+v", hello1.Hello.SessionId, hello.Hello)
+	}
+
+	// Exactly the missed messages are replayed.
+	for i := 3; i <= 4; i++ {
+		var payload int
+		if msg, err := client1.RunUntilMessage(ctx); err != nil {
+			t.Fatal(err)
+		} else if msg.Seq != uint64(i) {
+			t.Errorf("Expected sequence %d, got %+v", i, msg)
+		} else if err := checkMessageType(msg, "message"); err != nil {
+			t.Fatal(err)
+		} else if err := json.Unmarshal(*msg.Message.Data, &payload); err != nil {
+			t.Fatal(err)
+		} else if payload != i {
+			t.Errorf("Expected payload %d, got %d", i, payload)
+		}
+	}
+
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel2()
+
+	if msg, err := client1.RunUntilMessage(ctx2); err != nil {
+		if err != context.DeadlineExceeded {
+			t.Fatal(err)
+		}
+	} else {
+		t.Errorf("Expected no payload, got %+v", msg)
+	}
+}
+
 func TestClientHelloResumeExpired(t *testing.T) {
 	hub, _, _, server, shutdown := CreateHubForTest(t)
 	defer shutdown()
@@ -1012,9 +1502,348 @@ func TestClientHelloResumeOtherHub(t *testing.T) {
 	hub.performHousekeeping(time.Now().Add(2 * sessionExpireDuration))
 }
 
-func TestClientHelloResumePublicId(t *testing.T) {
-	// Test that a client can't resume a "public" session of another user.
-	hub, _, _, server, shutdown := CreateHubForTest(t)
+func TestClientHelloResumeCluster(t *testing.T) {
+	// Both servers must accept the backend of the session.
+	hub1, hub2, server1, server2, shutdown := CreateClusteredHubsForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("backend", "allowall", "true")
+		return config, nil
+	})
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server1, hub1)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server1, hub1)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+	if err := client2.RunUntilJoined(ctx, hello1.Hello, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+
+	client1.Close()
+	if err := client1.WaitForClientRemoved(ctx); err != nil {
+		t.Error(err)
+	}
+
+	// The session is resumed on the second hub.
+	client3 := NewTestClient(t, server2, hub2)
+	defer client3.CloseWithBye()
+	if err := client3.SendHelloResume(hello1.Hello.ResumeId); err != nil {
+		t.Fatal(err)
+	}
+	hello3, err := client3.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if hello3.Hello.SessionId != hello1.Hello.SessionId {
+		t.Errorf("Expected session id %s, got %+v", hello1.Hello.SessionId, hello3.Hello)
+	} else if hello3.Hello.ResumeId != hello1.Hello.ResumeId {
+		t.Errorf("Expected resume id %s, got %+v", hello1.Hello.ResumeId, hello3.Hello)
+	}
+
+	if session := hub1.GetSessionByPublicId(hello1.Hello.SessionId); session != nil {
+		t.Errorf("Session %s should have been removed from first hub", hello1.Hello.SessionId)
+	}
+	session := hub2.GetSessionByPublicId(hello1.Hello.SessionId)
+	if session == nil {
+		t.Fatalf("Session %s does not exist on second hub", hello1.Hello.SessionId)
+	} else if room := session.(*ClientSession).GetRoom(); room == nil || room.Id() != roomId {
+		t.Errorf("Expected session in room %s, got %+v", roomId, room)
+	}
+
+	// The other room member didn't notice the session moved.
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel2()
+	if msg, err := client2.RunUntilMessage(ctx2); err != nil {
+		if err != context.DeadlineExceeded {
+			t.Error(err)
+		}
+	} else {
+		t.Errorf("Expected no message, got %+v", msg)
+	}
+
+	recipient := MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}
+	data := "from-2-to-1"
+	if err := client2.SendMessage(recipient, data); err != nil {
+		t.Fatal(err)
+	}
+	var payload string
+	if err := checkReceiveClientMessage(ctx, client3, "session", hello2.Hello, &payload); err != nil {
+		t.Error(err)
+	} else if payload != data {
+		t.Errorf("Expected payload %s, got %s", data, payload)
+	}
+
+	// Resuming again on the first hub is no longer possible, the session was
+	// taken over by the client on the second hub.
+	client4 := NewTestClient(t, server1, hub1)
+	defer client4.CloseWithBye()
+	if err := client4.SendHelloResume(hello1.Hello.ResumeId); err != nil {
+		t.Fatal(err)
+	}
+	if hello4, err := client4.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	} else if hello4.Hello.SessionId != hello1.Hello.SessionId {
+		t.Errorf("Expected session id %s, got %+v", hello1.Hello.SessionId, hello4.Hello)
+	}
+	if msg, err := client3.RunUntilMessage(ctx); err != nil {
+		t.Error(err)
+	} else if msg.Type != "bye" || msg.Bye == nil || msg.Bye.Reason != "session_resumed" {
+		t.Errorf("Expected bye with reason session_resumed, got %+v", msg)
+	}
+}
+
+func TestClientHelloResumeClusterPublishers(t *testing.T) {
+	// Both servers must accept the backend of the session.
+	hub1, hub2, server1, server2, shutdown := CreateClusteredHubsForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("backend", "allowall", "true")
+		return config, nil
+	})
+	defer shutdown()
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub1.SetMcu(mcu)
+	hub2.SetMcu(mcu)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server1, hub1)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := &MessageClientMessageData{
+		Type:     "offer",
+		RoomType: streamTypeVideo,
+		Payload: map[string]interface{}{
+			"sdp": MockSdpOfferAudioAndVideo,
+		},
+	}
+	session1 := hub1.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	publisher, err := session1.GetOrCreatePublisher(ctx, mcu, streamTypeVideo, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client1.Close()
+	if err := client1.WaitForClientRemoved(ctx); err != nil {
+		t.Error(err)
+	}
+
+	client2 := NewTestClient(t, server2, hub2)
+	defer client2.CloseWithBye()
+	if err := client2.SendHelloResume(hello1.Hello.ResumeId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client2.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The publisher is kept until the session created a new one.
+	if publisher.(*TestMCUPublisher).isClosed() {
+		t.Error("Publisher should not be closed after handover")
+	}
+
+	session2 := hub2.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	if _, err := session2.GetOrCreatePublisher(ctx, mcu, streamTypeVideo, data); err != nil {
+		t.Fatal(err)
+	}
+	for !publisher.(*TestMCUPublisher).isClosed() {
+		select {
+		case <-ctx.Done():
+			t.Fatal("Publisher was not closed after it was replaced")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestClientHelloResumeClusterUnknownSession(t *testing.T) {
+	hub1, hub2, server1, server2, shutdown := CreateClusteredHubsForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server1, hub1)
+	if err := client1.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client1.CloseWithBye()
+	if err := client1.WaitForClientRemoved(ctx); err != nil {
+		t.Error(err)
+	}
+
+	// The other server responds that it doesn't own the session, no need to
+	// wait for the handover timeout.
+	client2 := NewTestClient(t, server2, hub2)
+	defer client2.CloseWithBye()
+	start := time.Now()
+	if err := client2.SendHelloResume(hello1.Hello.ResumeId); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(msg, "no_such_session"); err != nil {
+		t.Error(err)
+	}
+	if duration := time.Since(start); duration >= handoverTimeout {
+		t.Errorf("Expected response before timeout, took %s", duration)
+	}
+}
+
+func TestClientHelloResumeClusterSessionLimit(t *testing.T) {
+	hub1, hub2, server1, server2, shutdown := CreateClusteredHubsForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("backend", "allowall", "true")
+		config.AddOption("backend", "sessionlimit", "1")
+		return config, nil
+	})
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server1, hub1)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server2, hub2)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+	if err := client2.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+
+	client1.Close()
+	if err := client1.WaitForClientRemoved(ctx); err != nil {
+		t.Error(err)
+	}
+
+	// Resuming on the second hub would exceed the session limit there.
+	client3 := NewTestClient(t, server2, hub2)
+	defer client3.CloseWithBye()
+	if err := client3.SendHelloResume(hello1.Hello.ResumeId); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client3.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(msg, "session_limit_exceeded"); err != nil {
+		t.Error(err)
+	}
+
+	if session := hub1.GetSessionByPublicId(hello1.Hello.SessionId); session != nil {
+		t.Errorf("Session %s should have been removed from first hub", hello1.Hello.SessionId)
+	}
+	if session := hub2.GetSessionByPublicId(hello1.Hello.SessionId); session != nil {
+		t.Errorf("Session %s should not exist on second hub", hello1.Hello.SessionId)
+	}
+
+	// The other room member is notified that the session left.
+	if err := client2.RunUntilLeft(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientHelloResumePublicId(t *testing.T) {
+	// Test that a client can't resume a "public" session of another user.
+	hub, _, _, server, shutdown := CreateHubForTest(t)
 	defer shutdown()
 
 	client1 := NewTestClient(t, server, hub)
@@ -1367,13 +2196,13 @@ func TestClientMessageToSessionId(t *testing.T) {
 	}
 }
 
-func TestClientMessageToUserId(t *testing.T) {
+func TestClientMessagePack(t *testing.T) {
 	hub, _, _, server, shutdown := CreateHubForTest(t)
 	defer shutdown()
 
 	client1 := NewTestClient(t, server, hub)
 	defer client1.CloseWithBye()
-	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+	if err := client1.SendHelloWithFeatures(testDefaultUserId+"1", []string{ClientFeatureMessagePack}); err != nil {
 		t.Fatal(err)
 	}
 	client2 := NewTestClient(t, server, hub)
@@ -1394,10 +2223,173 @@ func TestClientMessageToUserId(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if hello1.Hello.SessionId == hello2.Hello.SessionId {
-		t.Fatalf("Expected different session ids, got %s twice", hello1.Hello.SessionId)
-	} else if hello1.Hello.UserId == hello2.Hello.UserId {
-		t.Fatalf("Expected different user ids, got %s twice", hello1.Hello.UserId)
+	// The "hello" response is already sent as MessagePack.
+	if count := atomic.LoadUint32(&client1.binaryMessages); count != 1 {
+		t.Errorf("Expected one binary message, got %d", count)
+	}
+
+	data1 := "from-1-to-2"
+	data, err := json.Marshal(data1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client1.WriteMessagePack(&ClientMessage{
+		Id:   "abcd",
+		Type: "message",
+		Message: &MessageClientMessage{
+			Recipient: MessageClientMessageRecipient{
+				Type:      "session",
+				SessionId: hello2.Hello.SessionId,
+			},
+			Data: (*json.RawMessage)(&data),
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	data2 := "from-2-to-1"
+	client2.SendMessage(MessageClientMessageRecipient{ // nolint
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, data2)
+
+	var payload string
+	if err := checkReceiveClientMessage(ctx, client1, "session", hello2.Hello, &payload); err != nil {
+		t.Error(err)
+	} else if payload != data2 {
+		t.Errorf("Expected payload %s, got %s", data2, payload)
+	}
+	if err := checkReceiveClientMessage(ctx, client2, "session", hello1.Hello, &payload); err != nil {
+		t.Error(err)
+	} else if payload != data1 {
+		t.Errorf("Expected payload %s, got %s", data1, payload)
+	}
+
+	if count := atomic.LoadUint32(&client1.binaryMessages); count != 2 {
+		t.Errorf("Expected two binary messages, got %d", count)
+	}
+	if count := atomic.LoadUint32(&client2.binaryMessages); count != 0 {
+		t.Errorf("Expected no binary messages, got %d", count)
+	}
+}
+
+func TestClientCompressionDisabled(t *testing.T) {
+	_, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	dialer := websocket.Dialer{
+		EnableCompression: true,
+	}
+	conn, response, err := dialer.Dial(getWebsocketUrl(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if extensions := response.Header.Get("Sec-WebSocket-Extensions"); strings.Contains(extensions, "permessage-deflate") {
+		t.Errorf("Expected compression to be disabled by default, got %s", extensions)
+	}
+}
+
+func TestClientCompression(t *testing.T) {
+	_, _, _, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("clients", "compression", "true")
+		return config, nil
+	})
+	defer shutdown()
+
+	dialer := websocket.Dialer{
+		EnableCompression: true,
+	}
+	conn, response, err := dialer.Dial(getWebsocketUrl(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if extensions := response.Header.Get("Sec-WebSocket-Extensions"); !strings.Contains(extensions, "permessage-deflate") {
+		t.Errorf("Expected compression to be negotiated, got %s", extensions)
+	}
+
+	params, err := json.Marshal(TestBackendClientAuthParams{
+		UserId: testDefaultUserId,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteJSON(&ClientMessage{
+		Id:   "1234",
+		Type: "hello",
+		Hello: &HelloClientMessage{
+			Version: HelloVersion,
+			Auth: HelloClientMessageAuth{
+				Url:    server.URL,
+				Params: (*json.RawMessage)(&params),
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(testTimeout)) // nolint
+	var message ServerMessage
+	if err := conn.ReadJSON(&message); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(&message, "hello"); err != nil {
+		t.Error(err)
+	} else if message.Hello.UserId != testDefaultUserId {
+		t.Errorf("Expected \"%s\", got %+v", testDefaultUserId, message.Hello)
+	}
+
+	if err := conn.WriteJSON(&ClientMessage{
+		Id:   "9876",
+		Type: "bye",
+		Bye:  &ByeClientMessage{},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.ReadJSON(&message); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(&message, "bye"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientMessageToUserId(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hello1.Hello.SessionId == hello2.Hello.SessionId {
+		t.Fatalf("Expected different session ids, got %s twice", hello1.Hello.SessionId)
+	} else if hello1.Hello.UserId == hello2.Hello.UserId {
+		t.Fatalf("Expected different user ids, got %s twice", hello1.Hello.UserId)
 	}
 
 	recipient1 := MessageClientMessageRecipient{
@@ -1428,6 +2420,85 @@ func TestClientMessageToUserId(t *testing.T) {
 	}
 }
 
+func TestClientMessageToOwnSessions(t *testing.T) {
+	hub1, hub2, server1, server2, shutdown := CreateClusteredHubsForTest(t)
+	defer shutdown()
+
+	client1 := NewTestClient(t, server1, hub1)
+	defer client1.CloseWithBye()
+	if err := client1.SendHelloWithFeatures(testDefaultUserId, []string{ClientFeatureOwnSessions}); err != nil {
+		t.Fatal(err)
+	}
+	client2 := NewTestClient(t, server2, hub2)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	client3 := NewTestClient(t, server1, hub1)
+	defer client3.CloseWithBye()
+	if err := client3.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client2.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client3.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	recipient := MessageClientMessageRecipient{
+		Type:   "user",
+		UserId: testDefaultUserId,
+	}
+
+	// The other sessions of the user will receive the message.
+	data1 := "from-1-to-own"
+	if err := client1.SendMessage(recipient, data1); err != nil {
+		t.Fatal(err)
+	}
+
+	var payload string
+	if err := checkReceiveClientMessage(ctx, client2, "user", hello1.Hello, &payload); err != nil {
+		t.Error(err)
+	} else if payload != data1 {
+		t.Errorf("Expected payload %s, got %s", data1, payload)
+	}
+	if err := checkReceiveClientMessage(ctx, client3, "user", hello1.Hello, &payload); err != nil {
+		t.Error(err)
+	} else if payload != data1 {
+		t.Errorf("Expected payload %s, got %s", data1, payload)
+	}
+
+	// Sessions that didn't opt-in can't send to their other sessions.
+	if err := client2.SendMessage(recipient, "from-2-to-own"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The sending session doesn't receive its own message.
+	ctx2, cancel2 := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel2()
+	if msg, err := client1.RunUntilMessage(ctx2); err == nil {
+		t.Errorf("Expected no message, got %+v", msg)
+	} else if err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+	ctx3, cancel3 := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel3()
+	if msg, err := client3.RunUntilMessage(ctx3); err == nil {
+		t.Errorf("Expected no message, got %+v", msg)
+	} else if err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+}
+
 func TestClientMessageToUserIdMultipleSessions(t *testing.T) {
 	hub, _, _, server, shutdown := CreateHubForTest(t)
 	defer shutdown()
@@ -1491,74 +2562,1234 @@ func TestClientMessageToUserIdMultipleSessions(t *testing.T) {
 	var payload string
 	if err := checkReceiveClientMessage(ctx, client2a, "user", hello1.Hello, &payload); err != nil {
 		t.Error(err)
-	} else if payload != data1 {
-		t.Errorf("Expected payload %s, got %s", data1, payload)
+	} else if payload != data1 {
+		t.Errorf("Expected payload %s, got %s", data1, payload)
+	}
+	if err := checkReceiveClientMessage(ctx, client2b, "user", hello1.Hello, &payload); err != nil {
+		t.Error(err)
+	} else if payload != data1 {
+		t.Errorf("Expected payload %s, got %s", data1, payload)
+	}
+}
+
+func WaitForUsersJoined(ctx context.Context, t *testing.T, client1 *TestClient, hello1 *ServerMessage, client2 *TestClient, hello2 *ServerMessage) {
+	// We will receive "joined" events for all clients. The ordering is not
+	// defined as messages are processed and sent by asynchronous NATS handlers.
+	msg1_1, err := client1.RunUntilMessage(ctx)
+	if err != nil {
+		t.Error(err)
+	}
+	msg1_2, err := client1.RunUntilMessage(ctx)
+	if err != nil {
+		t.Error(err)
+	}
+	msg2_1, err := client2.RunUntilMessage(ctx)
+	if err != nil {
+		t.Error(err)
+	}
+	msg2_2, err := client2.RunUntilMessage(ctx)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := client1.checkMessageJoined(msg1_1, hello1.Hello); err != nil {
+		// Ordering is "joined" from client 2, then from client 1
+		if err := client1.checkMessageJoined(msg1_1, hello2.Hello); err != nil {
+			t.Error(err)
+		}
+		if err := client1.checkMessageJoined(msg1_2, hello1.Hello); err != nil {
+			t.Error(err)
+		}
+	} else {
+		// Ordering is "joined" from client 1, then from client 2
+		if err := client1.checkMessageJoined(msg1_2, hello2.Hello); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := client2.checkMessageJoined(msg2_1, hello1.Hello); err != nil {
+		// Ordering is "joined" from client 2, then from client 1
+		if err := client2.checkMessageJoined(msg2_1, hello2.Hello); err != nil {
+			t.Error(err)
+		}
+		if err := client2.checkMessageJoined(msg2_2, hello1.Hello); err != nil {
+			t.Error(err)
+		}
+	} else {
+		// Ordering is "joined" from client 1, then from client 2
+		if err := client2.checkMessageJoined(msg2_2, hello2.Hello); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestClientMessageToRoom(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hello1.Hello.SessionId == hello2.Hello.SessionId {
+		t.Fatalf("Expected different session ids, got %s twice", hello1.Hello.SessionId)
+	} else if hello1.Hello.UserId == hello2.Hello.UserId {
+		t.Fatalf("Expected different user ids, got %s twice", hello1.Hello.UserId)
+	}
+
+	// Join room by id.
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// Give message processing some time.
+	time.Sleep(10 * time.Millisecond)
+
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	WaitForUsersJoined(ctx, t, client1, hello1, client2, hello2)
+
+	recipient := MessageClientMessageRecipient{
+		Type: "room",
+	}
+
+	data1 := "from-1-to-2"
+	client1.SendMessage(recipient, data1) // nolint
+	data2 := "from-2-to-1"
+	client2.SendMessage(recipient, data2) // nolint
+
+	var payload string
+	if err := checkReceiveClientMessage(ctx, client1, "room", hello2.Hello, &payload); err != nil {
+		t.Error(err)
+	} else if payload != data2 {
+		t.Errorf("Expected payload %s, got %s", data2, payload)
+	}
+
+	if err := checkReceiveClientMessage(ctx, client2, "room", hello1.Hello, &payload); err != nil {
+		t.Error(err)
+	} else if payload != data1 {
+		t.Errorf("Expected payload %s, got %s", data1, payload)
+	}
+}
+
+func TestClientMessageToCall(t *testing.T) {
+	hub1, hub2, server1, server2, shutdown := CreateClusteredHubsForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server1, hub1)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server2, hub2)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+	if err := client2.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+
+	recipient := MessageClientMessageRecipient{
+		Type: "call",
+	}
+
+	// Nobody is in the call yet, so the messages will not be delivered.
+	if err := client1.SendMessage(recipient, "from-1-not-delivered"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client2.SendMessage(recipient, "from-2-not-delivered"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx2, cancel2 := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel2()
+	if msg, err := client1.RunUntilMessage(ctx2); err == nil {
+		t.Errorf("Expected no message, got %+v", msg)
+	} else if err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+	ctx3, cancel3 := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel3()
+	if msg, err := client2.RunUntilMessage(ctx3); err == nil {
+		t.Errorf("Expected no message, got %+v", msg)
+	} else if err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+
+	// Simulate the second client joining the call on its hub.
+	session2 := hub2.GetSessionByPublicId(hello2.Hello.SessionId)
+	if session2 == nil {
+		t.Fatalf("Session %s does not exist", hello2.Hello.SessionId)
+	}
+	room2 := hub2.getRoom(roomId)
+	if room2 == nil {
+		t.Fatalf("Could not find room %s", roomId)
+	}
+	room2.setSessionInCall(session2)
+
+	data1 := "from-1-to-call"
+	if err := client1.SendMessage(recipient, data1); err != nil {
+		t.Fatal(err)
+	}
+	data2 := "from-2-to-call"
+	if err := client2.SendMessage(recipient, data2); err != nil {
+		t.Fatal(err)
+	}
+
+	var payload string
+	if err := checkReceiveClientMessage(ctx, client2, "call", hello1.Hello, &payload); err != nil {
+		t.Error(err)
+	} else if payload != data1 {
+		t.Errorf("Expected payload %s, got %s", data1, payload)
+	}
+
+	// The first client is still not in the call.
+	ctx4, cancel4 := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel4()
+	if msg, err := client1.RunUntilMessage(ctx4); err == nil {
+		t.Errorf("Expected no message, got %+v", msg)
+	} else if err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+}
+
+func runUntilClientMessageIgnoringEvents(ctx context.Context, client *TestClient) (*ServerMessage, error) {
+	for {
+		msg, err := client.RunUntilMessage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if msg.Type == "event" {
+			continue
+		}
+
+		return msg, nil
+	}
+}
+
+func TestClientMessageToCallVirtualSession(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientInternal := NewTestClient(t, server, hub)
+	defer clientInternal.CloseWithBye()
+	if err := clientInternal.SendHelloInternal(); err != nil {
+		t.Fatal(err)
+	}
+	helloInternal, err := clientInternal.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client.RunUntilJoined(ctx, hello.Hello); err != nil {
+		t.Fatal(err)
+	}
+	if room, err := clientInternal.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	room := hub.getRoom(roomId)
+	if room == nil {
+		t.Fatalf("Could not find room %s", roomId)
+	}
+	room.setSessionInCall(hub.GetSessionByPublicId(hello.Hello.SessionId))
+
+	msgAdd := &ClientMessage{
+		Type: "internal",
+		Internal: &InternalClientMessage{
+			Type: "addsession",
+			AddSession: &AddSessionInternalClientMessage{
+				CommonSessionInternalClientMessage: CommonSessionInternalClientMessage{
+					SessionId: "session1",
+					RoomId:    roomId,
+				},
+				UserId: "user1",
+			},
+		},
+	}
+	if err := clientInternal.WriteJSON(msgAdd); err != nil {
+		t.Fatal(err)
+	}
+
+	var virtualSession *VirtualSession
+	internalSession := hub.GetSessionByPublicId(helloInternal.Hello.SessionId).(*ClientSession)
+	for virtualSession == nil {
+		internalSession.mu.Lock()
+		for session := range internalSession.virtualSessions {
+			virtualSession = session
+		}
+		internalSession.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	recipient := MessageClientMessageRecipient{
+		Type: "call",
+	}
+
+	// The virtual session is not in the call, so the internal session will
+	// not receive the message.
+	if err := client.SendMessage(recipient, "not-delivered"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx2, cancel2 := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel2()
+	if msg, err := runUntilClientMessageIgnoringEvents(ctx2, clientInternal); err == nil {
+		t.Errorf("Expected no message, got %+v", msg)
+	} else if err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+
+	room.setSessionInCall(virtualSession)
+	data := "to-call"
+	if err := client.SendMessage(recipient, data); err != nil {
+		t.Fatal(err)
+	}
+
+	var payload string
+	if msg, err := runUntilClientMessageIgnoringEvents(ctx, clientInternal); err != nil {
+		t.Error(err)
+	} else if err := checkMessageType(msg, "message"); err != nil {
+		t.Error(err)
+	} else if err := json.Unmarshal(*msg.Message.Data, &payload); err != nil {
+		t.Error(err)
+	} else if payload != data {
+		t.Errorf("Expected payload %s, got %s", data, payload)
+	}
+}
+
+func TestClientRoster(t *testing.T) {
+	hub1, hub2, server1, server2, shutdown := CreateClusteredHubsForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server1, hub1)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server2, hub2)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Requesting the roster is only possible in a room.
+	if err := client1.WriteJSON(&ClientMessage{
+		Id:   "abcd",
+		Type: "roster",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(msg, "not_in_room"); err != nil {
+		t.Error(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+	if err := client2.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+
+	session2 := hub2.GetSessionByPublicId(hello2.Hello.SessionId)
+	if session2 == nil {
+		t.Fatalf("Session %s does not exist", hello2.Hello.SessionId)
+	}
+	room2 := hub2.getRoom(roomId)
+	if room2 == nil {
+		t.Fatalf("Could not find room %s", roomId)
+	}
+	room2.setSessionInCall(session2)
+
+	if err := client1.WriteJSON(&ClientMessage{
+		Id:   "efgh",
+		Type: "roster",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := client1.RunUntilMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(msg, "roster"); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.Id != "efgh" {
+		t.Errorf("Expected message id efgh, got %s", msg.Id)
+	}
+	if msg.Roster.RoomId != roomId {
+		t.Errorf("Expected room %s, got %s", roomId, msg.Roster.RoomId)
+	}
+	if len(msg.Roster.Sessions) != 2 {
+		t.Fatalf("Expected two sessions, got %+v", msg.Roster.Sessions)
+	}
+
+	expected := map[string]*RosterSessionEntry{
+		hello1.Hello.SessionId: {
+			SessionId: hello1.Hello.SessionId,
+			UserId:    hello1.Hello.UserId,
+			InCall:    FlagDisconnected,
+		},
+		hello2.Hello.SessionId: {
+			SessionId: hello2.Hello.SessionId,
+			UserId:    hello2.Hello.UserId,
+			InCall:    FlagInCall,
+		},
+	}
+	for _, entry := range msg.Roster.Sessions {
+		e, found := expected[entry.SessionId]
+		if !found {
+			t.Errorf("Unexpected session %+v", entry)
+			continue
+		}
+
+		if entry.UserId != e.UserId {
+			t.Errorf("Expected user %s for session %s, got %s", e.UserId, entry.SessionId, entry.UserId)
+		}
+		if entry.InCall != e.InCall {
+			t.Errorf("Expected in call flags %d for session %s, got %d", e.InCall, entry.SessionId, entry.InCall)
+		}
+		if entry.Internal || entry.Virtual {
+			t.Errorf("Expected regular session, got %+v", entry)
+		}
+	}
+}
+
+func TestClientRosterSingleServer(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client.RunUntilJoined(ctx, hello.Hello); err != nil {
+		t.Error(err)
+	}
+
+	// No other servers have to be asked for their sessions.
+	start := time.Now()
+	if err := client.WriteJSON(&ClientMessage{
+		Id:   "abcd",
+		Type: "roster",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := client.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(msg, "roster"); err != nil {
+		t.Fatal(err)
+	} else if len(msg.Roster.Sessions) != 1 || msg.Roster.Sessions[0].SessionId != hello.Hello.SessionId {
+		t.Errorf("Expected session %s, got %+v", hello.Hello.SessionId, msg.Roster.Sessions)
+	}
+	if duration := time.Since(start); duration >= rosterTimeout {
+		t.Errorf("Expected roster before the timeout of %s, took %s", rosterTimeout, duration)
+	}
+}
+
+func TestClientPersistentRoomMessage(t *testing.T) {
+	hub1, hub2, server1, server2, shutdown := CreateClusteredHubsForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server1, hub1)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	recipient := MessageClientMessageRecipient{
+		Type: "room",
+	}
+	if err := client1.SendMessage(recipient, "not-persistent"); err != nil {
+		t.Fatal(err)
+	}
+
+	persistent := "persistent"
+	data, err := json.Marshal(persistent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client1.WriteJSON(&ClientMessage{
+		Id:   "abcd",
+		Type: "message",
+		Message: &MessageClientMessage{
+			Recipient:  recipient,
+			Data:       (*json.RawMessage)(&data),
+			Persistent: true,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	room1 := hub1.getRoom(roomId)
+	if room1 == nil {
+		t.Fatalf("Could not find room %s", roomId)
+	}
+	for len(room1.GetHistory()) == 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	// The second client joins on a different server and will receive the
+	// persistent message from the history of the first server.
+	client2 := NewTestClient(t, server2, hub2)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	var joined bool
+	var received bool
+	for !joined || !received {
+		msg, err := client2.RunUntilMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch msg.Type {
+		case "event":
+			if err := client2.checkMessageJoined(msg, hello2.Hello); err != nil {
+				t.Error(err)
+			}
+			joined = true
+		case "message":
+			var payload string
+			if err := checkMessageSender(hub2, msg.Message, "room", hello1.Hello); err != nil {
+				t.Error(err)
+			} else if err := json.Unmarshal(*msg.Message.Data, &payload); err != nil {
+				t.Error(err)
+			} else if payload != persistent {
+				t.Errorf("Expected payload %s, got %s", persistent, payload)
+			}
+			received = true
+		default:
+			t.Errorf("Unexpected message %+v", msg)
+		}
+	}
+
+	ctx2, cancel2 := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel2()
+	if msg, err := client2.RunUntilMessage(ctx2); err == nil {
+		t.Errorf("Expected no message, got %+v", msg)
+	} else if err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+}
+
+func TestClientControlKick(t *testing.T) {
+	hub1, hub2, server1, server2, shutdown := CreateClusteredHubsForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server1, hub1)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server2, hub2)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+	if err := client2.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+
+	recipient := MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}
+	action := &ControlClientMessageAction{
+		Type:        ControlActionKick,
+		BanDuration: 60,
+	}
+
+	// Only moderators may kick other sessions.
+	session2 := hub2.GetSessionByPublicId(hello2.Hello.SessionId).(*ClientSession)
+	session2.SetPermissions([]Permission{})
+	if err := client2.SendControlAction(recipient, action); err != nil {
+		t.Fatal(err)
+	}
+
+	session1 := hub1.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	session1.SetPermissions([]Permission{PERMISSION_MAY_CONTROL})
+	recipient.SessionId = hello2.Hello.SessionId
+	if err := client1.SendControlAction(recipient, action); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(msg, "bye"); err != nil {
+		t.Error(err)
+	} else if msg.Bye.Reason != "kicked" {
+		t.Errorf("Expected reason kicked, got %+v", msg.Bye)
+	} else if msg.Bye.Reconnect == nil || !msg.Bye.Reconnect.Resume {
+		t.Errorf("Expected resumable bye, got %+v", msg.Bye)
+	}
+
+	// The kicked session is not closed but no longer in the room.
+	if session := hub2.GetSessionByPublicId(hello2.Hello.SessionId); session == nil {
+		t.Error("Kicked session should not have been closed")
+	} else if room := session.(*ClientSession).GetRoom(); room != nil {
+		t.Errorf("Kicked session should have left the room, got %s", room.Id())
+	}
+
+	client2 = NewTestClient(t, server2, hub2)
+	defer client2.CloseWithBye()
+	if err := client2.SendHelloResume(hello2.Hello.ResumeId); err != nil {
+		t.Fatal(err)
+	}
+	if hello, err := client2.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	} else if hello.Hello.SessionId != hello2.Hello.SessionId {
+		t.Errorf("Expected session %s, got %+v", hello2.Hello.SessionId, hello.Hello)
+	}
+	if room, err := client2.JoinRoom(ctx, roomId+"-kicked"); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId+"-kicked" {
+		t.Fatalf("Expected room %s, got %s", roomId+"-kicked", room.Room.RoomId)
+	}
+
+	// The user may not join the room again on any server.
+	client3 := NewTestClient(t, server1, hub1)
+	defer client3.CloseWithBye()
+	if err := client3.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client3.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client3.WriteJSON(&ClientMessage{
+		Id:   "ABCD",
+		Type: "room",
+		Room: &RoomClientMessage{
+			RoomId: roomId,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client3.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(msg, "banned"); err != nil {
+		t.Error(err)
+	}
+
+	// Other rooms can still be joined.
+	if room, err := client3.JoinRoom(ctx, roomId+"-other"); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId+"-other" {
+		t.Fatalf("Expected room %s, got %s", roomId+"-other", room.Room.RoomId)
+	}
+}
+
+func TestClientLobby(t *testing.T) {
+	hub1, hub2, server1, server2, shutdown := CreateClusteredHubsForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server1, hub1)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server2, hub2)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client3 := NewTestClient(t, server2, hub2)
+	defer client3.CloseWithBye()
+	if err := client3.SendHello(testDefaultUserId + "3"); err != nil {
+		t.Fatal(err)
+	}
+	hello3, err := client3.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The moderator can join directly.
+	roomId := "test-room-lobby"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	// Other users have to wait in the lobby.
+	for _, client := range []*TestClient{client2, client3} {
+		if err := client.WriteJSON(&ClientMessage{
+			Id:   "ABCD",
+			Type: "room",
+			Room: &RoomClientMessage{
+				RoomId:    roomId,
+				SessionId: roomId + "-" + client.publicId,
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		var event *EventServerMessage
+		if err := checkReceiveClientEvent(ctx, client, "lobby", &event); err != nil {
+			t.Error(err)
+		} else if event.Lobby == nil || event.Lobby.RoomId != roomId || event.Lobby.Status != LobbyStatusWaiting {
+			t.Errorf("Expected waiting in lobby of %s, got %+v", roomId, event)
+		}
+
+		if err := checkReceiveClientEvent(ctx, client1, "joinrequest", &event); err != nil {
+			t.Error(err)
+		} else if event.JoinRequest == nil || event.JoinRequest.SessionId != client.publicId {
+			t.Errorf("Expected join request from %s, got %+v", client.publicId, event)
+		}
+	}
+
+	if session := hub2.GetSessionByPublicId(hello2.Hello.SessionId); session.GetRoom() != nil {
+		t.Errorf("Session %s should not be in a room, got %+v", hello2.Hello.SessionId, session.GetRoom())
+	}
+
+	action := &ControlClientMessageAction{
+		Type: ControlActionApprove,
+	}
+	if err := client1.SendControlAction(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello2.Hello.SessionId,
+	}, action); err != nil {
+		t.Fatal(err)
+	}
+
+	// The join is completed with the original request.
+	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageRoomId(msg, roomId); err != nil {
+		t.Error(err)
+	} else if msg.Id != "ABCD" {
+		t.Errorf("Expected response to message ABCD, got %+v", msg)
+	}
+	if err := client1.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+	if err := client2.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+
+	action.Type = ControlActionDeny
+	if err := client1.SendControlAction(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello3.Hello.SessionId,
+	}, action); err != nil {
+		t.Fatal(err)
+	}
+
+	var event *EventServerMessage
+	if err := checkReceiveClientEvent(ctx, client3, "lobby", &event); err != nil {
+		t.Error(err)
+	} else if event.Lobby == nil || event.Lobby.RoomId != roomId || event.Lobby.Status != LobbyStatusDenied {
+		t.Errorf("Expected denied for lobby of %s, got %+v", roomId, event)
+	}
+	if session := hub2.GetSessionByPublicId(hello3.Hello.SessionId); session.GetRoom() != nil {
+		t.Errorf("Session %s should not be in a room, got %+v", hello3.Hello.SessionId, session.GetRoom())
+	}
+	// The backend is notified that the denied session left the room.
+	if err := waitForLobbyLeaveRequest(ctx, roomId+"-"+client3.publicId); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientLobbyModeratorJoinsLater(t *testing.T) {
+	// Both servers must accept the backend of the session.
+	hub1, hub2, server1, server2, shutdown := CreateClusteredHubsForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("backend", "allowall", "true")
+		return config, nil
+	})
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client2 := NewTestClient(t, server2, hub2)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room-lobby"
+	if err := client2.WriteJSON(&ClientMessage{
+		Id:   "ABCD",
+		Type: "room",
+		Room: &RoomClientMessage{
+			RoomId:    roomId,
+			SessionId: roomId + "-" + client2.publicId,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var event *EventServerMessage
+	if err := checkReceiveClientEvent(ctx, client2, "lobby", &event); err != nil {
+		t.Error(err)
+	} else if event.Lobby == nil || event.Lobby.RoomId != roomId || event.Lobby.Status != LobbyStatusWaiting {
+		t.Errorf("Expected waiting in lobby of %s, got %+v", roomId, event)
+	}
+
+	// The waiting session is resumed on the other server.
+	client2.Close()
+	if err := client2.WaitForClientRemoved(ctx); err != nil {
+		t.Error(err)
+	}
+
+	client3 := NewTestClient(t, server1, hub1)
+	defer client3.CloseWithBye()
+	if err := client3.SendHelloResume(hello2.Hello.ResumeId); err != nil {
+		t.Fatal(err)
+	}
+	if hello3, err := client3.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	} else if hello3.Hello.SessionId != hello2.Hello.SessionId {
+		t.Errorf("Expected session id %s, got %+v", hello2.Hello.SessionId, hello3.Hello)
+	}
+
+	// Moderators joining later receive the pending join requests.
+	client1 := NewTestClient(t, server2, hub2)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	if err := checkReceiveClientEvent(ctx, client1, "joinrequest", &event); err != nil {
+		t.Error(err)
+	} else if event.JoinRequest == nil || event.JoinRequest.SessionId != hello2.Hello.SessionId {
+		t.Errorf("Expected join request from %s, got %+v", hello2.Hello.SessionId, event)
+	} else if event.JoinRequest.RoomSessionId != roomId+"-"+client2.publicId {
+		t.Errorf("Expected room session id %s, got %+v", roomId+"-"+client2.publicId, event)
+	}
+
+	if err := client1.SendControlAction(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello2.Hello.SessionId,
+	}, &ControlClientMessageAction{
+		Type: ControlActionApprove,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The join is completed with the original request.
+	if msg, err := client3.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageRoomId(msg, roomId); err != nil {
+		t.Error(err)
+	} else if msg.Id != "ABCD" {
+		t.Errorf("Expected response to message ABCD, got %+v", msg)
+	}
+	if err := client1.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+}
+
+func waitForRemoteCounts(ctx context.Context, room *Room, sessions int, publishers int) error {
+	for {
+		room.mu.Lock()
+		s, p := room.countRemoteLocked(time.Now())
+		room.mu.Unlock()
+		if s == sessions && p == publishers {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Expected %d sessions and %d publishers, got %d and %d", sessions, publishers, s, p)
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestClientRoomLimits(t *testing.T) {
+	hub1, hub2, server1, server2, shutdown := CreateClusteredHubsForTest(t)
+	defer shutdown()
+
+	for _, hub := range []*Hub{hub1, hub2} {
+		mcu, err := NewTestMCU()
+		if err != nil {
+			t.Fatal(err)
+		} else if err := mcu.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer mcu.Stop()
+
+		hub.SetMcu(mcu)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server1, hub1)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server2, hub2)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client3 := NewTestClient(t, server1, hub1)
+	defer client3.CloseWithBye()
+	if err := client3.SendHello(testDefaultUserId + "3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client3.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room-limits"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
 	}
-	if err := checkReceiveClientMessage(ctx, client2b, "user", hello1.Hello, &payload); err != nil {
+	if err := client2.RunUntilJoined(ctx, hello2.Hello); err != nil {
 		t.Error(err)
-	} else if payload != data1 {
-		t.Errorf("Expected payload %s, got %s", data1, payload)
 	}
-}
 
-func WaitForUsersJoined(ctx context.Context, t *testing.T, client1 *TestClient, hello1 *ServerMessage, client2 *TestClient, hello2 *ServerMessage) {
-	// We will receive "joined" events for all clients. The ordering is not
-	// defined as messages are processed and sent by asynchronous NATS handlers.
-	msg1_1, err := client1.RunUntilMessage(ctx)
-	if err != nil {
-		t.Error(err)
+	room1 := hub1.getRoom(roomId)
+	if room1 == nil {
+		t.Fatalf("Could not find room %s", roomId)
 	}
-	msg1_2, err := client1.RunUntilMessage(ctx)
-	if err != nil {
+	if err := waitForRemoteCounts(ctx, room1, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// The room is full, the session on the other server is counted.
+	if err := client3.WriteJSON(&ClientMessage{
+		Id:   "ABCD",
+		Type: "room",
+		Room: &RoomClientMessage{
+			RoomId:    roomId,
+			SessionId: roomId + "-" + client3.publicId,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client3.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageRoomId(msg, roomId); err != nil {
 		t.Error(err)
 	}
-	msg2_1, err := client2.RunUntilMessage(ctx)
-	if err != nil {
+	if msg, err := client3.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(msg, "room_full"); err != nil {
 		t.Error(err)
 	}
-	msg2_2, err := client2.RunUntilMessage(ctx)
-	if err != nil {
+	if msg, err := client3.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageRoomId(msg, ""); err != nil {
 		t.Error(err)
 	}
 
-	if err := client1.checkMessageJoined(msg1_1, hello1.Hello); err != nil {
-		// Ordering is "joined" from client 2, then from client 1
-		if err := client1.checkMessageJoined(msg1_1, hello2.Hello); err != nil {
-			t.Error(err)
-		}
-		if err := client1.checkMessageJoined(msg1_2, hello1.Hello); err != nil {
-			t.Error(err)
-		}
-	} else {
-		// Ordering is "joined" from client 1, then from client 2
-		if err := client1.checkMessageJoined(msg1_2, hello2.Hello); err != nil {
-			t.Error(err)
-		}
+	session1 := hub1.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	session1.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_AUDIO, PERMISSION_MAY_PUBLISH_VIDEO})
+	session2 := hub2.GetSessionByPublicId(hello2.Hello.SessionId).(*ClientSession)
+	session2.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_AUDIO, PERMISSION_MAY_PUBLISH_VIDEO})
+
+	if err := client2.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello2.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "offer",
+		Sid:      "54321",
+		RoomType: "video",
+		Payload: map[string]interface{}{
+			"sdp": MockSdpOfferAudioAndVideo,
+		},
+	}); err != nil {
+		t.Fatal(err)
 	}
-	if err := client2.checkMessageJoined(msg2_1, hello1.Hello); err != nil {
-		// Ordering is "joined" from client 2, then from client 1
-		if err := client2.checkMessageJoined(msg2_1, hello2.Hello); err != nil {
-			t.Error(err)
-		}
-		if err := client2.checkMessageJoined(msg2_2, hello1.Hello); err != nil {
-			t.Error(err)
-		}
-	} else {
-		// Ordering is "joined" from client 1, then from client 2
-		if err := client2.checkMessageJoined(msg2_2, hello2.Hello); err != nil {
-			t.Error(err)
-		}
+	if err := client2.RunUntilAnswer(ctx, MockSdpAnswerAudioAndVideo); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := waitForRemoteCounts(ctx, room1, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only one session may publish at the same time.
+	if err := client1.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "offer",
+		Sid:      "12345",
+		RoomType: "video",
+		Payload: map[string]interface{}{
+			"sdp": MockSdpOfferAudioAndVideo,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(msg, "too_many_publishers"); err != nil {
+		t.Error(err)
 	}
 }
 
-func TestClientMessageToRoom(t *testing.T) {
-	hub, _, _, server, shutdown := CreateHubForTest(t)
+func TestClientRoomNoLimits(t *testing.T) {
+	hub1, hub2, server1, server2, shutdown := CreateClusteredHubsForTest(t)
 	defer shutdown()
 
 	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
 	defer cancel()
 
-	client1 := NewTestClient(t, server, hub)
+	client1 := NewTestClient(t, server1, hub1)
 	defer client1.CloseWithBye()
 	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
 		t.Fatal(err)
@@ -1568,7 +3799,7 @@ func TestClientMessageToRoom(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	client2 := NewTestClient(t, server, hub)
+	client2 := NewTestClient(t, server2, hub2)
 	defer client2.CloseWithBye()
 	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
 		t.Fatal(err)
@@ -1578,51 +3809,54 @@ func TestClientMessageToRoom(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if hello1.Hello.SessionId == hello2.Hello.SessionId {
-		t.Fatalf("Expected different session ids, got %s twice", hello1.Hello.SessionId)
-	} else if hello1.Hello.UserId == hello2.Hello.UserId {
-		t.Fatalf("Expected different user ids, got %s twice", hello1.Hello.UserId)
-	}
-
-	// Join room by id.
 	roomId := "test-room"
 	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
 		t.Fatal(err)
 	} else if room.Room.RoomId != roomId {
 		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
 	}
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
 
-	// Give message processing some time.
-	time.Sleep(10 * time.Millisecond)
+	room1 := hub1.getRoom(roomId)
+	if room1 == nil {
+		t.Fatalf("Could not find room %s", roomId)
+	}
+	receiver := make(chan *nats.Msg, 16)
+	subscription, err := hub1.nats.Subscribe(GetSubjectForBackendRoomId(roomId, room1.Backend()), receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Unsubscribe() // nolint
 
 	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
 		t.Fatal(err)
 	} else if room.Room.RoomId != roomId {
 		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
 	}
-
-	WaitForUsersJoined(ctx, t, client1, hello1, client2, hello2)
-
-	recipient := MessageClientMessageRecipient{
-		Type: "room",
+	if err := client1.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
 	}
-
-	data1 := "from-1-to-2"
-	client1.SendMessage(recipient, data1) // nolint
-	data2 := "from-2-to-1"
-	client2.SendMessage(recipient, data2) // nolint
-
-	var payload string
-	if err := checkReceiveClientMessage(ctx, client1, "room", hello2.Hello, &payload); err != nil {
+	if err := client2.RunUntilJoined(ctx, hello2.Hello); err != nil {
 		t.Error(err)
-	} else if payload != data2 {
-		t.Errorf("Expected payload %s, got %s", data2, payload)
 	}
 
-	if err := checkReceiveClientMessage(ctx, client2, "room", hello1.Hello, &payload); err != nil {
-		t.Error(err)
-	} else if payload != data1 {
-		t.Errorf("Expected payload %s, got %s", data1, payload)
+	// Counts are not exchanged if the room has no limits.
+	timer := time.NewTimer(100 * time.Millisecond)
+	defer timer.Stop()
+	for {
+		select {
+		case message := <-receiver:
+			var msg NatsMessage
+			if err := hub1.nats.Decode(message, &msg); err != nil {
+				t.Error(err)
+			} else if msg.Type == "counts" {
+				t.Errorf("Expected no counts, got %+v", msg.Counts)
+			}
+		case <-timer.C:
+			return
+		}
 	}
 }
 
@@ -2456,6 +4690,126 @@ func TestClientSendOfferPermissions(t *testing.T) {
 	}
 }
 
+func TestClientSendOfferPermissionsCluster(t *testing.T) {
+	hub1, hub2, server1, server2, shutdown := CreateClusteredHubsForTest(t)
+	defer shutdown()
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub1.SetMcu(mcu)
+	hub2.SetMcu(mcu)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server1, hub1)
+	defer client1.CloseWithBye()
+
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server2, hub2)
+	defer client2.CloseWithBye()
+
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session1 := hub1.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	if session1 == nil {
+		t.Fatalf("Session %s does not exist", hello1.Hello.SessionId)
+	}
+	session2 := hub2.GetSessionByPublicId(hello2.Hello.SessionId).(*ClientSession)
+	if session2 == nil {
+		t.Fatalf("Session %s does not exist", hello2.Hello.SessionId)
+	}
+
+	// The sessions are on different hubs, so must not be found on the other one.
+	if session := hub1.GetSessionByPublicId(hello2.Hello.SessionId); session != nil {
+		t.Errorf("Session %s should not exist on first hub, got %+v", hello2.Hello.SessionId, session)
+	}
+	if session := hub2.GetSessionByPublicId(hello1.Hello.SessionId); session != nil {
+		t.Errorf("Session %s should not exist on second hub, got %+v", hello1.Hello.SessionId, session)
+	}
+
+	// Client 1 is the moderator
+	session1.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_MEDIA, PERMISSION_MAY_PUBLISH_SCREEN})
+	// Client 2 is a guest participant.
+	session2.SetPermissions([]Permission{})
+
+	// Client 2 may not send an offer (he doesn't have the necessary permissions).
+	if err := client2.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "sendoffer",
+		Sid:      "12345",
+		RoomType: "screen",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else {
+		if err := checkMessageError(msg, "not_allowed"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Client 1 may send an offer.
+	if err := client1.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello2.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "sendoffer",
+		Sid:      "54321",
+		RoomType: "screen",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The test MCU doesn't support clients yet, so an error will be returned
+	// from the remote hub to the client trying to send the offer.
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else {
+		if err := checkMessageError(msg, "client_not_found"); err != nil {
+			t.Fatal(err)
+		} else if msg.Id != "abcd" {
+			t.Errorf("Expected error for message \"abcd\", got %+v", msg)
+		}
+	}
+
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel2()
+
+	if msg, err := client2.RunUntilMessage(ctx2); err != nil {
+		if err != context.DeadlineExceeded {
+			t.Fatal(err)
+		}
+	} else {
+		t.Errorf("Expected no payload, got %+v", msg)
+	}
+}
+
 func TestClientSendOfferPermissionsAudioOnly(t *testing.T) {
 	hub, _, _, server, shutdown := CreateHubForTest(t)
 	defer shutdown()
@@ -2675,6 +5029,32 @@ loop:
 		// Give some time to async processing.
 		time.Sleep(time.Millisecond)
 	}
+
+	// The client is notified about the revoked media (after the participants
+	// update from the backend).
+	for {
+		msg, err := client1.RunUntilMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := checkMessageType(msg, "event"); err != nil {
+			t.Fatal(err)
+		} else if msg.Event.Type != "revoked" {
+			continue
+		}
+
+		if msg.Event.Target != "participants" {
+			t.Errorf("Expected target participants, got %+v", msg.Event)
+		}
+		if revoked := msg.Event.Revoked; revoked == nil {
+			t.Errorf("Expected revoked details, got %+v", msg.Event)
+		} else if revoked.RoomId != roomId ||
+			revoked.SessionId != hello1.Hello.SessionId ||
+			revoked.StreamType != streamTypeVideo ||
+			!reflect.DeepEqual(revoked.Media, []string{"video"}) {
+			t.Errorf("Unexpected revoked details %+v", revoked)
+		}
+		break
+	}
 }
 
 func TestClientSendOfferPermissionsAudioVideoMedia(t *testing.T) {
@@ -0,0 +1,252 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2021 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const (
+	// Subject where all servers receive requests to send the pending join
+	// requests of a room to a moderator.
+	lobbySubject = "hub.lobby"
+)
+
+type lobbyEntry struct {
+	// The original "room" request and backend response, used to complete the
+	// join once the session was approved.
+	message *ClientMessage
+	room    *BackendClientResponse
+}
+
+func newLobbyJoinRequest(session *ClientSession, entry *lobbyEntry) *ServerMessage {
+	return &ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "room",
+			Type:   "joinrequest",
+			JoinRequest: &EventServerMessageSessionEntry{
+				SessionId:     session.PublicId(),
+				UserId:        session.UserId(),
+				User:          session.UserData(),
+				RoomSessionId: entry.message.Room.SessionId,
+			},
+		},
+	}
+}
+
+func (h *Hub) storeLobbySessionLocked(session *ClientSession, entry *lobbyEntry) {
+	internalRoomId := getRoomIdForBackend(entry.room.Room.RoomId, session.Backend())
+	h.removeLobbySessionLocked(session)
+	entries, found := h.lobby[internalRoomId]
+	if !found {
+		entries = make(map[*ClientSession]*lobbyEntry)
+		h.lobby[internalRoomId] = entries
+	}
+	entries[session] = entry
+	if client := session.GetClient(); client != nil {
+		// Don't expire anonymous clients while they are waiting.
+		delete(h.anonymousClients, client)
+	}
+}
+
+func (h *Hub) addLobbySession(session *ClientSession, message *ClientMessage, room *BackendClientResponse) {
+	roomId := room.Room.RoomId
+	entry := &lobbyEntry{
+		message: message,
+		room:    room,
+	}
+	h.mu.Lock()
+	h.storeLobbySessionLocked(session, entry)
+	h.mu.Unlock()
+
+	log.Printf("Session %s is waiting in the lobby of room %s", session.PublicId(), roomId)
+	session.SendMessage(&ServerMessage{
+		Id:   message.Id,
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "room",
+			Type:   "lobby",
+			Lobby: &EventServerMessageLobby{
+				RoomId: roomId,
+				Status: LobbyStatusWaiting,
+			},
+		},
+	})
+
+	// Notify the moderators in the room on all servers.
+	request := newLobbyJoinRequest(session, entry)
+	if err := h.nats.PublishMessage(GetSubjectForRoomId(roomId, session.Backend()), request); err != nil {
+		log.Printf("Could not publish join request of %s for room %s: %s", session.PublicId(), roomId, err)
+	}
+}
+
+// restoreLobbySession continues waiting in the lobby for a session that was
+// handed over from a different server. The moderators already received the
+// join request.
+func (h *Hub) restoreLobbySession(session *ClientSession, state *SessionHandoverLobbyState) {
+	if state.Message == nil || state.Message.Room == nil || state.Room == nil || state.Room.Room == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.storeLobbySessionLocked(session, &lobbyEntry{
+		message: state.Message,
+		room:    state.Room,
+	})
+}
+
+// requestLobbyJoinRequests asks all servers to send the pending join requests
+// of the room to a moderator that just joined.
+func (h *Hub) requestLobbyJoinRequests(room *Room, session *ClientSession) {
+	if err := h.nats.PublishNats(lobbySubject, &NatsMessage{
+		SendTime: time.Now(),
+		Type:     "lobbyrequests",
+		LobbyRequests: &NatsLobbyRequestsMessage{
+			RoomId:    getRoomIdForBackend(room.Id(), room.Backend()),
+			SessionId: session.PublicId(),
+		},
+	}); err != nil {
+		log.Printf("Error requesting lobby join requests of room %s for %s: %s", room.Id(), session.PublicId(), err)
+	}
+}
+
+func (h *Hub) processLobbyJoinRequests(request *NatsLobbyRequestsMessage) {
+	var requests []*ServerMessage
+	h.mu.RLock()
+	for session, entry := range h.lobby[request.RoomId] {
+		requests = append(requests, newLobbyJoinRequest(session, entry))
+	}
+	h.mu.RUnlock()
+
+	// Only moderators will receive the join requests.
+	subject := "session." + request.SessionId
+	for _, message := range requests {
+		if err := h.nats.PublishMessage(subject, message); err != nil {
+			log.Printf("Could not publish join request to %s: %s", request.SessionId, err)
+		}
+	}
+}
+
+func (h *Hub) removeLobbySession(session *ClientSession) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeLobbySessionLocked(session)
+}
+
+func (h *Hub) removeLobbySessionLocked(session *ClientSession) *lobbyEntry {
+	for roomId, entries := range h.lobby {
+		if entry, found := entries[session]; found {
+			delete(entries, session)
+			if len(entries) == 0 {
+				delete(h.lobby, roomId)
+			}
+			return entry
+		}
+	}
+	return nil
+}
+
+func (h *Hub) processLobbyAction(session *ClientSession, room *Room, msg *ControlClientMessage, approved bool) {
+	data := h.decodeSessionId(msg.Recipient.SessionId, publicSessionName)
+	if data == nil || data.BackendId != session.Backend().Id() {
+		log.Printf("Ignore lobby decision for unknown session %s from %s", msg.Recipient.SessionId, session.PublicId())
+		return
+	}
+
+	subject := "session." + msg.Recipient.SessionId
+	if err := h.nats.PublishNats(subject, &NatsMessage{
+		SendTime: time.Now(),
+		Type:     "lobby",
+		Lobby: &NatsLobbyMessage{
+			RoomId:    room.Id(),
+			SessionId: session.PublicId(),
+			Approved:  approved,
+		},
+	}); err != nil {
+		log.Printf("Error publishing lobby decision to %s: %s", subject, err)
+	}
+}
+
+func (h *Hub) processLobbyDecision(session *ClientSession, decision *NatsLobbyMessage) {
+	internalRoomId := getRoomIdForBackend(decision.RoomId, session.Backend())
+	h.mu.Lock()
+	entry, found := h.lobby[internalRoomId][session]
+	if found {
+		h.removeLobbySessionLocked(session)
+	}
+	h.mu.Unlock()
+	if !found {
+		// Session is no longer waiting for this room.
+		return
+	}
+
+	if !decision.Approved {
+		log.Printf("Session %s was denied to join room %s by %s", session.PublicId(), decision.RoomId, decision.SessionId)
+		// The backend already processed the "join" request.
+		h.notifyLobbySessionLeft(session, entry)
+		session.SendMessage(&ServerMessage{
+			Type: "event",
+			Event: &EventServerMessage{
+				Target: "room",
+				Type:   "lobby",
+				Lobby: &EventServerMessageLobby{
+					RoomId: decision.RoomId,
+					Status: LobbyStatusDenied,
+				},
+			},
+		})
+		if client := session.GetClient(); client != nil && session.UserId() == "" && session.ClientType() != HelloClientTypeInternal {
+			h.startWaitAnonymousClientRoom(client)
+		}
+		return
+	}
+
+	log.Printf("Session %s was approved to join room %s by %s", session.PublicId(), decision.RoomId, decision.SessionId)
+	// The backend already allowed joining, so no need to ask it again.
+	entry.room.Room.Waiting = false
+	h.processJoinRoom(session, entry.message, entry.room)
+}
+
+func (h *Hub) notifyLobbySessionLeft(session *ClientSession, entry *lobbyEntry) {
+	roomId := entry.room.Room.RoomId
+	sessionId := entry.message.Room.SessionId
+	if sessionId == "" {
+		sessionId = session.PublicId()
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), h.backendTimeout)
+		defer cancel()
+
+		request := NewBackendClientRoomRequest(roomId, session.UserId(), sessionId)
+		request.Room.Action = "leave"
+		var response map[string]interface{}
+		if err := h.backend.PerformJSONRequest(ctx, session.ParsedBackendUrl(), request, &response); err != nil {
+			log.Printf("Could not notify about room session %s left lobby of room %s: %s", sessionId, roomId, err)
+		} else {
+			log.Printf("Removed room session %s from lobby: %+v", sessionId, response)
+		}
+	}()
+}
@@ -55,6 +55,8 @@ type McuListener interface {
 
 	PublisherClosed(publisher McuPublisher)
 	SubscriberClosed(subscriber McuSubscriber)
+
+	PublisherTalking(publisher McuPublisher, talking bool)
 }
 
 type McuInitiator interface {
@@ -88,6 +90,10 @@ type McuPublisher interface {
 	McuClient
 
 	HasMedia(MediaType) bool
+
+	// SetRecording starts or stops recording the publisher to the given
+	// filename (without extension).
+	SetRecording(ctx context.Context, recording bool, filename string) error
 }
 
 type McuSubscriber interface {
@@ -140,6 +140,7 @@ type mcuJanus struct {
 	maxStreamBitrate int
 	maxScreenBitrate int
 	mcuTimeout       time.Duration
+	recordingDir     string
 
 	gw      *JanusGateway
 	session *JanusSession
@@ -179,12 +180,14 @@ func NewMcuJanus(url string, config *goconf.ConfigFile) (Mcu, error) {
 		mcuTimeoutSeconds = defaultMcuTimeoutSeconds
 	}
 	mcuTimeout := time.Duration(mcuTimeoutSeconds) * time.Second
+	recordingDir, _ := config.GetString("mcu", "recordingdir")
 
 	mcu := &mcuJanus{
 		url:              url,
 		maxStreamBitrate: maxStreamBitrate,
 		maxScreenBitrate: maxScreenBitrate,
 		mcuTimeout:       mcuTimeout,
+		recordingDir:     recordingDir,
 		closeChan:        make(chan bool, 1),
 		clients:          make(map[clientInterface]bool),
 
@@ -310,6 +313,9 @@ func (m *mcuJanus) Start() error {
 	}
 	log.Printf("Maximum bandwidth %d bits/sec per publishing stream", m.maxStreamBitrate)
 	log.Printf("Maximum bandwidth %d bits/sec per screensharing stream", m.maxScreenBitrate)
+	if m.recordingDir != "" {
+		log.Printf("Storing recordings in %s", m.recordingDir)
+	}
 
 	if m.session, err = m.gw.Create(ctx); err != nil {
 		m.disconnect()
@@ -734,6 +740,13 @@ func (m *mcuJanus) getOrCreatePublisherHandle(ctx context.Context, id string, st
 		// orientation changes in Firefox.
 		"videoorient_ext": false,
 	}
+	if streamType == streamTypeVideo {
+		// Let Janus detect if the publisher is talking.
+		create_msg["audiolevel_event"] = true
+	}
+	if m.recordingDir != "" {
+		create_msg["rec_dir"] = m.recordingDir
+	}
 	var maxBitrate int
 	if streamType == streamTypeScreen {
 		maxBitrate = m.maxScreenBitrate
@@ -839,6 +852,10 @@ func (p *mcuJanusPublisher) handleEvent(event *janus.EventMsg) {
 			go p.Close(ctx)
 		case "slow_link":
 			// Ignore, processed through "handleSlowLink" in the general events.
+		case "talking":
+			p.listener.PublisherTalking(p, true)
+		case "stopped-talking":
+			p.listener.PublisherTalking(p, false)
 		default:
 			log.Printf("Unsupported videoroom publisher event in %d: %+v", p.handleId, event)
 		}
@@ -884,6 +901,23 @@ func (p *mcuJanusPublisher) HasMedia(mt MediaType) bool {
 	return (p.mediaTypes & mt) == mt
 }
 
+func (p *mcuJanusPublisher) SetRecording(ctx context.Context, recording bool, filename string) error {
+	handle := p.handle
+	if handle == nil {
+		return ErrNotConnected
+	}
+
+	configure_msg := map[string]interface{}{
+		"request": "configure",
+		"record":  recording,
+	}
+	if recording && filename != "" {
+		configure_msg["filename"] = filename
+	}
+	_, err := handle.Message(ctx, configure_msg, nil)
+	return err
+}
+
 func (p *mcuJanusPublisher) NotifyReconnected() {
 	ctx := context.TODO()
 	handle, session, roomId, err := p.mcu.getOrCreatePublisherHandle(ctx, p.id, p.streamType, p.bitrate)
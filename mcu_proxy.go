@@ -162,6 +162,24 @@ func (p *mcuProxyPublisher) Close(ctx context.Context) {
 	log.Printf("Delete publisher %s at %s", p.proxyId, p.conn.url)
 }
 
+func (p *mcuProxyPublisher) SetRecording(ctx context.Context, recording bool, filename string) error {
+	msg := &ProxyClientMessage{
+		Type: "command",
+		Command: &CommandProxyClientMessage{
+			Type:      "set-recording",
+			ClientId:  p.proxyId,
+			Recording: recording,
+			Filename:  filename,
+		},
+	}
+
+	if _, err := p.conn.performSyncRequest(ctx, msg); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (p *mcuProxyPublisher) SendMessage(ctx context.Context, message *MessageClientMessage, data *MessageClientMessageData, callback func(error, map[string]interface{})) {
 	msg := &ProxyClientMessage{
 		Type: "payload",
@@ -185,6 +203,13 @@ func (p *mcuProxyPublisher) ProcessEvent(msg *EventProxyServerMessage) {
 		p.listener.OnIceCompleted(p)
 	case "publisher-closed":
 		p.NotifyClosed()
+	case "talking":
+		if msg.Talking == nil {
+			log.Printf("Received talking event without payload from %s: %+v", p.conn.url, msg)
+			return
+		}
+
+		p.listener.PublisherTalking(p, msg.Talking.Talking)
 	default:
 		log.Printf("Unsupported event from %s: %+v", p.conn.url, msg)
 	}
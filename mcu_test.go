@@ -147,12 +147,34 @@ type TestMCUPublisher struct {
 
 	mediaTypes MediaType
 	bitrate    int
+
+	mu                sync.Mutex
+	recording         bool
+	recordingFilename string
 }
 
 func (p *TestMCUPublisher) HasMedia(mt MediaType) bool {
 	return (p.mediaTypes & mt) == mt
 }
 
+func (p *TestMCUPublisher) SetRecording(ctx context.Context, recording bool, filename string) error {
+	if p.isClosed() {
+		return fmt.Errorf("Already closed")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.recording = recording
+	p.recordingFilename = filename
+	return nil
+}
+
+func (p *TestMCUPublisher) IsRecording() (bool, string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.recording, p.recordingFilename
+}
+
 func (p *TestMCUPublisher) SendMessage(ctx context.Context, message *MessageClientMessage, data *MessageClientMessageData, callback func(error, map[string]interface{})) {
 	go func() {
 		if p.isClosed() {
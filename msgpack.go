@@ -0,0 +1,118 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2021 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Messages are encoded as MessagePack using the field names of the "json"
+// struct tags. Raw JSON payloads (e.g. the data of "message" requests) are
+// stored as native MessagePack values.
+
+var (
+	ErrMessagePackTrailingData = errors.New("data after MessagePack value")
+)
+
+func init() {
+	msgpack.Register(json.RawMessage{}, encodeMessagePackRawMessage, decodeMessagePackRawMessage)
+	msgpack.Register(json.Number(""), encodeMessagePackNumber, nil)
+}
+
+func encodeMessagePackRawMessage(e *msgpack.Encoder, v reflect.Value) error {
+	data := v.Bytes()
+	if len(data) == 0 {
+		return e.EncodeNil()
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return err
+	}
+	return e.Encode(value)
+}
+
+func decodeMessagePackRawMessage(d *msgpack.Decoder, v reflect.Value) error {
+	value, err := d.DecodeInterface()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	v.SetBytes(data)
+	return nil
+}
+
+func encodeMessagePackNumber(e *msgpack.Encoder, v reflect.Value) error {
+	n := json.Number(v.String())
+	if i, err := n.Int64(); err == nil {
+		return e.EncodeInt(i)
+	} else if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		return e.EncodeUint(u)
+	}
+
+	f, err := n.Float64()
+	if err != nil {
+		return err
+	}
+	return e.EncodeFloat64(f)
+}
+
+// encodeMessagePack writes the MessagePack encoding of v to w.
+func encodeMessagePack(w io.Writer, v interface{}) error {
+	encoder := msgpack.GetEncoder()
+	defer msgpack.PutEncoder(encoder)
+
+	encoder.Reset(w)
+	encoder.SetCustomStructTag("json")
+	encoder.UseCompactInts(true)
+	return encoder.Encode(v)
+}
+
+// decodeMessagePack decodes the MessagePack encoded data into v.
+func decodeMessagePack(data []byte, v interface{}) error {
+	decoder := msgpack.GetDecoder()
+	defer msgpack.PutDecoder(decoder)
+
+	decoder.Reset(bytes.NewReader(data))
+	decoder.SetCustomStructTag("json")
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+
+	if _, err := decoder.PeekCode(); err != io.EOF {
+		return ErrMessagePackTrailingData
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2021 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestMessagePackRawMessage(t *testing.T) {
+	testcases := map[string]string{
+		"null":                 "c0",
+		"true":                 "c3",
+		"0":                    "00",
+		"128":                  "cc80",
+		"-33":                  "d0df",
+		"18446744073709551615": "cfffffffffffffffff",
+		"1.5":                  "cb3ff8000000000000",
+		"\"abc\"":              "a3616263",
+		"[1,\"a\"]":            "9201a161",
+		"{\"a\":1}":            "81a16101",
+	}
+	for input, expected := range testcases {
+		raw := json.RawMessage(input)
+		var encoded bytes.Buffer
+		if err := encodeMessagePack(&encoded, &raw); err != nil {
+			t.Errorf("Could not encode %s: %s", input, err)
+			continue
+		} else if hex.EncodeToString(encoded.Bytes()) != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, input, hex.EncodeToString(encoded.Bytes()))
+			continue
+		}
+
+		var decoded json.RawMessage
+		if err := decodeMessagePack(encoded.Bytes(), &decoded); err != nil {
+			t.Errorf("Could not decode %s: %s", expected, err)
+		} else if string(decoded) != input {
+			t.Errorf("Expected %s, got %s", input, string(decoded))
+		}
+	}
+}
+
+func TestMessagePackClientMessage(t *testing.T) {
+	data := json.RawMessage(`{"type":"offer","payload":{"sdp":"v=0","count":2,"float":0.25}}`)
+	message := &ClientMessage{
+		Id:   "abcd",
+		Type: "message",
+		Message: &MessageClientMessage{
+			Recipient: MessageClientMessageRecipient{
+				Type:      "session",
+				SessionId: "the-session",
+			},
+			Data: &data,
+		},
+	}
+
+	var encoded bytes.Buffer
+	if err := encodeMessagePack(&encoded, message); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fields are encoded with the names from the "json" struct tags and
+	// empty fields are omitted.
+	var value map[string]interface{}
+	if err := decodeMessagePack(encoded.Bytes(), &value); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := value["Message"]; found {
+		t.Errorf("Expected json field names, got %+v", value)
+	} else if _, found := value["hello"]; found {
+		t.Errorf("Expected empty fields to be omitted, got %+v", value)
+	} else if m, ok := value["message"].(map[string]interface{}); !ok {
+		t.Errorf("Expected message in %+v", value)
+	} else if d, ok := m["data"].(map[string]interface{}); !ok {
+		t.Errorf("Expected data to be encoded as map, got %+v", m["data"])
+	} else if d["type"] != "offer" {
+		t.Errorf("Expected offer, got %+v", d)
+	}
+
+	var decoded ClientMessage
+	if err := decodeMessagePack(encoded.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Id != message.Id || decoded.Type != message.Type || decoded.Message == nil ||
+		!reflect.DeepEqual(decoded.Message.Recipient, message.Message.Recipient) {
+		t.Fatalf("Expected %+v, got %+v", message, decoded)
+	}
+
+	var expected, received interface{}
+	if err := json.Unmarshal(data, &expected); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(*decoded.Message.Data, &received); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expected, received) {
+		t.Errorf("Expected data %+v, got %+v", expected, received)
+	}
+}
+
+func TestMessagePackDecodeInvalid(t *testing.T) {
+	testcases := []string{
+		"",
+		// Truncated string.
+		"a361",
+		// Map with non-string key.
+		"810101",
+		// Data after value.
+		"80c0",
+		// Invalid value for string field.
+		"81a46964c3",
+	}
+	for _, input := range testcases {
+		data, err := hex.DecodeString(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var message ClientMessage
+		if err := decodeMessagePack(data, &message); err == nil {
+			t.Errorf("Decoding %s should have failed, got %+v", input, message)
+		}
+	}
+}
@@ -48,9 +48,220 @@ type NatsMessage struct {
 
 	Permissions []Permission `json:"permissions,omitempty"`
 
+	SendOffer *NatsSendOfferMessage `json:"sendoffer,omitempty"`
+
+	TransientData *NatsTransientDataMessage `json:"transient,omitempty"`
+
+	Broadcast *NatsBroadcastMessage `json:"broadcast,omitempty"`
+
+	Handover *NatsHandoverRequest `json:"handover,omitempty"`
+
+	HandoverResponse *NatsHandoverResponse `json:"handoverresponse,omitempty"`
+
+	HandoverRelease *NatsHandoverReleaseMessage `json:"handoverrelease,omitempty"`
+
+	Kick *NatsKickMessage `json:"kick,omitempty"`
+
+	Ban *NatsBanMessage `json:"ban,omitempty"`
+
+	Lobby *NatsLobbyMessage `json:"lobby,omitempty"`
+
+	LobbyRequests *NatsLobbyRequestsMessage `json:"lobbyrequests,omitempty"`
+
+	Roster *NatsRosterRequest `json:"roster,omitempty"`
+
+	RosterResponse *NatsRosterResponse `json:"rosterresponse,omitempty"`
+
+	RoomServer *NatsRoomServerMessage `json:"roomserver,omitempty"`
+
+	History *NatsRoomHistoryMessage `json:"history,omitempty"`
+
+	Counts *NatsRoomCountsMessage `json:"counts,omitempty"`
+
+	Recording *NatsRoomRecordingMessage `json:"recording,omitempty"`
+
+	Admin *NatsAdminRequest `json:"admin,omitempty"`
+
+	AdminResponse *NatsAdminResponse `json:"adminresponse,omitempty"`
+
 	Id string `json:"id"`
 }
 
+type NatsKickMessage struct {
+	RoomId string `json:"roomid"`
+	// Session that kicked the recipient.
+	SessionId string `json:"sessionid"`
+
+	BanDuration int `json:"banduration,omitempty"`
+}
+
+type NatsLobbyMessage struct {
+	RoomId string `json:"roomid"`
+	// Session that approved / denied the request.
+	SessionId string `json:"sessionid"`
+
+	Approved bool `json:"approved"`
+}
+
+type NatsLobbyRequestsMessage struct {
+	// Room id including the backend.
+	RoomId string `json:"roomid"`
+	// Moderator that should receive the pending join requests.
+	SessionId string `json:"sessionid"`
+}
+
+type NatsBanMessage struct {
+	// Room id including the backend.
+	RoomId string `json:"roomid"`
+
+	UserId        string `json:"userid,omitempty"`
+	RoomSessionId string `json:"roomsessionid,omitempty"`
+
+	Expires time.Time `json:"expires"`
+}
+
+type NatsBroadcastMessage struct {
+	BackendId string `json:"backendid"`
+
+	// Only sessions of these users will receive the message if set.
+	UserIds []string `json:"userids,omitempty"`
+
+	Message *ServerMessage `json:"message"`
+}
+
+type NatsSendOfferMessage struct {
+	// Id of the client message that triggered the offer.
+	MessageId string `json:"messageid,omitempty"`
+	// Session that is sending the offer (i.e. the publisher).
+	SessionId string `json:"sessionid"`
+
+	Data *MessageClientMessageData `json:"data"`
+}
+
+type NatsTransientDataMessage struct {
+	// One of "set", "remove" or "snapshot".
+	Type string `json:"type"`
+
+	Key   string      `json:"key,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+	// Used for types "set" and "remove"
+	Version int64 `json:"version,omitempty"`
+
+	// Used for type "snapshot"
+	Data     map[string]interface{} `json:"data,omitempty"`
+	Versions map[string]int64       `json:"versions,omitempty"`
+}
+
+type NatsHandoverRequest struct {
+	// Private id of the session that should be handed over.
+	PrivateId string `json:"privateid"`
+	// Subject where the response should be sent to.
+	ReplyTo string `json:"replyto"`
+	// Id of the server that requested the handover.
+	ServerId string `json:"serverid"`
+}
+
+type NatsHandoverResponse struct {
+	// Id of the server that sent the response.
+	ServerId string `json:"serverid"`
+	// State of the session, "nil" if the server doesn't own the session.
+	Session *SessionHandoverState `json:"session"`
+}
+
+type NatsHandoverReleaseMessage struct {
+	// Public id of the session that was handed over.
+	PublicId string `json:"publicid"`
+	// Stream types of the publishers and ids of the subscribers that were
+	// replaced. Everything is released if both are empty.
+	Publishers  []string `json:"publishers,omitempty"`
+	Subscribers []string `json:"subscribers,omitempty"`
+	// Id of the server that sent the release.
+	ServerId string `json:"serverid"`
+}
+
+type NatsRosterRequest struct {
+	// Subject where the response should be sent to.
+	ReplyTo string `json:"replyto"`
+	// Id of the server that requested the roster.
+	ServerId string `json:"serverid"`
+}
+
+type NatsRosterResponse struct {
+	// Id of the server that sent the response.
+	ServerId string                `json:"serverid"`
+	Sessions []*RosterSessionEntry `json:"sessions"`
+}
+
+type NatsRoomServerMessage struct {
+	// Id of the server that created or closed the room.
+	ServerId string `json:"serverid"`
+
+	Active bool `json:"active"`
+
+	// Other servers that have the room should announce themselves and send
+	// snapshots of the transient data, history and recording state.
+	Sync bool `json:"sync,omitempty"`
+}
+
+type NatsRoomHistoryMessage struct {
+	// One of "add" or "snapshot".
+	Type string `json:"type"`
+
+	// Used for type "add"
+	Message *ServerMessage `json:"message,omitempty"`
+
+	// Used for type "snapshot"
+	Messages []*ServerMessage `json:"messages,omitempty"`
+}
+
+type NatsRoomCountsMessage struct {
+	// Id of the server that sent the counts.
+	ServerId string `json:"serverid"`
+
+	Sessions   int `json:"sessions"`
+	Publishers int `json:"publishers"`
+
+	// Other servers should send their counts.
+	Sync bool `json:"sync,omitempty"`
+}
+
+type NatsRoomRecordingMessage struct {
+	// One of "start" / "stop" (sent by the backend server), "ack" (sent to
+	// the backend server) or "snapshot" with the state.
+	Type string `json:"type"`
+
+	Recording bool `json:"recording,omitempty"`
+
+	// Used for types "start" and "stop", subject to send the "ack" to.
+	ReplyTo string `json:"replyto,omitempty"`
+}
+
+type NatsAdminRequest struct {
+	// One of "rooms", "session", "closesession" or "announce".
+	Type string `json:"type"`
+
+	SessionId string `json:"sessionid,omitempty"`
+
+	// Used for type "announce", the server was started or stopped.
+	Active bool `json:"active,omitempty"`
+	// Used for type "announce", other servers should announce themselves.
+	Sync bool `json:"sync,omitempty"`
+
+	// Subject to send the response to.
+	ReplyTo string `json:"replyto,omitempty"`
+	// Id of the server that sent the request.
+	ServerId string `json:"serverid"`
+}
+
+type NatsAdminResponse struct {
+	// Id of the server that sent the response.
+	ServerId string `json:"serverid"`
+
+	Rooms   []*AdminRoomEntry  `json:"rooms,omitempty"`
+	Session *AdminSessionEntry `json:"session,omitempty"`
+	Closed  bool               `json:"closed,omitempty"`
+}
+
 type NatsSubscription interface {
 	Unsubscribe() error
 }
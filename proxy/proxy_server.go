@@ -750,6 +750,33 @@ func (s *ProxyServer) processCommand(ctx context.Context, client *ProxyClient, s
 			client.Close(context.Background())
 		}()
 
+		response := &signaling.ProxyServerMessage{
+			Id:   message.Id,
+			Type: "command",
+			Command: &signaling.CommandProxyServerMessage{
+				Id: cmd.ClientId,
+			},
+		}
+		session.sendMessage(response)
+	case "set-recording":
+		client := s.GetClient(cmd.ClientId)
+		if client == nil {
+			session.sendMessage(message.NewErrorServerMessage(UnknownClient))
+			return
+		}
+
+		publisher, ok := client.(signaling.McuPublisher)
+		if !ok {
+			session.sendMessage(message.NewErrorServerMessage(UnknownClient))
+			return
+		}
+
+		if err := publisher.SetRecording(ctx, cmd.Recording, cmd.Filename); err != nil {
+			log.Printf("Error changing recording of %s publisher %s to %t: %s", client.StreamType(), cmd.ClientId, cmd.Recording, err)
+			session.sendMessage(message.NewWrappedErrorServerMessage(err))
+			return
+		}
+
 		response := &signaling.ProxyServerMessage{
 			Id:   message.Id,
 			Type: "command",
@@ -189,6 +189,26 @@ func (s *ProxySession) PublisherClosed(publisher signaling.McuPublisher) {
 	}
 }
 
+func (s *ProxySession) PublisherTalking(publisher signaling.McuPublisher, talking bool) {
+	id := s.proxy.GetClientId(publisher)
+	if id == "" {
+		log.Printf("Received talking event from unknown %s publisher %s (%+v)", publisher.StreamType(), publisher.Id(), publisher)
+		return
+	}
+
+	msg := &signaling.ProxyServerMessage{
+		Type: "event",
+		Event: &signaling.EventProxyServerMessage{
+			Type:     "talking",
+			ClientId: id,
+			Talking: &signaling.TalkingProxyServerMessage{
+				Talking: talking,
+			},
+		},
+	}
+	s.sendMessage(msg)
+}
+
 func (s *ProxySession) SubscriberClosed(subscriber signaling.McuSubscriber) {
 	if id := s.DeleteSubscriber(subscriber); id != "" {
 		if s.proxy.DeleteClient(id, subscriber) {
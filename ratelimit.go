@@ -0,0 +1,295 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2021 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dlintw/goconf"
+)
+
+const (
+	// Rejected messages are counted in this interval to detect clients that
+	// ignore the limits.
+	rateLimitViolationsInterval = time.Minute
+
+	// Buckets that were not used for this duration will be removed.
+	rateLimitIdleTimeout = 5 * time.Minute
+
+	// Default number of rejected messages after which a client is
+	// disconnected.
+	defaultRateLimitMaxViolations = 10
+
+	RateLimitScopeIP      = "ip"
+	RateLimitScopeSession = "session"
+	RateLimitScopeType    = "type"
+)
+
+func init() {
+	RegisterRateLimitStats()
+}
+
+type TooManyRequestsDetails struct {
+	// Time in milliseconds after which the request can be retried.
+	RetryAfter int64 `json:"retryafter"`
+}
+
+func NewTooManyRequestsError(retryAfter time.Duration) *Error {
+	return NewErrorDetail("too_many_requests", "Too many requests.", &TooManyRequestsDetails{
+		RetryAfter: int64(math.Ceil(float64(retryAfter) / float64(time.Millisecond))),
+	})
+}
+
+type rateLimit struct {
+	// Number of messages per second.
+	rate float64
+	// Maximum number of messages that can be sent at once.
+	burst float64
+}
+
+func (l rateLimit) IsEnabled() bool {
+	return l.rate > 0
+}
+
+func parseRateLimit(value string) (rateLimit, error) {
+	var result rateLimit
+	parts := strings.Split(value, ",")
+	if len(parts) > 2 {
+		return result, fmt.Errorf("invalid rate limit %s", value)
+	}
+
+	rate, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil || rate < 0 {
+		return result, fmt.Errorf("invalid rate %s", parts[0])
+	}
+	result.rate = rate
+	if len(parts) == 2 {
+		burst, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || burst < 1 {
+			return result, fmt.Errorf("invalid burst %s", parts[1])
+		}
+		result.burst = burst
+	} else {
+		result.burst = math.Max(1, math.Ceil(rate))
+	}
+	return result, nil
+}
+
+func getRateLimit(config *goconf.ConfigFile, section string, name string) (rateLimit, error) {
+	value, _ := config.GetString(section, name)
+	if value == "" {
+		return rateLimit{}, nil
+	}
+
+	return parseRateLimit(value)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+
+	violations     int
+	firstViolation time.Time
+}
+
+// take removes a token from the bucket. Returns the duration after which a
+// token will be available if the bucket is empty.
+func (b *tokenBucket) take(limit rateLimit, now time.Time) time.Duration {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(limit.burst, b.tokens+elapsed.Seconds()*limit.rate)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / limit.rate * float64(time.Second))
+	if wait <= 0 {
+		wait = time.Millisecond
+	}
+	return wait
+}
+
+func (b *tokenBucket) addViolation(now time.Time) int {
+	if now.Sub(b.firstViolation) > rateLimitViolationsInterval {
+		b.violations = 0
+		b.firstViolation = now
+	}
+	b.violations++
+	return b.violations
+}
+
+// RateLimiter limits the number of messages per remote address, session
+// and message type using token buckets.
+type RateLimiter struct {
+	mu sync.Mutex
+
+	ip            rateLimit
+	session       rateLimit
+	types         map[string]rateLimit
+	maxViolations int
+
+	buckets map[string]*tokenBucket
+}
+
+func NewRateLimiter(config *goconf.ConfigFile) (*RateLimiter, error) {
+	l := &RateLimiter{
+		buckets: make(map[string]*tokenBucket),
+	}
+	if err := l.load(config); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *RateLimiter) load(config *goconf.ConfigFile) error {
+	ip, err := getRateLimit(config, "ratelimit", "ip")
+	if err != nil {
+		return err
+	}
+	session, err := getRateLimit(config, "ratelimit", "session")
+	if err != nil {
+		return err
+	}
+	types := make(map[string]rateLimit)
+	options, _ := config.GetOptions("ratelimit-types")
+	for _, name := range options {
+		limit, err := getRateLimit(config, "ratelimit-types", name)
+		if err != nil {
+			return fmt.Errorf("invalid rate limit for type %s: %s", name, err)
+		}
+		if limit.IsEnabled() {
+			types[name] = limit
+		}
+	}
+	maxViolations, err := config.GetInt("ratelimit", "maxviolations")
+	if err != nil {
+		maxViolations = defaultRateLimitMaxViolations
+	}
+
+	statsRateLimitCurrent.Reset()
+	if ip.IsEnabled() {
+		log.Printf("Limiting messages per remote address to %.2f/s (burst %.0f)", ip.rate, ip.burst)
+		statsRateLimitCurrent.WithLabelValues(RateLimitScopeIP, "").Set(ip.rate)
+	}
+	if session.IsEnabled() {
+		log.Printf("Limiting messages per session to %.2f/s (burst %.0f)", session.rate, session.burst)
+		statsRateLimitCurrent.WithLabelValues(RateLimitScopeSession, "").Set(session.rate)
+	}
+	for name, limit := range types {
+		log.Printf("Limiting messages of type %s per session to %.2f/s (burst %.0f)", name, limit.rate, limit.burst)
+		statsRateLimitCurrent.WithLabelValues(RateLimitScopeType, name).Set(limit.rate)
+	}
+	if maxViolations > 0 && (ip.IsEnabled() || session.IsEnabled() || len(types) > 0) {
+		log.Printf("Disconnecting clients after %d rejected messages per %s", maxViolations, rateLimitViolationsInterval)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ip = ip
+	l.session = session
+	l.types = types
+	l.maxViolations = maxViolations
+	return nil
+}
+
+func (l *RateLimiter) Reload(config *goconf.ConfigFile) {
+	if err := l.load(config); err != nil {
+		log.Printf("Could not reload rate limits, keeping previous values: %s", err)
+	}
+}
+
+func (l *RateLimiter) check(key string, limit rateLimit, now time.Time) (time.Duration, bool) {
+	bucket, found := l.buckets[key]
+	if !found {
+		bucket = &tokenBucket{
+			tokens: limit.burst,
+			last:   now,
+		}
+		l.buckets[key] = bucket
+	}
+
+	wait := bucket.take(limit, now)
+	if wait == 0 {
+		return 0, false
+	}
+
+	violations := bucket.addViolation(now)
+	return wait, l.maxViolations > 0 && violations > l.maxViolations
+}
+
+// AllowIP checks if another message from the given remote address may be
+// processed. Returns the duration after which the client may retry if not,
+// and if the client should be disconnected.
+func (l *RateLimiter) AllowIP(ip string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.ip.IsEnabled() {
+		return 0, false
+	}
+
+	return l.check(RateLimitScopeIP+"|"+ip, l.ip, now)
+}
+
+// AllowSession checks if another message from the given session may be
+// processed.
+func (l *RateLimiter) AllowSession(sessionId string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.session.IsEnabled() {
+		return 0, false
+	}
+
+	return l.check(RateLimitScopeSession+"|"+sessionId, l.session, now)
+}
+
+// AllowType checks if another message of the given type from the given
+// session may be processed.
+func (l *RateLimiter) AllowType(sessionId string, messageType string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limit, found := l.types[messageType]
+	if !found {
+		return 0, false
+	}
+
+	return l.check(RateLimitScopeType+"|"+messageType+"|"+sessionId, limit, now)
+}
+
+// Cleanup removes buckets that were not used recently.
+func (l *RateLimiter) Cleanup(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.last) > rateLimitIdleTimeout {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2021 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	statsRateLimitCurrent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "signaling",
+		Subsystem: "ratelimit",
+		Name:      "limit",
+		Help:      "The configured number of messages per second",
+	}, []string{"scope", "type"})
+	statsRateLimitRejectedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "signaling",
+		Subsystem: "ratelimit",
+		Name:      "rejected_total",
+		Help:      "The total number of messages rejected because of rate limits",
+	}, []string{"scope", "type"})
+	statsRateLimitDisconnectedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "signaling",
+		Subsystem: "ratelimit",
+		Name:      "disconnected_total",
+		Help:      "The total number of clients disconnected because of repeated rate limit violations",
+	}, []string{"scope"})
+
+	rateLimitStats = []prometheus.Collector{
+		statsRateLimitCurrent,
+		statsRateLimitRejectedTotal,
+		statsRateLimitDisconnectedTotal,
+	}
+)
+
+func RegisterRateLimitStats() {
+	registerAll(rateLimitStats...)
+}
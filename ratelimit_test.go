@@ -0,0 +1,237 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2021 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dlintw/goconf"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	valid := map[string]rateLimit{
+		"0":       {rate: 0, burst: 1},
+		"10":      {rate: 10, burst: 10},
+		"0.5":     {rate: 0.5, burst: 1},
+		"2, 5":    {rate: 2, burst: 5},
+		" 1 , 3 ": {rate: 1, burst: 3},
+	}
+	for value, expected := range valid {
+		if limit, err := parseRateLimit(value); err != nil {
+			t.Errorf("Could not parse %s: %s", value, err)
+		} else if limit != expected {
+			t.Errorf("Expected %+v for %s, got %+v", expected, value, limit)
+		}
+	}
+
+	invalid := []string{
+		"foo",
+		"-1",
+		"1, 0",
+		"1, 2, 3",
+	}
+	for _, value := range invalid {
+		if limit, err := parseRateLimit(value); err == nil {
+			t.Errorf("Parsing %s should have failed, got %+v", value, limit)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("ratelimit", "session", "1, 2")
+	config.AddOption("ratelimit", "maxviolations", "2")
+	config.AddOption("ratelimit-types", "requestoffer", "0.5")
+	limiter, err := NewRateLimiter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if wait, _ := limiter.AllowIP("127.0.0.1", now); wait != 0 {
+		t.Errorf("Remote addresses should not be limited, got %s", wait)
+	}
+	if wait, _ := limiter.AllowType("session", "message", now); wait != 0 {
+		t.Errorf("Type should not be limited, got %s", wait)
+	}
+
+	for i := 0; i < 2; i++ {
+		if wait, _ := limiter.AllowSession("session", now); wait != 0 {
+			t.Errorf("Message %d should be allowed, got %s", i, wait)
+		}
+	}
+	if wait, disconnect := limiter.AllowSession("session", now); wait != time.Second {
+		t.Errorf("Expected wait of %s, got %s", time.Second, wait)
+	} else if disconnect {
+		t.Error("Should not disconnect")
+	}
+	// Other sessions are not affected.
+	if wait, _ := limiter.AllowSession("other-session", now); wait != 0 {
+		t.Errorf("Other session should be allowed, got %s", wait)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if wait, disconnect := limiter.AllowSession("session", now); wait != 500*time.Millisecond {
+		t.Errorf("Expected wait of %s, got %s", 500*time.Millisecond, wait)
+	} else if disconnect {
+		t.Error("Should not disconnect")
+	}
+	if wait, disconnect := limiter.AllowSession("session", now); wait == 0 {
+		t.Error("Message should have been rejected")
+	} else if !disconnect {
+		t.Error("Should disconnect after repeated violations")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if wait, _ := limiter.AllowSession("session", now); wait != 0 {
+		t.Errorf("Message should be allowed again, got %s", wait)
+	}
+
+	if wait, _ := limiter.AllowType("session", "requestoffer", now); wait != 0 {
+		t.Errorf("Request should be allowed, got %s", wait)
+	}
+	if wait, _ := limiter.AllowType("session", "requestoffer", now); wait != 2*time.Second {
+		t.Errorf("Expected wait of %s, got %s", 2*time.Second, wait)
+	}
+
+	limiter.Cleanup(now)
+	if count := len(limiter.buckets); count != 3 {
+		t.Errorf("Expected 3 buckets, got %d", count)
+	}
+	limiter.Cleanup(now.Add(rateLimitIdleTimeout + time.Second))
+	if count := len(limiter.buckets); count != 0 {
+		t.Errorf("Expected no buckets, got %d", count)
+	}
+}
+
+func TestClientRateLimit(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("ratelimit", "session", "0.1, 2")
+		config.AddOption("ratelimit", "maxviolations", "1")
+		return config, nil
+	})
+	defer shutdown()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rejected := testutil.ToFloat64(statsRateLimitRejectedTotal.WithLabelValues(RateLimitScopeSession, ""))
+	disconnected := testutil.ToFloat64(statsRateLimitDisconnectedTotal.WithLabelValues(RateLimitScopeSession))
+
+	recipient := MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello2.Hello.SessionId,
+	}
+	for i := 0; i < 2; i++ {
+		data := "from-1-to-2"
+		if err := client1.SendMessage(recipient, data); err != nil {
+			t.Fatal(err)
+		}
+
+		var payload string
+		if err := checkReceiveClientMessage(ctx, client2, "session", hello1.Hello, &payload); err != nil {
+			t.Error(err)
+		} else if payload != data {
+			t.Errorf("Expected payload %s, got %s", data, payload)
+		}
+	}
+
+	if err := client1.SendMessage(recipient, "rejected"); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Error(err)
+	} else if err := checkMessageError(msg, "too_many_requests"); err != nil {
+		t.Error(err)
+	} else if msg.Id != "abcd" {
+		t.Errorf("Expected message id abcd, got %+v", msg)
+	} else {
+		var details TooManyRequestsDetails
+		if data, err := json.Marshal(msg.Error.Details); err != nil {
+			t.Error(err)
+		} else if err := json.Unmarshal(data, &details); err != nil {
+			t.Error(err)
+		} else if details.RetryAfter <= 0 || details.RetryAfter > 10000 {
+			t.Errorf("Expected retry hint, got %+v", msg.Error.Details)
+		}
+	}
+
+	// Clients that ignore the limit will be disconnected.
+	if err := client1.SendMessage(recipient, "rejected"); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Error(err)
+	} else if err := checkMessageType(msg, "bye"); err != nil {
+		t.Error(err)
+	} else if msg.Bye.Reason != "too_many_requests" {
+		t.Errorf("Expected reason too_many_requests, got %+v", msg.Bye)
+	}
+
+	checkStatsValue(t, statsRateLimitRejectedTotal.WithLabelValues(RateLimitScopeSession, ""), rejected+2)
+	checkStatsValue(t, statsRateLimitDisconnectedTotal.WithLabelValues(RateLimitScopeSession), disconnected+1)
+
+	// The other client didn't receive the rejected messages.
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel2()
+	if msg, err := client2.RunUntilMessage(ctx2); err != nil {
+		if err != context.DeadlineExceeded {
+			t.Error(err)
+		}
+	} else {
+		t.Errorf("Expected no message, got %+v", msg)
+	}
+}
+
+func TestRateLimitStats(t *testing.T) {
+	collectAndLint(t, rateLimitStats...)
+}
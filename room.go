@@ -69,6 +69,29 @@ type Room struct {
 	inCallSessions   map[Session]bool
 	roomSessionData  map[string]*RoomSessionData
 
+	transientData *TransientData
+
+	// Recent room messages that will be sent to joining sessions.
+	history []*ServerMessage
+
+	// Sessions that are currently speaking and pending timers to notify when
+	// they stopped speaking.
+	speaking       map[string]bool
+	speakingTimers map[string]*time.Timer
+
+	// Limits as received from the backend, "0" for no limit.
+	maxSessions   int
+	maxPublishers int
+	// Local sessions that are publishing media.
+	publishers map[string]bool
+	// Number of sessions and publishers on other servers.
+	remoteCounts map[string]*roomServerCounts
+	// Other servers that have sessions in the room.
+	remoteServers map[string]bool
+
+	// The publishers of the room are being recorded by the MCU.
+	recording bool
+
 	statsRoomSessionsCurrent *prometheus.GaugeVec
 
 	natsReceiver        chan *nats.Msg
@@ -76,6 +99,8 @@ type Room struct {
 
 	// Users currently in the room
 	users []map[string]interface{}
+	// At least one of the users is in the call.
+	callActive bool
 
 	// Timestamps of last NATS backend requests for the different types.
 	lastNatsRoomRequests map[string]int64
@@ -130,6 +155,15 @@ func NewRoom(roomId string, properties *json.RawMessage, hub *Hub, n NatsClient,
 		inCallSessions:   make(map[Session]bool),
 		roomSessionData:  make(map[string]*RoomSessionData),
 
+		transientData: NewTransientData(),
+
+		speaking:       make(map[string]bool),
+		speakingTimers: make(map[string]*time.Timer),
+
+		publishers:    make(map[string]bool),
+		remoteCounts:  make(map[string]*roomServerCounts),
+		remoteServers: make(map[string]bool),
+
 		statsRoomSessionsCurrent: statsRoomSessionsCurrent.MustCurryWith(prometheus.Labels{
 			"backend": backend.Id(),
 			"room":    roomId,
@@ -142,6 +176,10 @@ func NewRoom(roomId string, properties *json.RawMessage, hub *Hub, n NatsClient,
 	}
 	go room.run()
 
+	// The room might already exist on other servers, they will announce
+	// themselves and send the current state of the room.
+	room.announceServer(true, true)
+
 	return room, nil
 }
 
@@ -194,6 +232,10 @@ loop:
 			}
 		case <-ticker.C:
 			r.publishActiveSessions()
+			if r.hasLimits() {
+				// Refresh counts on other servers so they don't expire.
+				r.publishCounts(false)
+			}
 		}
 	}
 }
@@ -228,10 +270,12 @@ func (r *Room) Close() []Session {
 		result = append(result, s)
 	}
 	r.sessions = nil
+	r.clearSpeakingLocked()
 	r.statsRoomSessionsCurrent.Delete(prometheus.Labels{"clienttype": HelloClientTypeClient})
 	r.statsRoomSessionsCurrent.Delete(prometheus.Labels{"clienttype": HelloClientTypeInternal})
 	r.statsRoomSessionsCurrent.Delete(prometheus.Labels{"clienttype": HelloClientTypeVirtual})
 	r.mu.Unlock()
+	r.announceServer(false, false)
 	return result
 }
 
@@ -245,6 +289,18 @@ func (r *Room) processNatsMessage(message *nats.Msg) {
 	switch msg.Type {
 	case "room":
 		r.processBackendRoomRequest(msg.Room)
+	case "transient":
+		r.processTransientData(msg.TransientData)
+	case "roster":
+		r.processRosterRequest(msg.Roster)
+	case "history":
+		r.processHistory(msg.History)
+	case "counts":
+		r.processCounts(msg.Counts)
+	case "roomserver":
+		r.processRoomServer(msg.RoomServer)
+	case "recording":
+		r.processRecording(msg.Recording)
 	default:
 		log.Printf("Unsupported NATS room request with type %s: %+v", msg.Type, msg)
 	}
@@ -275,12 +331,25 @@ func (r *Room) processBackendRoomRequest(message *BackendServerRoomRequest) {
 		r.hub.roomParticipants <- message
 	case "message":
 		r.publishRoomMessage(message.Message)
+	case "permissions":
+		r.processPermissionsRequest(message.Permissions)
+	case "switchto":
+		r.processSwitchToRequest(message.SwitchTo)
 	default:
 		log.Printf("Unsupported NATS backend room request with type %s in %s: %+v", message.Type, r.Id(), message)
 	}
 }
 
-func (r *Room) AddSession(session Session, sessionData *json.RawMessage) []Session {
+// AddSession adds the session to the room and returns the other sessions
+// already in the room. Returns an error if the room is full.
+func (r *Room) AddSession(session Session, sessionData *json.RawMessage) ([]Session, error) {
+	return r.addSession(session, sessionData, true)
+}
+
+// addSession adds the session to the room. Sessions that were handed over
+// from other servers are added without "notify", they are no new sessions
+// in the room and don't count against the limit.
+func (r *Room) addSession(session Session, sessionData *json.RawMessage, notify bool) ([]Session, error) {
 	var roomSessionData *RoomSessionData
 	if sessionData != nil && len(*sessionData) > 0 {
 		roomSessionData = &RoomSessionData{}
@@ -292,6 +361,13 @@ func (r *Room) AddSession(session Session, sessionData *json.RawMessage) []Sessi
 
 	sid := session.PublicId()
 	r.mu.Lock()
+	if notify {
+		// Checked while locked so concurrent joins can't exceed the limit.
+		if err := r.checkSessionLimitLocked(session); err != nil {
+			r.mu.Unlock()
+			return nil, err
+		}
+	}
 	_, found := r.sessions[sid]
 	// Return list of sessions already in the room.
 	result := make([]Session, 0, len(r.sessions))
@@ -323,7 +399,14 @@ func (r *Room) AddSession(session Session, sessionData *json.RawMessage) []Sessi
 		log.Printf("Session %s sent room session data %+v", session.PublicId(), roomSessionData)
 	}
 	r.mu.Unlock()
+	if clientSession, ok := session.(*ClientSession); ok {
+		r.transientData.AddListener(clientSession)
+	}
 	if !found {
+		r.publishCounts(false)
+	}
+	if !found && notify {
+		r.hub.webhooks.Send(r.backend, newWebhookEvent(BackendEventSessionJoined, r.id, session))
 		r.PublishSessionJoined(session, roomSessionData)
 		if publishUsersChanged {
 			r.publishUsersChangedWithInternal()
@@ -332,7 +415,7 @@ func (r *Room) AddSession(session Session, sessionData *json.RawMessage) []Sessi
 			}
 		}
 	}
-	return result
+	return result, nil
 }
 
 func (r *Room) HasSession(session Session) bool {
@@ -342,6 +425,12 @@ func (r *Room) HasSession(session Session) bool {
 	return result
 }
 
+func (r *Room) setSessionInCall(session Session) {
+	r.mu.Lock()
+	r.inCallSessions[session] = true
+	r.mu.Unlock()
+}
+
 func (r *Room) IsSessionInCall(session Session) bool {
 	r.mu.RLock()
 	_, result := r.inCallSessions[session]
@@ -349,8 +438,16 @@ func (r *Room) IsSessionInCall(session Session) bool {
 	return result
 }
 
-// Returns "true" if there are still clients in the room.
-func (r *Room) RemoveSession(session Session) bool {
+// Returns "true" if there are still clients in the room. The "left" event is
+// only sent to the webhook of the backend if "notify" is set.
+func (r *Room) RemoveSession(session Session, notify bool) bool {
+	return r.removeSession(session, notify, true)
+}
+
+// removeSession removes the session from the room. The webhook of the backend
+// is only notified if "notifyBackend" is set, the other sessions in the room
+// only if "notifyRoom" is set.
+func (r *Room) removeSession(session Session, notifyBackend bool, notifyRoom bool) bool {
 	r.mu.Lock()
 	if _, found := r.sessions[session.PublicId()]; !found {
 		r.mu.Unlock()
@@ -366,9 +463,20 @@ func (r *Room) RemoveSession(session Session) bool {
 	}
 	delete(r.inCallSessions, session)
 	delete(r.roomSessionData, sid)
+	delete(r.publishers, sid)
+	r.removeSpeakingLocked(sid)
+	if clientSession, ok := session.(*ClientSession); ok {
+		r.transientData.RemoveListener(clientSession)
+	}
+	if notifyBackend {
+		r.hub.webhooks.Send(r.backend, newWebhookEvent(BackendEventSessionLeft, r.id, session))
+	}
 	if len(r.sessions) > 0 {
 		r.mu.Unlock()
-		r.PublishSessionLeft(session)
+		r.publishCounts(false)
+		if notifyRoom {
+			r.PublishSessionLeft(session)
+		}
 		return true
 	}
 
@@ -379,6 +487,8 @@ func (r *Room) RemoveSession(session Session) bool {
 	r.unsubscribeBackend()
 	r.doClose()
 	r.mu.Unlock()
+	r.publishCounts(false)
+	r.announceServer(false, false)
 	return false
 }
 
@@ -386,6 +496,72 @@ func (r *Room) publish(message *ServerMessage) error {
 	return r.nats.PublishMessage(GetSubjectForRoomId(r.id, r.backend), message)
 }
 
+func (r *Room) publishTransientData(message *NatsTransientDataMessage) error {
+	msg := &NatsMessage{
+		SendTime:      time.Now(),
+		Type:          "transient",
+		TransientData: message,
+	}
+	return r.nats.PublishNats(GetSubjectForBackendRoomId(r.id, r.backend), msg)
+}
+
+// SetTransientData updates the transient data of the room on all servers.
+// Passing a "nil" value will remove the key.
+func (r *Room) SetTransientData(key string, value interface{}) error {
+	if value == nil {
+		return r.RemoveTransientData(key)
+	}
+
+	return r.publishTransientData(&NatsTransientDataMessage{
+		Type:    "set",
+		Key:     key,
+		Value:   value,
+		Version: r.transientData.NextVersion(),
+	})
+}
+
+// RemoveTransientData removes the transient data of the room on all servers.
+func (r *Room) RemoveTransientData(key string) error {
+	return r.publishTransientData(&NatsTransientDataMessage{
+		Type:    "remove",
+		Key:     key,
+		Version: r.transientData.NextVersion(),
+	})
+}
+
+func (r *Room) publishTransientDataSnapshot() {
+	data, versions := r.transientData.GetDataVersions()
+	if len(data) == 0 {
+		return
+	}
+
+	if err := r.publishTransientData(&NatsTransientDataMessage{
+		Type:     "snapshot",
+		Data:     data,
+		Versions: versions,
+	}); err != nil {
+		log.Printf("Could not publish transient data snapshot for room %s: %s", r.Id(), err)
+	}
+}
+
+func (r *Room) processTransientData(message *NatsTransientDataMessage) {
+	if message == nil {
+		return
+	}
+
+	switch message.Type {
+	case "set":
+		r.transientData.SetVersion(message.Key, message.Value, message.Version)
+	case "remove":
+		r.transientData.RemoveVersion(message.Key, message.Version)
+	case "snapshot":
+		// Entries that were changed or removed more recently are ignored.
+		r.transientData.Merge(message.Data, message.Versions)
+	default:
+		log.Printf("Unsupported transient data message with type %s in %s: %+v", message.Type, r.Id(), message)
+	}
+}
+
 func (r *Room) UpdateProperties(properties *json.RawMessage) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -538,8 +714,64 @@ func IsInCall(value interface{}) (bool, bool) {
 	}
 }
 
+// getInCallFlags returns the numeric "inCall" flags of a participant.
+func getInCallFlags(value interface{}) (int, bool) {
+	switch value := value.(type) {
+	case bool:
+		if value {
+			return FlagInCall, true
+		}
+		return FlagDisconnected, true
+	case float64:
+		return int(value), true
+	case int:
+		return value, true
+	case json.Number:
+		if flags, err := value.Int64(); err == nil {
+			return int(flags), true
+		}
+		return 0, false
+	default:
+		return 0, false
+	}
+}
+
+func hasUsersInCall(users []map[string]interface{}) bool {
+	for _, user := range users {
+		if inCall, ok := IsInCall(user["inCall"]); ok && inCall {
+			return true
+		}
+	}
+	return false
+}
+
+// isEventOwnerLocked returns true if this server sends the events of the room
+// that don't belong to a session. All servers hosting the room receive the
+// same updates, so only the one with the lowest id sends them.
+func (r *Room) isEventOwnerLocked() bool {
+	for serverId := range r.remoteServers {
+		if serverId < r.hub.serverId {
+			return false
+		}
+	}
+	return true
+}
+
 func (r *Room) PublishUsersInCallChanged(changed []map[string]interface{}, users []map[string]interface{}) {
+	callActive := hasUsersInCall(users)
+	r.mu.Lock()
 	r.users = users
+	callChanged := r.callActive != callActive
+	r.callActive = callActive
+	isEventOwner := r.isEventOwnerLocked()
+	r.mu.Unlock()
+	if callChanged && isEventOwner {
+		if callActive {
+			r.hub.webhooks.Send(r.backend, newWebhookEvent(BackendEventCallStarted, r.id, nil))
+		} else {
+			r.hub.webhooks.Send(r.backend, newWebhookEvent(BackendEventCallEnded, r.id, nil))
+		}
+	}
 	for _, user := range changed {
 		inCallInterface, found := user["inCall"]
 		if !found {
@@ -691,6 +923,118 @@ func (r *Room) publishSessionFlagsChanged(session *VirtualSession) {
 	}
 }
 
+// processPermissionsRequest updates the permissions of the local sessions
+// that match the session ids or user ids of the request.
+func (r *Room) processPermissionsRequest(request *BackendRoomPermissionsRequest) {
+	// Only sessions connected to this server can be resolved.
+	sessionIds := make(map[string]bool, len(request.SessionIds))
+	for _, roomSessionId := range request.SessionIds {
+		if sessionId, err := r.hub.roomSessions.GetSessionId(roomSessionId); err == nil {
+			sessionIds[sessionId] = true
+		} else if err != ErrNoSuchRoomSession {
+			log.Printf("Could not lookup by room session %s: %s", roomSessionId, err)
+		}
+	}
+	userIds := make(map[string]bool, len(request.UserIds))
+	for _, userId := range request.UserIds {
+		userIds[userId] = true
+	}
+
+	var sessions []*ClientSession
+	r.mu.RLock()
+	for sid, session := range r.sessions {
+		clientSession, ok := session.(*ClientSession)
+		if !ok {
+			continue
+		}
+
+		if userId := clientSession.AuthUserId(); sessionIds[sid] || (userId != "" && userIds[userId]) {
+			sessions = append(sessions, clientSession)
+		}
+	}
+	r.mu.RUnlock()
+
+	for _, session := range sessions {
+		session.SetPermissions(request.Permissions)
+		session.SendMessage(&ServerMessage{
+			Type: "event",
+			Event: &EventServerMessage{
+				Target: "participants",
+				Type:   "permissions",
+				Permissions: &RoomPermissionsServerMessage{
+					RoomId:      r.id,
+					SessionId:   session.PublicId(),
+					Permissions: request.Permissions,
+				},
+			},
+		})
+	}
+}
+
+func (r *Room) processSwitchToRequest(request *BackendRoomSwitchToRequest) {
+	// Resolve the room session ids without holding the room lock.
+	sessionIds := make([]string, 0, len(request.SessionIds))
+	for _, roomSessionId := range request.SessionIds {
+		if roomSessionId == sessionIdNotInMeeting {
+			// Ignore entries that are no longer in the meeting.
+			continue
+		}
+
+		sessionId, err := r.hub.roomSessions.GetSessionId(roomSessionId)
+		if err != nil {
+			if err != ErrNoSuchRoomSession {
+				log.Printf("Could not lookup by room session %s: %s", roomSessionId, err)
+			}
+			continue
+		}
+
+		sessionIds = append(sessionIds, sessionId)
+	}
+
+	// Only sessions connected to this server are notified.
+	var sessions []*ClientSession
+	r.mu.RLock()
+	for _, sessionId := range sessionIds {
+		if session, ok := r.sessions[sessionId].(*ClientSession); ok {
+			sessions = append(sessions, session)
+		}
+	}
+	r.mu.RUnlock()
+
+	msg := &ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "room",
+			Type:   "switchto",
+			SwitchTo: &EventServerMessageSwitchTo{
+				RoomId: request.RoomId,
+			},
+		},
+	}
+	for _, session := range sessions {
+		session.SendMessage(msg)
+	}
+}
+
+func (r *Room) publishPublisherRevoked(session Session, streamType string, media []string) {
+	message := &ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "participants",
+			Type:   "revoked",
+			Revoked: &RoomRevokedServerMessage{
+				RoomId:     r.id,
+				SessionId:  session.PublicId(),
+				StreamType: streamType,
+				Media:      media,
+			},
+		},
+	}
+	if err := r.publish(message); err != nil {
+		log.Printf("Could not publish revoked message in room %s: %s", r.Id(), err)
+	}
+}
+
 func (r *Room) publishActiveSessions() (int, *sync.WaitGroup) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
@@ -772,6 +1116,8 @@ func (r *Room) publishRoomMessage(message *BackendRoomMessageRequest) {
 			},
 		},
 	}
+	// Backend requests are received by all servers, no need to distribute.
+	r.addHistory(msg)
 	if err := r.publish(msg); err != nil {
 		log.Printf("Could not publish room message in room %s: %s", r.Id(), err)
 	}
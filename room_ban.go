@@ -0,0 +1,186 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2021 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// Subject where all servers receive users / room sessions that may not
+	// join a room for some time.
+	roomBanSubject = "hub.bans"
+)
+
+func getRoomBanKey(roomId string, userId string, roomSessionId string) string {
+	if userId != "" {
+		return roomId + "|user|" + userId
+	}
+
+	return roomId + "|session|" + roomSessionId
+}
+
+func (h *Hub) processControlAction(session *ClientSession, message *ClientMessage) {
+	msg := message.Control
+	room := session.GetRoom()
+	if room == nil {
+		session.SendMessage(message.NewErrorServerMessage(NotInRoom))
+		return
+	}
+
+	switch msg.Action.Type {
+	case ControlActionKick:
+		h.processKickAction(session, room, msg)
+	case ControlActionApprove:
+		h.processLobbyAction(session, room, msg, true)
+	case ControlActionDeny:
+		h.processLobbyAction(session, room, msg, false)
+	}
+}
+
+func (h *Hub) processKickAction(session *ClientSession, room *Room, msg *ControlClientMessage) {
+	kick := &NatsKickMessage{
+		RoomId:    room.Id(),
+		SessionId: session.PublicId(),
+	}
+	var subject string
+	switch msg.Recipient.Type {
+	case RecipientTypeSession:
+		data := h.decodeSessionId(msg.Recipient.SessionId, publicSessionName)
+		if data == nil || data.BackendId != session.Backend().Id() {
+			// Clients are only allowed to kick sessions from the same backend.
+			log.Printf("Ignore kick of unknown session %s from %s", msg.Recipient.SessionId, session.PublicId())
+			return
+		} else if msg.Recipient.SessionId == session.PublicId() {
+			// Sessions can't kick themselves.
+			return
+		}
+
+		subject = "session." + msg.Recipient.SessionId
+		// The ban will be created by the kicked session as only it knows the
+		// user and room session ids.
+		kick.BanDuration = msg.Action.BanDuration
+	case RecipientTypeUser:
+		subject = GetSubjectForUserId(msg.Recipient.UserId, session.Backend())
+		if msg.Action.BanDuration > 0 {
+			// Also ban the user if it has no sessions in the room right now.
+			h.banFromRoom(room, msg.Recipient.UserId, "", time.Duration(msg.Action.BanDuration)*time.Second)
+		}
+	}
+
+	log.Printf("Session %s kicks %s %s from room %s", session.PublicId(), msg.Recipient.Type, msg.Recipient.SessionId+msg.Recipient.UserId, room.Id())
+	if err := h.nats.PublishNats(subject, &NatsMessage{
+		SendTime: time.Now(),
+		Type:     "kick",
+		Kick:     kick,
+	}); err != nil {
+		log.Printf("Error publishing kick to %s: %s", subject, err)
+	}
+}
+
+func (h *Hub) processKick(session *ClientSession, kick *NatsKickMessage) {
+	room := session.GetRoom()
+	if room == nil || room.Id() != kick.RoomId || kick.SessionId == session.PublicId() {
+		// Session is no longer in the room (or the sender itself).
+		return
+	}
+
+	if kick.BanDuration > 0 {
+		session.mu.Lock()
+		roomSessionId := session.RoomSessionId()
+		session.mu.Unlock()
+		h.banFromRoom(room, session.UserId(), roomSessionId, time.Duration(kick.BanDuration)*time.Second)
+	}
+
+	log.Printf("Session %s was kicked from room %s by %s", session.PublicId(), room.Id(), kick.SessionId)
+	// The backend will be notified that the session left the room.
+	session.LeaveRoom(true)
+	// The session is kept, the client may resume it and join other rooms.
+	if client := session.GetClient(); client != nil {
+		client.SendMessage(&ServerMessage{
+			Type: "bye",
+			Bye: &ByeServerMessage{
+				Reason: "kicked",
+				Reconnect: &ByeServerMessageReconnect{
+					Resume: true,
+				},
+			},
+		})
+	}
+}
+
+func (h *Hub) banFromRoom(room *Room, userId string, roomSessionId string, duration time.Duration) {
+	if userId == "" && roomSessionId == "" {
+		return
+	}
+
+	ban := &NatsBanMessage{
+		RoomId:        getRoomIdForBackend(room.Id(), room.Backend()),
+		UserId:        userId,
+		RoomSessionId: roomSessionId,
+		Expires:       time.Now().Add(duration),
+	}
+	// Add locally to prevent rejoining before the NATS message was processed.
+	h.addRoomBan(ban)
+	if err := h.nats.PublishNats(roomBanSubject, &NatsMessage{
+		SendTime: time.Now(),
+		Type:     "ban",
+		Ban:      ban,
+	}); err != nil {
+		log.Printf("Error publishing ban for room %s: %s", room.Id(), err)
+	}
+}
+
+func (h *Hub) addRoomBan(ban *NatsBanMessage) {
+	key := getRoomBanKey(ban.RoomId, ban.UserId, ban.RoomSessionId)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if expires, found := h.roomBans[key]; !found || expires.Before(ban.Expires) {
+		h.roomBans[key] = ban.Expires
+	}
+}
+
+func (h *Hub) isBannedFromRoom(roomId string, backend *Backend, userId string, roomSessionId string, now time.Time) bool {
+	internalRoomId := getRoomIdForBackend(roomId, backend)
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if userId != "" {
+		if expires, found := h.roomBans[getRoomBanKey(internalRoomId, userId, "")]; found && now.Before(expires) {
+			return true
+		}
+	}
+	if roomSessionId != "" {
+		if expires, found := h.roomBans[getRoomBanKey(internalRoomId, "", roomSessionId)]; found && now.Before(expires) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Hub) checkExpiredRoomBans(now time.Time) {
+	for key, expires := range h.roomBans {
+		if !now.Before(expires) {
+			delete(h.roomBans, key)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2021 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// Default number of room messages that will be sent to joining sessions.
+	defaultRoomHistorySize = 10
+)
+
+func (r *Room) addHistoryLocked(message *ServerMessage) {
+	size := r.hub.roomHistorySize
+	if size <= 0 {
+		return
+	}
+
+	r.history = append(r.history, message)
+	if len(r.history) > size {
+		r.history = r.history[len(r.history)-size:]
+	}
+}
+
+func (r *Room) addHistory(message *ServerMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addHistoryLocked(message)
+}
+
+// GetHistory returns the recent room messages, oldest first.
+func (r *Room) GetHistory() []*ServerMessage {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.history) == 0 {
+		return nil
+	}
+
+	result := make([]*ServerMessage, len(r.history))
+	copy(result, r.history)
+	return result
+}
+
+func (r *Room) publishHistory(message *NatsRoomHistoryMessage) error {
+	msg := &NatsMessage{
+		SendTime: time.Now(),
+		Type:     "history",
+		History:  message,
+	}
+	return r.nats.PublishNats(GetSubjectForBackendRoomId(r.id, r.backend), msg)
+}
+
+// AddPersistentMessage adds a message that was sent to the room to the
+// history of the room on all servers.
+func (r *Room) AddPersistentMessage(message *ServerMessage) error {
+	if r.hub.roomHistorySize <= 0 {
+		return nil
+	}
+
+	return r.publishHistory(&NatsRoomHistoryMessage{
+		Type:    "add",
+		Message: message,
+	})
+}
+
+func (r *Room) publishHistorySnapshot() {
+	history := r.GetHistory()
+	if len(history) == 0 {
+		return
+	}
+
+	if err := r.publishHistory(&NatsRoomHistoryMessage{
+		Type:     "snapshot",
+		Messages: history,
+	}); err != nil {
+		log.Printf("Could not publish history snapshot for room %s: %s", r.Id(), err)
+	}
+}
+
+func (r *Room) processHistory(message *NatsRoomHistoryMessage) {
+	if message == nil {
+		return
+	}
+
+	switch message.Type {
+	case "add":
+		if message.Message != nil {
+			r.addHistory(message.Message)
+		}
+	case "snapshot":
+		r.mu.Lock()
+		if len(r.history) > 0 {
+			// Already received a snapshot or messages directly.
+			r.mu.Unlock()
+			return
+		}
+
+		for _, msg := range message.Messages {
+			r.addHistoryLocked(msg)
+		}
+		history := make([]*ServerMessage, len(r.history))
+		copy(history, r.history)
+		sessions := make([]*ClientSession, 0, len(r.sessions))
+		for _, s := range r.sessions {
+			if session, ok := s.(*ClientSession); ok && session.ClientType() != HelloClientTypeInternal {
+				sessions = append(sessions, session)
+			}
+		}
+		r.mu.Unlock()
+
+		// Sessions that joined before the snapshot was received didn't get
+		// any history yet.
+		for _, session := range sessions {
+			sendHistoryMessages(session, history)
+		}
+	default:
+		log.Printf("Unsupported history message with type %s in %s: %+v", message.Type, r.Id(), message)
+	}
+}
+
+func sendHistoryMessages(session *ClientSession, history []*ServerMessage) {
+	for _, msg := range history {
+		// Messages are shared between sessions, the sequence number is set
+		// when sending.
+		m := *msg
+		session.SendMessage(&m)
+	}
+}
+
+// SendHistory sends the recent room messages to a session that joined.
+func (r *Room) SendHistory(session *ClientSession) {
+	if session.ClientType() == HelloClientTypeInternal {
+		return
+	}
+
+	sendHistoryMessages(session, r.GetHistory())
+}
@@ -0,0 +1,199 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2021 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"log"
+	"time"
+)
+
+var (
+	RoomFull          = NewError("room_full", "The room is full.")
+	TooManyPublishers = NewError("too_many_publishers", "Too many sessions are publishing in the room.")
+)
+
+type roomServerCounts struct {
+	sessions   int
+	publishers int
+	updated    time.Time
+}
+
+// SetLimits updates the maximum number of sessions and publishers in the
+// room. A value of "0" disables the limit.
+func (r *Room) SetLimits(maxSessions int, maxPublishers int) {
+	r.mu.Lock()
+	hadLimits := r.maxSessions > 0 || r.maxPublishers > 0
+	r.maxSessions = maxSessions
+	r.maxPublishers = maxPublishers
+	hasLimits := r.maxSessions > 0 || r.maxPublishers > 0
+	r.mu.Unlock()
+
+	if hasLimits && !hadLimits {
+		// Counts are only exchanged while limits are configured, get the
+		// current values from the other servers.
+		r.requestCounts()
+	}
+}
+
+func (r *Room) hasLimits() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.maxSessions > 0 || r.maxPublishers > 0
+}
+
+func (r *Room) countLocalSessionsLocked() int {
+	count := 0
+	for _, session := range r.sessions {
+		// Internal and virtual sessions are not limited.
+		if session.ClientType() == HelloClientTypeClient {
+			count++
+		}
+	}
+	return count
+}
+
+func (r *Room) countRemoteLocked(now time.Time) (int, int) {
+	// Counts are refreshed regularly while limits are configured, ignore
+	// servers that stopped sending them.
+	expired := now.Add(-3 * updateActiveSessionsInterval)
+	sessions := 0
+	publishers := 0
+	for serverId, counts := range r.remoteCounts {
+		if counts.updated.Before(expired) {
+			delete(r.remoteCounts, serverId)
+			continue
+		}
+
+		sessions += counts.sessions
+		publishers += counts.publishers
+	}
+	return sessions, publishers
+}
+
+// checkSessionLimitLocked returns an error if the session may not join the
+// room because the maximum number of sessions is reached on all servers.
+// The room lock must be held.
+func (r *Room) checkSessionLimitLocked(session Session) error {
+	if session.ClientType() != HelloClientTypeClient || r.maxSessions <= 0 {
+		return nil
+	}
+
+	if _, found := r.sessions[session.PublicId()]; found {
+		return nil
+	}
+
+	remote, _ := r.countRemoteLocked(time.Now())
+	if r.countLocalSessionsLocked()+remote >= r.maxSessions {
+		return RoomFull
+	}
+	return nil
+}
+
+// AddPublisher registers a session that will start publishing media. Returns
+// an error if the maximum number of publishers is reached on all servers.
+func (r *Room) AddPublisher(session Session) error {
+	sid := session.PublicId()
+	r.mu.Lock()
+	if r.publishers[sid] {
+		r.mu.Unlock()
+		return nil
+	}
+
+	if r.maxPublishers > 0 {
+		_, remote := r.countRemoteLocked(time.Now())
+		if len(r.publishers)+remote >= r.maxPublishers {
+			r.mu.Unlock()
+			return TooManyPublishers
+		}
+	}
+
+	r.publishers[sid] = true
+	r.mu.Unlock()
+	r.publishCounts(false)
+	return nil
+}
+
+// RemovePublisher unregisters a session that no longer publishes media.
+func (r *Room) RemovePublisher(session Session) {
+	sid := session.PublicId()
+	r.mu.Lock()
+	if !r.publishers[sid] {
+		r.mu.Unlock()
+		return
+	}
+
+	delete(r.publishers, sid)
+	r.mu.Unlock()
+	r.publishCounts(false)
+}
+
+func (r *Room) publishCounts(sync bool) {
+	r.mu.RLock()
+	if r.maxSessions <= 0 && r.maxPublishers <= 0 {
+		// Counts are only needed to check the limits.
+		r.mu.RUnlock()
+		return
+	}
+
+	counts := &NatsRoomCountsMessage{
+		ServerId:   r.hub.serverId,
+		Sessions:   r.countLocalSessionsLocked(),
+		Publishers: len(r.publishers),
+		Sync:       sync,
+	}
+	r.mu.RUnlock()
+
+	msg := &NatsMessage{
+		SendTime: time.Now(),
+		Type:     "counts",
+		Counts:   counts,
+	}
+	if err := r.nats.PublishNats(GetSubjectForBackendRoomId(r.id, r.backend), msg); err != nil {
+		log.Printf("Could not publish counts for room %s: %s", r.Id(), err)
+	}
+}
+
+func (r *Room) requestCounts() {
+	r.publishCounts(true)
+}
+
+func (r *Room) processCounts(message *NatsRoomCountsMessage) {
+	if message == nil || message.ServerId == r.hub.serverId {
+		return
+	}
+
+	r.mu.Lock()
+	if message.Sessions == 0 && message.Publishers == 0 {
+		delete(r.remoteCounts, message.ServerId)
+	} else {
+		r.remoteCounts[message.ServerId] = &roomServerCounts{
+			sessions:   message.Sessions,
+			publishers: message.Publishers,
+			updated:    time.Now(),
+		}
+	}
+	r.mu.Unlock()
+
+	if message.Sync {
+		r.publishCounts(false)
+	}
+}
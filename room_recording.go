@@ -0,0 +1,153 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2021 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"log"
+	"time"
+)
+
+// IsRecording returns true if the publishers of the room are being recorded.
+func (r *Room) IsRecording() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.recording
+}
+
+// SetRecording starts or stops recording the publishers of all local sessions
+// in the room. Sessions that start publishing later will also be recorded.
+func (r *Room) SetRecording(recording bool) {
+	r.mu.Lock()
+	if r.recording == recording {
+		r.mu.Unlock()
+		return
+	}
+
+	r.recording = recording
+	sessions := make([]*ClientSession, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		if session, ok := s.(*ClientSession); ok {
+			sessions = append(sessions, session)
+		}
+	}
+	r.mu.Unlock()
+
+	if recording {
+		log.Printf("Start recording room %s", r.Id())
+	} else {
+		log.Printf("Stop recording room %s", r.Id())
+	}
+
+	for _, session := range sessions {
+		session.SetRecording(r, recording)
+	}
+
+	// Every server notifies its own sessions, the request to start / stop
+	// recording is received by all servers.
+	message := r.newRecordingMessage(recording)
+	for _, session := range sessions {
+		if session.ClientType() == HelloClientTypeInternal {
+			continue
+		}
+
+		m := *message
+		session.SendMessage(&m)
+	}
+}
+
+func (r *Room) newRecordingMessage(recording bool) *ServerMessage {
+	return &ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "room",
+			Type:   "recording",
+			Recording: &EventServerMessageRecording{
+				RoomId:    r.id,
+				Recording: recording,
+			},
+		},
+	}
+}
+
+// SendRecording notifies a session that joined if the room is being recorded.
+func (r *Room) SendRecording(session *ClientSession) {
+	if session.ClientType() == HelloClientTypeInternal || !r.IsRecording() {
+		return
+	}
+
+	session.SendMessage(r.newRecordingMessage(true))
+}
+
+func (r *Room) publishRecording(message *NatsRoomRecordingMessage) error {
+	return r.publishRecordingTo(GetSubjectForBackendRoomId(r.id, r.backend), message)
+}
+
+func (r *Room) publishRecordingTo(subject string, message *NatsRoomRecordingMessage) error {
+	msg := &NatsMessage{
+		SendTime:  time.Now(),
+		Type:      "recording",
+		Recording: message,
+	}
+	return r.nats.PublishNats(subject, msg)
+}
+
+func (r *Room) publishRecordingSnapshot() {
+	if !r.IsRecording() {
+		return
+	}
+
+	if err := r.publishRecording(&NatsRoomRecordingMessage{
+		Type:      "snapshot",
+		Recording: true,
+	}); err != nil {
+		log.Printf("Could not publish recording state for room %s: %s", r.Id(), err)
+	}
+}
+
+func (r *Room) processRecording(message *NatsRoomRecordingMessage) {
+	if message == nil {
+		return
+	}
+
+	switch message.Type {
+	case "start":
+		fallthrough
+	case "stop":
+		r.SetRecording(message.Type == "start")
+		if message.ReplyTo == "" {
+			return
+		}
+
+		if err := r.publishRecordingTo(message.ReplyTo, &NatsRoomRecordingMessage{
+			Type:      "ack",
+			Recording: message.Type == "start",
+		}); err != nil {
+			log.Printf("Could not confirm recording request for room %s: %s", r.Id(), err)
+		}
+	case "snapshot":
+		if message.Recording {
+			r.SetRecording(true)
+		}
+	default:
+		log.Printf("Unsupported recording message with type %s in %s: %+v", message.Type, r.Id(), message)
+	}
+}
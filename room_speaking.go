@@ -0,0 +1,129 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2021 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"log"
+	"time"
+)
+
+var (
+	// Time a session must be speaking before it is reported, short noises
+	// should not be reported.
+	speakingStartDebounceInterval = 200 * time.Millisecond
+	// Time to wait before notifying that a session stopped speaking, short
+	// pauses should not be reported.
+	speakingStopDebounceInterval = time.Second
+)
+
+// SetSessionSpeaking updates the speaking state of a session and notifies
+// the room if it changed and didn't change back within the debounce interval.
+func (r *Room) SetSessionSpeaking(session Session, speaking bool) {
+	sid := session.PublicId()
+	r.mu.Lock()
+	if _, found := r.sessions[sid]; !found {
+		r.mu.Unlock()
+		return
+	}
+
+	if r.speaking[sid] == speaking {
+		// The change was reverted before it was reported.
+		if timer, found := r.speakingTimers[sid]; found {
+			timer.Stop()
+			delete(r.speakingTimers, sid)
+		}
+		r.mu.Unlock()
+		return
+	}
+
+	if _, found := r.speakingTimers[sid]; found {
+		// The change will be reported once the interval expired.
+		r.mu.Unlock()
+		return
+	}
+
+	interval := speakingStopDebounceInterval
+	if speaking {
+		interval = speakingStartDebounceInterval
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(interval, func() {
+		r.mu.Lock()
+		if r.speakingTimers[sid] != timer {
+			// The change was reverted or the session left the room.
+			r.mu.Unlock()
+			return
+		}
+
+		delete(r.speakingTimers, sid)
+		if speaking {
+			r.speaking[sid] = true
+		} else {
+			delete(r.speaking, sid)
+		}
+		r.mu.Unlock()
+		r.publishSessionSpeaking(sid, speaking)
+	})
+	r.speakingTimers[sid] = timer
+	r.mu.Unlock()
+}
+
+// IsSessionSpeaking returns true if the session is currently speaking.
+func (r *Room) IsSessionSpeaking(session Session) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.speaking[session.PublicId()]
+}
+
+func (r *Room) removeSpeakingLocked(sid string) {
+	if timer, found := r.speakingTimers[sid]; found {
+		timer.Stop()
+		delete(r.speakingTimers, sid)
+	}
+	delete(r.speaking, sid)
+}
+
+func (r *Room) clearSpeakingLocked() {
+	for sid, timer := range r.speakingTimers {
+		timer.Stop()
+		delete(r.speakingTimers, sid)
+	}
+	r.speaking = make(map[string]bool)
+}
+
+func (r *Room) publishSessionSpeaking(sessionId string, speaking bool) {
+	message := &ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "participants",
+			Type:   "speaking",
+			Speaking: &RoomSpeakingServerMessage{
+				RoomId:    r.id,
+				SessionId: sessionId,
+				Speaking:  speaking,
+			},
+		},
+	}
+	if err := r.publish(message); err != nil {
+		log.Printf("Could not publish speaking message in room %s: %s", r.Id(), err)
+	}
+}
@@ -421,3 +421,133 @@ func TestRoom_RoomSessionData(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func checkMessageSpeaking(message *ServerMessage, sessionId string, speaking bool) error {
+	if err := checkMessageType(message, "event"); err != nil {
+		return err
+	} else if message.Event.Target != "participants" || message.Event.Type != "speaking" {
+		return fmt.Errorf("Expected speaking event, got %+v", message.Event)
+	} else if message.Event.Speaking == nil {
+		return fmt.Errorf("Expected speaking payload, got %+v", message.Event)
+	} else if message.Event.Speaking.SessionId != sessionId {
+		return fmt.Errorf("Expected session %s, got %+v", sessionId, message.Event.Speaking)
+	} else if message.Event.Speaking.Speaking != speaking {
+		return fmt.Errorf("Expected speaking %v, got %+v", speaking, message.Event.Speaking)
+	}
+	return nil
+}
+
+func TestRoom_Speaking(t *testing.T) {
+	startInterval := speakingStartDebounceInterval
+	stopInterval := speakingStopDebounceInterval
+	speakingStartDebounceInterval = 50 * time.Millisecond
+	speakingStopDebounceInterval = 100 * time.Millisecond
+	defer func() {
+		speakingStartDebounceInterval = startInterval
+		speakingStopDebounceInterval = stopInterval
+	}()
+
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client.RunUntilJoined(ctx, hello.Hello); err != nil {
+		t.Error(err)
+	}
+
+	session, ok := hub.GetSessionByPublicId(hello.Hello.SessionId).(*ClientSession)
+	if !ok {
+		t.Fatalf("Could not find session %s", hello.Hello.SessionId)
+	}
+	room := session.GetRoom()
+	if room == nil {
+		t.Fatalf("Room not found")
+	}
+
+	publisher := &TestMCUPublisher{
+		TestMCUClient: TestMCUClient{
+			id:         "publisher",
+			streamType: streamTypeVideo,
+		},
+	}
+	screen := &TestMCUPublisher{
+		TestMCUClient: TestMCUClient{
+			id:         "screen",
+			streamType: streamTypeScreen,
+		},
+	}
+
+	// Audio levels of screen publishers are ignored.
+	session.PublisherTalking(screen, true)
+	if room.IsSessionSpeaking(session) {
+		t.Error("Screen publisher should not be speaking")
+	}
+
+	// Short noises are not reported.
+	session.PublisherTalking(publisher, true)
+	session.PublisherTalking(publisher, false)
+
+	ctx1, cancel1 := context.WithTimeout(ctx, 2*speakingStartDebounceInterval)
+	defer cancel1()
+	if message, err := client.RunUntilMessage(ctx1); err == nil {
+		t.Errorf("Expected no message, got %+v", message)
+	} else if err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+	if room.IsSessionSpeaking(session) {
+		t.Error("Session should not be speaking")
+	}
+
+	session.PublisherTalking(publisher, true)
+	if message, err := client.RunUntilMessage(ctx); err != nil {
+		t.Error(err)
+	} else if err := checkMessageSpeaking(message, hello.Hello.SessionId, true); err != nil {
+		t.Error(err)
+	}
+
+	// Short pauses are not reported.
+	session.PublisherTalking(publisher, false)
+	session.PublisherTalking(publisher, true)
+
+	ctx2, cancel2 := context.WithTimeout(ctx, 2*speakingStopDebounceInterval)
+	defer cancel2()
+	if message, err := client.RunUntilMessage(ctx2); err == nil {
+		t.Errorf("Expected no message, got %+v", message)
+	} else if err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+	if !room.IsSessionSpeaking(session) {
+		t.Error("Session should be speaking")
+	}
+
+	// Closing the publisher also stops speaking.
+	session.PublisherClosed(publisher)
+	if message, err := client.RunUntilMessage(ctx); err != nil {
+		t.Error(err)
+	} else if err := checkMessageSpeaking(message, hello.Hello.SessionId, false); err != nil {
+		t.Error(err)
+	}
+	if room.IsSessionSpeaking(session) {
+		t.Error("Session should no longer be speaking")
+	}
+}
@@ -0,0 +1,279 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2021 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+var (
+	// Time to wait for other servers to send their sessions of a room.
+	rosterTimeout = 500 * time.Millisecond
+)
+
+func (r *Room) getSessionInCallFlagsLocked(session Session) int {
+	sessionId := session.PublicId()
+	for _, user := range r.users {
+		if sid, ok := user["sessionId"].(string); !ok || sid != sessionId {
+			continue
+		}
+
+		if flags, ok := getInCallFlags(user["inCall"]); ok {
+			return flags
+		}
+		break
+	}
+
+	if r.inCallSessions[session] {
+		return FlagInCall
+	}
+	return FlagDisconnected
+}
+
+// GetLocalRosterEntries returns the sessions of the room that are connected
+// to this server.
+func (r *Room) GetLocalRosterEntries() []*RosterSessionEntry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	result := make([]*RosterSessionEntry, 0, len(r.sessions))
+	for sid, session := range r.sessions {
+		entry := &RosterSessionEntry{
+			SessionId: sid,
+			User:      session.UserData(),
+		}
+
+		switch sess := session.(type) {
+		case *ClientSession:
+			// "UserId" would lock the room to check the room session data.
+			entry.UserId = sess.AuthUserId()
+			entry.RoomSessionId = sess.RoomSessionId()
+			if sess.ClientType() == HelloClientTypeInternal {
+				entry.Internal = true
+				entry.InCall = FlagInCall | FlagWithAudio
+			} else {
+				entry.InCall = r.getSessionInCallFlagsLocked(sess)
+			}
+		case *VirtualSession:
+			entry.UserId = sess.UserId()
+			entry.Virtual = true
+			entry.InCall = FlagInCall | FlagWithPhone
+			entry.Flags = sess.Flags()
+		default:
+			entry.UserId = session.UserId()
+			entry.InCall = r.getSessionInCallFlagsLocked(session)
+		}
+		if entry.UserId == "" {
+			if roomSessionData, found := r.roomSessionData[sid]; found {
+				entry.UserId = roomSessionData.UserId
+			}
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+func (r *Room) processRosterRequest(request *NatsRosterRequest) {
+	if request == nil || request.ReplyTo == "" {
+		return
+	}
+
+	if request.ServerId == r.hub.serverId {
+		// Our own request, the local sessions are added by the requester.
+		return
+	}
+
+	// Always respond so the requester doesn't have to wait for the timeout.
+	response := &NatsMessage{
+		SendTime: time.Now(),
+		Type:     "rosterresponse",
+		RosterResponse: &NatsRosterResponse{
+			ServerId: r.hub.serverId,
+			Sessions: r.GetLocalRosterEntries(),
+		},
+	}
+	if err := r.nats.PublishNats(request.ReplyTo, response); err != nil {
+		log.Printf("Could not send roster of room %s to %s: %s", r.Id(), request.ReplyTo, err)
+	}
+}
+
+// announceServer notifies the other servers with sessions in the room that
+// the room was created (or closed) on this server.
+func (r *Room) announceServer(active bool, sync bool) {
+	msg := &NatsMessage{
+		SendTime: time.Now(),
+		Type:     "roomserver",
+		RoomServer: &NatsRoomServerMessage{
+			ServerId: r.hub.serverId,
+			Active:   active,
+			Sync:     sync,
+		},
+	}
+	if err := r.nats.PublishNats(GetSubjectForBackendRoomId(r.id, r.backend), msg); err != nil {
+		log.Printf("Could not announce server for room %s: %s", r.Id(), err)
+	}
+}
+
+func (r *Room) processRoomServer(message *NatsRoomServerMessage) {
+	if message == nil || message.ServerId == r.hub.serverId {
+		return
+	}
+
+	r.mu.Lock()
+	if message.Active {
+		r.remoteServers[message.ServerId] = true
+	} else {
+		delete(r.remoteServers, message.ServerId)
+	}
+	r.mu.Unlock()
+
+	if message.Active && message.Sync {
+		// The room was created on the other server, send the current state.
+		r.announceServer(true, false)
+		r.publishTransientDataSnapshot()
+		r.publishHistorySnapshot()
+		r.publishRecordingSnapshot()
+	}
+}
+
+// GetRoster returns the sessions of the room on all servers.
+func (r *Room) GetRoster() ([]*RosterSessionEntry, error) {
+	r.mu.RLock()
+	pending := make(map[string]bool, len(r.remoteServers))
+	for serverId := range r.remoteServers {
+		pending[serverId] = true
+	}
+	r.mu.RUnlock()
+
+	sessions := make(map[string]*RosterSessionEntry)
+	for _, entry := range r.GetLocalRosterEntries() {
+		sessions[entry.SessionId] = entry
+	}
+	if len(pending) == 0 {
+		// No other server has sessions in the room.
+		return sortRosterEntries(sessions), nil
+	}
+
+	receiver := make(chan *nats.Msg, 64)
+	replyTo := "roster.reply." + newRandomString(32)
+	subscription, err := r.nats.Subscribe(replyTo, receiver)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := subscription.Unsubscribe(); err != nil {
+			log.Printf("Error closing roster subscription %s: %s", replyTo, err)
+		}
+	}()
+
+	request := &NatsMessage{
+		SendTime: time.Now(),
+		Type:     "roster",
+		Roster: &NatsRosterRequest{
+			ReplyTo:  replyTo,
+			ServerId: r.hub.serverId,
+		},
+	}
+	if err := r.nats.PublishNats(GetSubjectForBackendRoomId(r.id, r.backend), request); err != nil {
+		return nil, err
+	}
+
+	// Servers that closed the room without being noticed will not respond,
+	// so only wait until the timeout.
+	timer := time.NewTimer(rosterTimeout)
+	defer timer.Stop()
+loop:
+	for len(pending) > 0 {
+		select {
+		case message := <-receiver:
+			var msg NatsMessage
+			if err := r.nats.Decode(message, &msg); err != nil {
+				log.Printf("Could not decode roster response %+v: %s", message, err)
+				continue
+			} else if msg.Type != "rosterresponse" || msg.RosterResponse == nil {
+				log.Printf("Invalid roster response %+v", msg)
+				continue
+			}
+
+			delete(pending, msg.RosterResponse.ServerId)
+			for _, entry := range msg.RosterResponse.Sessions {
+				if _, found := sessions[entry.SessionId]; !found {
+					sessions[entry.SessionId] = entry
+				}
+			}
+		case <-timer.C:
+			break loop
+		}
+	}
+
+	return sortRosterEntries(sessions), nil
+}
+
+func sortRosterEntries(sessions map[string]*RosterSessionEntry) []*RosterSessionEntry {
+	result := make([]*RosterSessionEntry, 0, len(sessions))
+	for _, entry := range sessions {
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].SessionId < result[j].SessionId
+	})
+	return result
+}
+
+func (h *Hub) processRosterMsg(client *Client, message *ClientMessage) {
+	session := client.GetSession()
+	if session == nil {
+		// Client is not connected yet.
+		return
+	}
+
+	room := session.GetRoom()
+	if room == nil {
+		session.SendMessage(message.NewErrorServerMessage(NotInRoom))
+		return
+	}
+
+	// Waiting for other servers must not block processing further messages.
+	go h.sendRoster(session, message, room)
+}
+
+func (h *Hub) sendRoster(session *ClientSession, message *ClientMessage, room *Room) {
+	sessions, err := room.GetRoster()
+	if err != nil {
+		log.Printf("Could not get roster of room %s for %s: %s", room.Id(), session.PublicId(), err)
+		session.SendMessage(message.NewWrappedErrorServerMessage(err))
+		return
+	}
+
+	session.SendMessage(&ServerMessage{
+		Id:   message.Id,
+		Type: "roster",
+		Roster: &RosterServerMessage{
+			RoomId:   room.Id(),
+			Sessions: sessions,
+		},
+	})
+}
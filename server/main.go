@@ -22,6 +22,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
@@ -59,6 +60,7 @@ var (
 const (
 	defaultReadTimeout  = 15
 	defaultWriteTimeout = 15
+	defaultDrainTimeout = 60
 
 	initialMcuRetry = time.Second
 	maxMcuRetry     = time.Second * 16
@@ -101,6 +103,7 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt)
 	signal.Notify(sigChan, syscall.SIGHUP)
+	signal.Notify(sigChan, syscall.SIGTERM)
 
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
@@ -327,18 +330,49 @@ func main() {
 		}
 	}
 
+	drainTimeout, _ := config.GetInt("app", "draintimeout")
+	if drainTimeout <= 0 {
+		drainTimeout = defaultDrainTimeout
+	}
+	drainChan := hub.DrainChan()
+	drainedChan := make(chan bool)
+
 loop:
-	for sig := range sigChan {
-		switch sig {
-		case os.Interrupt:
-			log.Println("Interrupted")
+	for {
+		select {
+		case <-drainChan:
+			drainChan = nil
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Duration(drainTimeout)*time.Second)
+				defer cancel()
+
+				log.Printf("Waiting up to %d seconds for rooms to close", drainTimeout)
+				if err := hub.WaitUntilDrained(ctx); err == nil {
+					log.Println("All rooms closed")
+				}
+				close(drainedChan)
+			}()
+		case <-drainedChan:
+			log.Println("Draining finished")
 			break loop
-		case syscall.SIGHUP:
-			log.Printf("Received SIGHUP, reloading %s", *configFlag)
-			if config, err := goconf.ReadConfigFile(*configFlag); err != nil {
-				log.Printf("Could not read configuration from %s: %s", *configFlag, err)
-			} else {
-				hub.Reload(config)
+		case sig := <-sigChan:
+			switch sig {
+			case os.Interrupt:
+				log.Println("Interrupted")
+				break loop
+			case syscall.SIGTERM:
+				if !hub.Drain() {
+					log.Println("Received SIGTERM while draining, stopping")
+					break loop
+				}
+				log.Println("Received SIGTERM, draining")
+			case syscall.SIGHUP:
+				log.Printf("Received SIGHUP, reloading %s", *configFlag)
+				if config, err := goconf.ReadConfigFile(*configFlag); err != nil {
+					log.Printf("Could not read configuration from %s: %s", *configFlag, err)
+				} else {
+					hub.Reload(config)
+				}
 			}
 		}
 	}
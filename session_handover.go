@@ -0,0 +1,704 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2021 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// Subject where all servers receive requests to hand over sessions.
+	handoverSubject = "hub.handover"
+)
+
+var (
+	// Time to wait for a different server to hand over a session.
+	handoverTimeout = time.Second
+)
+
+type SessionHandoverRoomState struct {
+	RoomId        string           `json:"roomid"`
+	RoomSessionId string           `json:"roomsessionid,omitempty"`
+	Properties    *json.RawMessage `json:"properties,omitempty"`
+	SessionData   *json.RawMessage `json:"sessiondata,omitempty"`
+	InCall        bool             `json:"incall,omitempty"`
+}
+
+type SessionHandoverLobbyState struct {
+	// The original "room" request and backend response.
+	Message *ClientMessage         `json:"message"`
+	Room    *BackendClientResponse `json:"room"`
+}
+
+type VirtualSessionHandoverState struct {
+	PrivateId string         `json:"privateid"`
+	PublicId  string         `json:"publicid"`
+	Data      *SessionIdData `json:"data"`
+
+	SessionId string             `json:"sessionid"`
+	UserId    string             `json:"userid,omitempty"`
+	UserData  *json.RawMessage   `json:"userdata,omitempty"`
+	Flags     uint32             `json:"flags,omitempty"`
+	Options   *AddSessionOptions `json:"options,omitempty"`
+	InRoom    bool               `json:"inroom,omitempty"`
+}
+
+// SessionHandoverState contains everything needed to continue a client
+// session on a different server.
+type SessionHandoverState struct {
+	PrivateId string         `json:"privateid"`
+	PublicId  string         `json:"publicid"`
+	Data      *SessionIdData `json:"data"`
+
+	ClientType string           `json:"clienttype"`
+	Features   []string         `json:"features,omitempty"`
+	UserId     string           `json:"userid,omitempty"`
+	UserData   *json.RawMessage `json:"userdata,omitempty"`
+	BackendUrl string           `json:"backendurl"`
+
+	SupportsPermissions bool         `json:"supportspermissions,omitempty"`
+	Permissions         []Permission `json:"permissions,omitempty"`
+
+	Room  *SessionHandoverRoomState  `json:"room,omitempty"`
+	Lobby *SessionHandoverLobbyState `json:"lobby,omitempty"`
+
+	PendingMessages  []*ServerMessage `json:"pendingmessages,omitempty"`
+	SupportsSequence bool             `json:"supportssequence,omitempty"`
+	LastSeq          uint64           `json:"lastseq,omitempty"`
+	ReplayMessages   []*ServerMessage `json:"replaymessages,omitempty"`
+
+	VirtualSessions []*VirtualSessionHandoverState `json:"virtualsessions,omitempty"`
+
+	// Stream types of the publishers and ids of the subscribers that are kept
+	// on the previous servers until they are replaced.
+	McuPublishers  []string `json:"mcupublishers,omitempty"`
+	McuSubscribers []string `json:"mcusubscribers,omitempty"`
+}
+
+// handoverMcuObjects are the publishers and subscribers of a session that was
+// handed over to a different server. They are kept so media continues to flow
+// until the session replaced them on the other server or was closed there.
+type handoverMcuObjects struct {
+	publishers  map[string]McuPublisher
+	subscribers map[string]McuSubscriber
+}
+
+// getInitialSessionId returns a random start value for the session ids so
+// sessions created on different servers don't share the same ids.
+func getInitialSessionId() uint64 {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return uint64(binary.BigEndian.Uint32(b[:])) << 32
+}
+
+// handover detaches the session from this server and returns its state.
+// Room members will not be notified, the session will continue to be
+// available on the server that requested the handover.
+func (s *ClientSession) handover() (*SessionHandoverState, []*VirtualSession) {
+	s.mu.Lock()
+	state := &SessionHandoverState{
+		PrivateId: s.privateId,
+		PublicId:  s.publicId,
+		Data:      s.data,
+
+		ClientType: s.clientType,
+		Features:   s.features,
+		UserId:     s.userId,
+		UserData:   s.userData,
+		BackendUrl: s.backendUrl,
+
+		SupportsPermissions: s.supportsPermissions,
+
+		PendingMessages:  s.pendingClientMessages,
+		SupportsSequence: s.supportsSequence,
+		LastSeq:          s.lastSeq,
+		ReplayMessages:   s.replayMessages,
+	}
+	for permission, value := range s.permissions {
+		if value {
+			state.Permissions = append(state.Permissions, permission)
+		}
+	}
+	s.pendingClientMessages = nil
+	s.replayMessages = nil
+
+	room := s.GetRoom()
+	if room != nil {
+		roomState := &SessionHandoverRoomState{
+			RoomId:        room.Id(),
+			RoomSessionId: s.roomSessionId,
+			Properties:    room.Properties(),
+			InCall:        room.IsSessionInCall(s),
+		}
+		if data := room.GetRoomSessionData(s); data != nil {
+			if encoded, err := json.Marshal(data); err == nil {
+				roomState.SessionData = (*json.RawMessage)(&encoded)
+			}
+		}
+		state.Room = roomState
+
+		// The session will continue in the room on the other server, so
+		// don't notify the backend or other room members.
+		s.doUnsubscribeRoomNats(false)
+		s.SetRoom(nil)
+	}
+
+	virtualSessions := make([]*VirtualSession, 0, len(s.virtualSessions))
+	for session := range s.virtualSessions {
+		virtualSessions = append(virtualSessions, session)
+	}
+	s.virtualSessions = nil
+	s.mu.Unlock()
+
+	// The room calls back into the session, so it must not be locked while
+	// removing it.
+	if room != nil {
+		room.removeSession(s, false, false)
+	}
+
+	for _, session := range virtualSessions {
+		virtualState := &VirtualSessionHandoverState{
+			PrivateId: session.PrivateId(),
+			PublicId:  session.PublicId(),
+			Data:      session.Data(),
+
+			SessionId: session.SessionId(),
+			UserId:    session.UserId(),
+			UserData:  session.UserData(),
+			Flags:     session.Flags(),
+			Options:   session.Options(),
+		}
+		if room := session.GetRoom(); room != nil {
+			virtualState.InRoom = true
+			session.SetRoom(nil)
+			room.removeSession(session, false, false)
+		}
+		state.VirtualSessions = append(state.VirtualSessions, virtualState)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.userSubscription != nil {
+		if err := s.userSubscription.Unsubscribe(); err != nil {
+			log.Printf("Error closing user subscription in session %s: %s", s.PublicId(), err)
+		}
+		s.userSubscription = nil
+	}
+	if s.sessionSubscription != nil {
+		if err := s.sessionSubscription.Unsubscribe(); err != nil {
+			log.Printf("Error closing session subscription in session %s: %s", s.PublicId(), err)
+		}
+		s.sessionSubscription = nil
+	}
+	// The session continues on the other server, so the publishers are not
+	// reported as stopped. They are kept until the session replaced them.
+	for streamType := range s.publishers {
+		state.McuPublishers = append(state.McuPublishers, streamType)
+	}
+	for streamType := range s.handoverPublishers {
+		state.McuPublishers = append(state.McuPublishers, streamType)
+	}
+	for id := range s.subscribers {
+		state.McuSubscribers = append(state.McuSubscribers, id)
+	}
+	for id := range s.handoverSubscribers {
+		state.McuSubscribers = append(state.McuSubscribers, id)
+	}
+	s.hub.keepHandoverMcuObjects(s.PublicId(), s.publishers, s.subscribers)
+	s.publishers = nil
+	s.subscribers = nil
+	s.handoverPublishers = nil
+	s.handoverSubscribers = nil
+	if client := s.client; client != nil {
+		s.clearClientLocked(client)
+		go client.SendByeResponseWithReason(nil, "session_resumed")
+	}
+	s.backend.RemoveSession(s)
+	if atomic.CompareAndSwapInt32(&s.running, 1, 0) {
+		s.stopRun <- true
+		s.mu.Unlock()
+		// Wait for Session goroutine to stop
+		<-s.runStopped
+		s.mu.Lock()
+	}
+	return state, virtualSessions
+}
+
+func newClientSessionFromHandover(hub *Hub, backend *Backend, state *SessionHandoverState) (*ClientSession, error) {
+	u, err := url.Parse(state.BackendUrl)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(u.Host, ":") && hasStandardPort(u) {
+		u.Host = u.Hostname()
+	}
+
+	s := &ClientSession{
+		hub:       hub,
+		privateId: state.PrivateId,
+		publicId:  state.PublicId,
+		data:      state.Data,
+
+		clientType: state.ClientType,
+		features:   state.Features,
+		userId:     state.UserId,
+		userData:   state.UserData,
+
+		backend:          backend,
+		backendUrl:       state.BackendUrl,
+		parsedBackendUrl: u,
+
+		natsReceiver: make(chan *nats.Msg, 64),
+		stopRun:      make(chan bool, 1),
+		runStopped:   make(chan bool, 1),
+
+		supportsSequence: state.SupportsSequence,
+		lastSeq:          state.LastSeq,
+		replayMessages:   state.ReplayMessages,
+	}
+	if state.SupportsPermissions {
+		s.SetPermissions(state.Permissions)
+	}
+	for _, streamType := range state.McuPublishers {
+		if s.handoverPublishers == nil {
+			s.handoverPublishers = make(map[string]bool)
+		}
+		s.handoverPublishers[streamType] = true
+	}
+	for _, id := range state.McuSubscribers {
+		if s.handoverSubscribers == nil {
+			s.handoverSubscribers = make(map[string]bool)
+		}
+		s.handoverSubscribers[id] = true
+	}
+	for _, message := range state.PendingMessages {
+		s.storePendingMessage(message)
+	}
+
+	if err := s.SubscribeNats(hub.nats); err != nil {
+		return nil, err
+	}
+	atomic.StoreInt32(&s.running, 1)
+	go s.run()
+	return s, nil
+}
+
+func (h *Hub) sendHandoverResponse(request *NatsHandoverRequest, state *SessionHandoverState) error {
+	response := &NatsMessage{
+		SendTime: time.Now(),
+		Type:     "handoverresponse",
+		HandoverResponse: &NatsHandoverResponse{
+			ServerId: h.serverId,
+			Session:  state,
+		},
+	}
+	return h.nats.PublishNats(request.ReplyTo, response)
+}
+
+func (h *Hub) processHandoverRequest(request *NatsHandoverRequest) {
+	// Always respond so the requester doesn't have to wait for the timeout if
+	// no server owns the session.
+	data := h.decodeSessionId(request.PrivateId, privateSessionName)
+	if data == nil {
+		if err := h.sendHandoverResponse(request, nil); err != nil {
+			log.Printf("Could not send handover response to %s: %s", request.ReplyTo, err)
+		}
+		return
+	}
+
+	h.mu.Lock()
+	session, ok := h.sessions[data.Sid].(*ClientSession)
+	if !ok || session.PrivateId() != request.PrivateId {
+		// Session is not connected to this server.
+		h.mu.Unlock()
+		if err := h.sendHandoverResponse(request, nil); err != nil {
+			log.Printf("Could not send handover response to %s: %s", request.ReplyTo, err)
+		}
+		return
+	}
+
+	// Remove from the hub so the session can't be resumed locally any longer.
+	delete(h.sessions, data.Sid)
+	delete(h.clients, data.Sid)
+	delete(h.expiredSessions, session)
+	lobby := h.removeLobbySessionLocked(session)
+	h.mu.Unlock()
+	h.invalidateSessionId(session.PrivateId(), privateSessionName)
+	h.invalidateSessionId(session.PublicId(), publicSessionName)
+	statsHubSessionsCurrent.WithLabelValues(session.Backend().Id(), session.ClientType()).Dec()
+
+	state, virtualSessions := session.handover()
+	if lobby != nil {
+		// The session continues to wait in the lobby on the other server.
+		state.Lobby = &SessionHandoverLobbyState{
+			Message: lobby.message,
+			Room:    lobby.room,
+		}
+	}
+	h.mu.Lock()
+	for _, virtualSession := range virtualSessions {
+		if data := virtualSession.Data(); data != nil {
+			delete(h.sessions, data.Sid)
+		}
+		delete(h.virtualSessions, GetVirtualSessionId(session, virtualSession.SessionId()))
+		statsHubSessionsCurrent.WithLabelValues(session.Backend().Id(), virtualSession.ClientType()).Dec()
+	}
+	h.mu.Unlock()
+
+	if err := h.sendHandoverResponse(request, state); err != nil {
+		log.Printf("Could not send handover response for session %s: %s", session.PublicId(), err)
+		return
+	}
+
+	log.Printf("Handed over session %s (private=%s) to other server", session.PublicId(), session.PrivateId())
+}
+
+// requestHandover asks the other servers to hand over the session with the
+// given private id. Returns "nil" if no server owns the session.
+func (h *Hub) requestHandover(privateId string) (*SessionHandoverState, error) {
+	pending := h.getRemoteServers()
+	if len(pending) == 0 {
+		// No other servers in the cluster.
+		return nil, nil
+	}
+
+	receiver := make(chan *nats.Msg, 64)
+	replyTo := handoverSubject + ".reply." + newRandomString(32)
+	subscription, err := h.nats.Subscribe(replyTo, receiver)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := subscription.Unsubscribe(); err != nil {
+			log.Printf("Error closing handover subscription %s: %s", replyTo, err)
+		}
+	}()
+
+	request := &NatsMessage{
+		SendTime: time.Now(),
+		Type:     "handover",
+		Handover: &NatsHandoverRequest{
+			PrivateId: privateId,
+			ReplyTo:   replyTo,
+			ServerId:  h.serverId,
+		},
+	}
+	if err := h.nats.PublishNats(handoverSubject, request); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(handoverTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case message := <-receiver:
+			var msg NatsMessage
+			if err := h.nats.Decode(message, &msg); err != nil {
+				return nil, err
+			} else if msg.Type != "handoverresponse" || msg.HandoverResponse == nil {
+				return nil, fmt.Errorf("invalid handover response %+v", msg)
+			}
+
+			if msg.HandoverResponse.Session != nil {
+				return msg.HandoverResponse.Session, nil
+			}
+
+			// Stop waiting once all servers responded they don't own the session.
+			delete(pending, msg.HandoverResponse.ServerId)
+			if len(pending) == 0 {
+				return nil, nil
+			}
+		case <-timer.C:
+			return nil, nil
+		}
+	}
+}
+
+func (h *Hub) keepHandoverMcuObjects(publicId string, publishers map[string]McuPublisher, subscribers map[string]McuSubscriber) {
+	if len(publishers) == 0 && len(subscribers) == 0 {
+		return
+	}
+
+	h.handoverMcuLock.Lock()
+	defer h.handoverMcuLock.Unlock()
+
+	objects, found := h.handoverMcu[publicId]
+	if !found {
+		objects = &handoverMcuObjects{
+			publishers:  make(map[string]McuPublisher),
+			subscribers: make(map[string]McuSubscriber),
+		}
+		h.handoverMcu[publicId] = objects
+	}
+	for streamType, publisher := range publishers {
+		objects.publishers[streamType] = publisher
+	}
+	for id, subscriber := range subscribers {
+		objects.subscribers[id] = subscriber
+	}
+}
+
+func (h *Hub) processHandoverRelease(message *NatsHandoverReleaseMessage) {
+	var publishers []McuPublisher
+	var subscribers []McuSubscriber
+	h.handoverMcuLock.Lock()
+	objects, found := h.handoverMcu[message.PublicId]
+	if !found {
+		h.handoverMcuLock.Unlock()
+		return
+	}
+
+	if len(message.Publishers) == 0 && len(message.Subscribers) == 0 {
+		for _, publisher := range objects.publishers {
+			publishers = append(publishers, publisher)
+		}
+		for _, subscriber := range objects.subscribers {
+			subscribers = append(subscribers, subscriber)
+		}
+		delete(h.handoverMcu, message.PublicId)
+	} else {
+		for _, streamType := range message.Publishers {
+			if publisher, found := objects.publishers[streamType]; found {
+				publishers = append(publishers, publisher)
+				delete(objects.publishers, streamType)
+			}
+		}
+		for _, id := range message.Subscribers {
+			if subscriber, found := objects.subscribers[id]; found {
+				subscribers = append(subscribers, subscriber)
+				delete(objects.subscribers, id)
+			}
+		}
+		if len(objects.publishers) == 0 && len(objects.subscribers) == 0 {
+			delete(h.handoverMcu, message.PublicId)
+		}
+	}
+	h.handoverMcuLock.Unlock()
+
+	if len(publishers) == 0 && len(subscribers) == 0 {
+		return
+	}
+
+	log.Printf("Releasing %d publishers and %d subscribers of handed over session %s", len(publishers), len(subscribers), message.PublicId)
+	go func() {
+		ctx := context.TODO()
+		for _, publisher := range publishers {
+			publisher.Close(ctx)
+		}
+		for _, subscriber := range subscribers {
+			subscriber.Close(ctx)
+		}
+	}()
+}
+
+// releaseHandoverMcuObjectsLocked notifies the previous servers of a handed over
+// session that the given publishers and subscribers have been replaced.
+// Everything is released if both are empty. The session must be locked.
+func (s *ClientSession) releaseHandoverMcuObjectsLocked(publishers []string, subscribers []string) {
+	msg := &NatsMessage{
+		SendTime: time.Now(),
+		Type:     "handoverrelease",
+		HandoverRelease: &NatsHandoverReleaseMessage{
+			PublicId:    s.PublicId(),
+			Publishers:  publishers,
+			Subscribers: subscribers,
+			ServerId:    s.hub.serverId,
+		},
+	}
+	if err := s.hub.nats.PublishNats(handoverSubject, msg); err != nil {
+		log.Printf("Could not release MCU objects of handed over session %s: %s", s.PublicId(), err)
+	}
+}
+
+// processRemoteResume tries to resume a session that is owned by a
+// different server.
+func (h *Hub) processRemoteResume(client *Client, message *ClientMessage, data *SessionIdData) {
+	state, err := h.requestHandover(message.Hello.ResumeId)
+	if err != nil {
+		log.Printf("Could not request handover of session %s: %s", message.Hello.ResumeId, err)
+	}
+	if state == nil {
+		statsHubSessionResumeFailed.Inc()
+		client.SendMessage(message.NewErrorServerMessage(NoSuchSession))
+		return
+	}
+
+	var backend *Backend
+	if u, err := url.Parse(state.BackendUrl); err == nil {
+		backend = h.backend.GetBackend(u)
+	}
+	if backend == nil || backend.Id() != data.BackendId {
+		log.Printf("Backend %s of handed over session %s is not configured", data.BackendId, state.PublicId)
+		statsHubSessionResumeFailed.Inc()
+		client.SendMessage(message.NewErrorServerMessage(NoSuchSession))
+		return
+	}
+
+	session, err := newClientSessionFromHandover(h, backend, state)
+	if err != nil {
+		log.Printf("Could not create handed over session %s: %s", state.PublicId, err)
+		statsHubSessionResumeFailed.Inc()
+		client.SendMessage(message.NewWrappedErrorServerMessage(err))
+		return
+	}
+
+	if err := backend.AddSession(session); err != nil {
+		log.Printf("Error adding handed over session %s to backend %s: %s", session.PublicId(), backend.Id(), err)
+		if roomState := state.Room; roomState != nil {
+			// The session didn't leave its room on the other server, restore
+			// it so closing notifies the backend and the other room members.
+			if _, roomErr := h.restoreHandoverRoom(session, roomState); roomErr != nil {
+				log.Printf("Could not restore room %s of rejected session %s: %s", roomState.RoomId, session.PublicId(), roomErr)
+			}
+		}
+		session.Close()
+		statsHubSessionResumeFailed.Inc()
+		client.SendMessage(message.NewWrappedErrorServerMessage(err))
+		return
+	}
+
+	h.mu.Lock()
+	if _, found := h.sessions[data.Sid]; found {
+		h.mu.Unlock()
+		log.Printf("Handed over session %s conflicts with local session", session.PublicId())
+		session.Close()
+		statsHubSessionResumeFailed.Inc()
+		client.SendMessage(message.NewErrorServerMessage(NoSuchSession))
+		return
+	}
+
+	h.sessions[data.Sid] = session
+	delete(h.expectHelloClients, client)
+	if client.IsConnected() {
+		session.SetClient(client)
+		h.clients[data.Sid] = client
+	} else {
+		// Client disconnected while waiting for the handover.
+		session.StartExpire()
+	}
+	h.mu.Unlock()
+	statsHubSessionsCurrent.WithLabelValues(backend.Id(), session.ClientType()).Inc()
+	statsHubSessionsResumedTotal.WithLabelValues(backend.Id(), session.ClientType()).Inc()
+
+	log.Printf("Resume session from %s in %s (%s) %s (private=%s) from other server", client.RemoteAddr(), client.Country(), client.UserAgent(), session.PublicId(), session.PrivateId())
+
+	h.sendHelloResponse(session, message)
+
+	var room *Room
+	if roomState := state.Room; roomState != nil {
+		if room, err = h.restoreHandoverRoom(session, roomState); err != nil {
+			log.Printf("Could not restore room %s of session %s: %s", roomState.RoomId, session.PublicId(), err)
+			session.SendMessage(message.NewWrappedErrorServerMessage(err))
+			// The client (implicitly) left the room due to an error.
+			h.sendRoom(session, nil, nil)
+		}
+	}
+
+	for _, virtualState := range state.VirtualSessions {
+		h.restoreHandoverVirtualSession(session, room, virtualState)
+	}
+
+	if state.Lobby != nil {
+		h.restoreLobbySession(session, state.Lobby)
+	}
+
+	session.NotifySessionResumed(client, message.Hello.LastSeq)
+}
+
+func (h *Hub) restoreHandoverRoom(session *ClientSession, state *SessionHandoverRoomState) (*Room, error) {
+	if err := session.SubscribeRoomNats(h.nats, state.RoomId, state.RoomSessionId); err != nil {
+		return nil, err
+	}
+
+	internalRoomId := getRoomIdForBackend(state.RoomId, session.Backend())
+	h.ru.Lock()
+	room, found := h.rooms[internalRoomId]
+	if !found {
+		var err error
+		if room, err = h.createRoom(state.RoomId, state.Properties, session.Backend()); err != nil {
+			h.ru.Unlock()
+			session.UnsubscribeRoomNats()
+			return nil, err
+		}
+	}
+	h.ru.Unlock()
+
+	session.SetRoom(room)
+	// The session didn't leave the room, so don't notify other members.
+	room.addSession(session, state.SessionData, false)
+	if state.InCall {
+		room.setSessionInCall(session)
+	}
+	return room, nil
+}
+
+func (h *Hub) restoreHandoverVirtualSession(session *ClientSession, room *Room, state *VirtualSessionHandoverState) {
+	if state.Data == nil {
+		return
+	}
+
+	virtualSession := &VirtualSession{
+		hub:       h,
+		session:   session,
+		privateId: state.PrivateId,
+		publicId:  state.PublicId,
+		data:      state.Data,
+
+		sessionId: state.SessionId,
+		userId:    state.UserId,
+		userData:  state.UserData,
+		flags:     state.Flags,
+		options:   state.Options,
+	}
+	virtualSessionId := GetVirtualSessionId(session, state.SessionId)
+
+	h.mu.Lock()
+	if _, found := h.sessions[state.Data.Sid]; found {
+		h.mu.Unlock()
+		log.Printf("Handed over virtual session %s conflicts with local session", state.PublicId)
+		return
+	}
+	h.sessions[state.Data.Sid] = virtualSession
+	h.virtualSessions[virtualSessionId] = state.Data.Sid
+	h.mu.Unlock()
+	statsHubSessionsCurrent.WithLabelValues(session.Backend().Id(), virtualSession.ClientType()).Inc()
+
+	session.AddVirtualSession(virtualSession)
+	if state.InRoom && room != nil {
+		virtualSession.SetRoom(room)
+		room.addSession(virtualSession, nil, false)
+	}
+}
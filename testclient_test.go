@@ -22,6 +22,7 @@
 package signaling
 
 import (
+	"bytes"
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
@@ -30,7 +31,9 @@ import (
 	"fmt"
 	"net"
 	"net/http/httptest"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -112,6 +115,14 @@ func checkMessageType(message *ServerMessage, expectedType string) error {
 		if message.Event == nil {
 			return fmt.Errorf("Expected \"%s\" message, got %+v (%s)", expectedType, message, toJsonString(message))
 		}
+	case "transient":
+		if message.TransientData == nil {
+			return fmt.Errorf("Expected \"%s\" message, got %+v (%s)", expectedType, message, toJsonString(message))
+		}
+	case "roster":
+		if message.Roster == nil {
+			return fmt.Errorf("Expected \"%s\" message, got %+v (%s)", expectedType, message, toJsonString(message))
+		}
 	}
 
 	return nil
@@ -180,6 +191,9 @@ type TestClient struct {
 	messageChan   chan []byte
 	readErrorChan chan error
 
+	// Number of received binary (i.e. MessagePack) messages.
+	binaryMessages uint32
+
 	publicId string
 }
 
@@ -190,35 +204,58 @@ func NewTestClient(t *testing.T, server *httptest.Server, hub *Hub) *TestClient
 		t.Fatal(err)
 	}
 
-	messageChan := make(chan []byte)
-	readErrorChan := make(chan error, 1)
+	client := &TestClient{
+		t:      t,
+		hub:    hub,
+		server: server,
+
+		conn:      conn,
+		localAddr: conn.LocalAddr(),
+
+		messageChan:   make(chan []byte),
+		readErrorChan: make(chan error, 1),
+	}
 
 	go func() {
 		for {
 			messageType, data, err := conn.ReadMessage()
 			if err != nil {
-				readErrorChan <- err
+				client.readErrorChan <- err
 				return
-			} else if messageType != websocket.TextMessage {
-				t.Errorf("Expect text message, got %d", messageType)
+			}
+
+			switch messageType {
+			case websocket.TextMessage:
+			case websocket.BinaryMessage:
+				atomic.AddUint32(&client.binaryMessages, 1)
+				var value interface{}
+				if err := decodeMessagePack(data, &value); err != nil {
+					t.Errorf("Could not decode MessagePack: %s", err)
+					return
+				}
+				if data, err = json.Marshal(value); err != nil {
+					t.Errorf("Could not convert MessagePack to JSON: %s", err)
+					return
+				}
+			default:
+				t.Errorf("Expect text or binary message, got %d", messageType)
 				return
 			}
 
-			messageChan <- data
+			client.messageChan <- data
 		}
 	}()
 
-	return &TestClient{
-		t:      t,
-		hub:    hub,
-		server: server,
-
-		conn:      conn,
-		localAddr: conn.LocalAddr(),
+	return client
+}
 
-		messageChan:   messageChan,
-		readErrorChan: readErrorChan,
+func (c *TestClient) WriteMessagePack(data interface{}) error {
+	var encoded bytes.Buffer
+	if err := encodeMessagePack(&encoded, data); err != nil {
+		return err
 	}
+
+	return c.conn.WriteMessage(websocket.BinaryMessage, encoded.Bytes())
 }
 
 func (c *TestClient) CloseWithBye() {
@@ -326,18 +363,63 @@ func (c *TestClient) SendHello(userid string) error {
 	return c.SendHelloParams(c.server.URL, "", params)
 }
 
+func (c *TestClient) SendHelloWithFeatures(userid string, features []string) error {
+	params := TestBackendClientAuthParams{
+		UserId: userid,
+	}
+	return c.SendHelloParamsWithFeatures(c.server.URL, "", features, params)
+}
+
+func (c *TestClient) SendHelloV2(token string) error {
+	params := HelloV2AuthParams{
+		Token: token,
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	hello := &ClientMessage{
+		Id:   "1234",
+		Type: "hello",
+		Hello: &HelloClientMessage{
+			Version: HelloVersionV2,
+			Auth: HelloClientMessageAuth{
+				Url:    c.server.URL,
+				Params: (*json.RawMessage)(&data),
+			},
+		},
+	}
+	return c.WriteJSON(hello)
+}
+
 func (c *TestClient) SendHelloResume(resumeId string) error {
+	return c.SendHelloResumeWithSequence(resumeId, 0)
+}
+
+func (c *TestClient) SendHelloResumeWithSequence(resumeId string, lastSeq uint64) error {
 	hello := &ClientMessage{
 		Id:   "1234",
 		Type: "hello",
 		Hello: &HelloClientMessage{
 			Version:  HelloVersion,
 			ResumeId: resumeId,
+			LastSeq:  lastSeq,
 		},
 	}
 	return c.WriteJSON(hello)
 }
 
+func (c *TestClient) SendAck(seq uint64) error {
+	message := &ClientMessage{
+		Type: "ack",
+		Ack: &AckClientMessage{
+			Seq: seq,
+		},
+	}
+	return c.WriteJSON(message)
+}
+
 func (c *TestClient) SendHelloClient(userid string) error {
 	params := TestBackendClientAuthParams{
 		UserId: userid,
@@ -361,6 +443,10 @@ func (c *TestClient) SendHelloInternal() error {
 }
 
 func (c *TestClient) SendHelloParams(url string, clientType string, params interface{}) error {
+	return c.SendHelloParamsWithFeatures(url, clientType, nil, params)
+}
+
+func (c *TestClient) SendHelloParamsWithFeatures(url string, clientType string, features []string, params interface{}) error {
 	data, err := json.Marshal(params)
 	if err != nil {
 		c.t.Fatal(err)
@@ -370,7 +456,8 @@ func (c *TestClient) SendHelloParams(url string, clientType string, params inter
 		Id:   "1234",
 		Type: "hello",
 		Hello: &HelloClientMessage{
-			Version: HelloVersion,
+			Version:  HelloVersion,
+			Features: features,
 			Auth: HelloClientMessageAuth{
 				Type:   clientType,
 				Url:    url,
@@ -407,6 +494,50 @@ func (c *TestClient) SendMessage(recipient MessageClientMessageRecipient, data i
 	return c.WriteJSON(message)
 }
 
+func (c *TestClient) SendControlAction(recipient MessageClientMessageRecipient, action *ControlClientMessageAction) error {
+	message := &ClientMessage{
+		Id:   "abcd",
+		Type: "control",
+		Control: &ControlClientMessage{
+			MessageClientMessage: MessageClientMessage{
+				Recipient: recipient,
+			},
+			Action: action,
+		},
+	}
+	return c.WriteJSON(message)
+}
+
+func (c *TestClient) SetTransientData(key string, value interface{}) error {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	message := &ClientMessage{
+		Id:   "efgh",
+		Type: "transient",
+		TransientData: &TransientDataClientMessage{
+			Type:  "set",
+			Key:   key,
+			Value: (*json.RawMessage)(&payload),
+		},
+	}
+	return c.WriteJSON(message)
+}
+
+func (c *TestClient) RemoveTransientData(key string) error {
+	message := &ClientMessage{
+		Id:   "ijkl",
+		Type: "transient",
+		TransientData: &TransientDataClientMessage{
+			Type: "remove",
+			Key:  key,
+		},
+	}
+	return c.WriteJSON(message)
+}
+
 func (c *TestClient) DrainMessages(ctx context.Context) error {
 	select {
 	case err := <-c.readErrorChan:
@@ -695,6 +826,23 @@ func (c *TestClient) RunUntilRoomMessage(ctx context.Context) (*RoomEventMessage
 	}
 }
 
+// RunUntilRoomMessageIgnoringJoin waits for a room message and skips any
+// "join" events received before.
+func (c *TestClient) RunUntilRoomMessageIgnoringJoin(ctx context.Context) (*RoomEventMessage, error) {
+	for {
+		message, err := c.RunUntilMessage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if message.Type == "event" && message.Event != nil && message.Event.Target == "room" && message.Event.Type == "join" {
+			continue
+		}
+
+		return checkMessageRoomMessage(message)
+	}
+}
+
 func checkMessageError(message *ServerMessage, msgid string) error {
 	if err := checkMessageType(message, "error"); err != nil {
 		return err
@@ -705,6 +853,48 @@ func checkMessageError(message *ServerMessage, msgid string) error {
 	return nil
 }
 
+func checkMessageTransientSet(message *ServerMessage, key string, value interface{}, oldValue interface{}) error {
+	if err := checkMessageType(message, "transient"); err != nil {
+		return err
+	} else if message.TransientData.Type != "set" {
+		return fmt.Errorf("Expected transient set, got %+v", message.TransientData)
+	} else if message.TransientData.Key != key {
+		return fmt.Errorf("Expected transient set key %s, got %+v", key, message.TransientData)
+	} else if !reflect.DeepEqual(message.TransientData.Value, value) {
+		return fmt.Errorf("Expected transient set value %+v, got %+v", value, message.TransientData.Value)
+	} else if !reflect.DeepEqual(message.TransientData.OldValue, oldValue) {
+		return fmt.Errorf("Expected transient set old value %+v, got %+v", oldValue, message.TransientData.OldValue)
+	}
+
+	return nil
+}
+
+func checkMessageTransientRemove(message *ServerMessage, key string, oldValue interface{}) error {
+	if err := checkMessageType(message, "transient"); err != nil {
+		return err
+	} else if message.TransientData.Type != "remove" {
+		return fmt.Errorf("Expected transient remove, got %+v", message.TransientData)
+	} else if message.TransientData.Key != key {
+		return fmt.Errorf("Expected transient remove key %s, got %+v", key, message.TransientData)
+	} else if !reflect.DeepEqual(message.TransientData.OldValue, oldValue) {
+		return fmt.Errorf("Expected transient remove old value %+v, got %+v", oldValue, message.TransientData.OldValue)
+	}
+
+	return nil
+}
+
+func checkMessageTransientInitial(message *ServerMessage, data map[string]interface{}) error {
+	if err := checkMessageType(message, "transient"); err != nil {
+		return err
+	} else if message.TransientData.Type != "initial" {
+		return fmt.Errorf("Expected transient initial, got %+v", message.TransientData)
+	} else if !reflect.DeepEqual(message.TransientData.Data, data) {
+		return fmt.Errorf("Expected transient initial data %+v, got %+v", data, message.TransientData.Data)
+	}
+
+	return nil
+}
+
 func (c *TestClient) RunUntilAnswer(ctx context.Context, answer string) error {
 	message, err := c.RunUntilMessage(ctx)
 	if err != nil {
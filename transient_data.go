@@ -0,0 +1,303 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2021 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	// Time to remember removed entries to ignore stale snapshots.
+	transientDataRemovedTimeout = time.Minute
+)
+
+type TransientListener interface {
+	SendMessage(message *ServerMessage) bool
+}
+
+// TransientData stores key/value entries that only live in memory and are
+// forwarded to all registered listeners when they change.
+type TransientData struct {
+	mu   sync.Mutex
+	data map[string]interface{}
+	// Versions of the entries in "data" and of recently removed entries.
+	versions  map[string]int64
+	removed   map[string]*transientRemovedEntry
+	listeners map[TransientListener]bool
+	// Lamport clock, always ahead of the versions seen so far, so local
+	// changes are more recent than all changes received from other servers.
+	clock int64
+}
+
+type transientRemovedEntry struct {
+	version int64
+	expires time.Time
+}
+
+// NewTransientData creates a new transient data container.
+func NewTransientData() *TransientData {
+	return &TransientData{}
+}
+
+func (t *TransientData) getListenersLocked() []TransientListener {
+	if len(t.listeners) == 0 {
+		return nil
+	}
+
+	result := make([]TransientListener, 0, len(t.listeners))
+	for listener := range t.listeners {
+		result = append(result, listener)
+	}
+	return result
+}
+
+func notifyTransientListeners(listeners []TransientListener, message *ServerMessage) {
+	for _, listener := range listeners {
+		listener.SendMessage(message)
+	}
+}
+
+func (t *TransientData) notifySet(listeners []TransientListener, key string, prev, value interface{}) {
+	msg := &ServerMessage{
+		Type: "transient",
+		TransientData: &TransientDataServerMessage{
+			Type:     "set",
+			Key:      key,
+			OldValue: prev,
+			Value:    value,
+		},
+	}
+	notifyTransientListeners(listeners, msg)
+}
+
+func (t *TransientData) notifyDeleted(listeners []TransientListener, key string, prev interface{}) {
+	msg := &ServerMessage{
+		Type: "transient",
+		TransientData: &TransientDataServerMessage{
+			Type:     "remove",
+			Key:      key,
+			OldValue: prev,
+		},
+	}
+	notifyTransientListeners(listeners, msg)
+}
+
+// AddListener registers a new listener and sends the current data to it.
+func (t *TransientData) AddListener(listener TransientListener) {
+	t.mu.Lock()
+	if t.listeners == nil {
+		t.listeners = make(map[TransientListener]bool)
+	}
+	t.listeners[listener] = true
+	data := t.getDataLocked()
+	t.mu.Unlock()
+
+	if len(data) == 0 {
+		return
+	}
+
+	msg := &ServerMessage{
+		Type: "transient",
+		TransientData: &TransientDataServerMessage{
+			Type: "initial",
+			Data: data,
+		},
+	}
+	listener.SendMessage(msg)
+}
+
+// RemoveListener unregisters a listener.
+func (t *TransientData) RemoveListener(listener TransientListener) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.listeners, listener)
+}
+
+// Set sets the value for the given key and notifies listeners if the value
+// changed. Passing a "nil" value will remove the key.
+func (t *TransientData) Set(key string, value interface{}) bool {
+	return t.SetVersion(key, value, t.NextVersion())
+}
+
+// NextVersion returns a version that is more recent than all versions that
+// have been used so far.
+func (t *TransientData) NextVersion() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.clock++
+	return t.clock
+}
+
+func (t *TransientData) updateClockLocked(version int64) {
+	if version > t.clock {
+		t.clock = version
+	}
+}
+
+// isStaleLocked returns true if the key was changed or removed with a more
+// recent version than the given one.
+func (t *TransientData) isStaleLocked(key string, version int64) bool {
+	if current, found := t.versions[key]; found && current > version {
+		return true
+	}
+	if removed, found := t.removed[key]; found && removed.version > version {
+		return true
+	}
+	return false
+}
+
+// SetVersion sets the value for the given key if the key was not changed or
+// removed with a more recent version and notifies listeners if the value
+// changed. Passing a "nil" value will remove the key.
+func (t *TransientData) SetVersion(key string, value interface{}, version int64) bool {
+	if value == nil {
+		return t.RemoveVersion(key, version)
+	}
+
+	t.mu.Lock()
+	t.updateClockLocked(version)
+	if t.isStaleLocked(key, version) {
+		t.mu.Unlock()
+		return false
+	}
+
+	prev, found := t.data[key]
+	if found && reflect.DeepEqual(prev, value) {
+		t.versions[key] = version
+		t.mu.Unlock()
+		return false
+	}
+
+	if t.data == nil {
+		t.data = make(map[string]interface{})
+		t.versions = make(map[string]int64)
+	}
+	t.data[key] = value
+	t.versions[key] = version
+	delete(t.removed, key)
+	listeners := t.getListenersLocked()
+	t.mu.Unlock()
+
+	t.notifySet(listeners, key, prev, value)
+	return true
+}
+
+// Merge updates the data with entries received from a different server. Only
+// entries that are more recent than the local state are taken over, so stale
+// entries can't restore keys that have been removed in the meantime.
+func (t *TransientData) Merge(data map[string]interface{}, versions map[string]int64) {
+	for key, value := range data {
+		if value == nil {
+			continue
+		}
+
+		t.SetVersion(key, value, versions[key])
+	}
+}
+
+// Remove deletes the value with the given key and notifies listeners if the
+// key was set.
+func (t *TransientData) Remove(key string) bool {
+	return t.RemoveVersion(key, t.NextVersion())
+}
+
+// RemoveVersion deletes the value with the given key if it was not changed
+// with a more recent version and notifies listeners if the key was set.
+func (t *TransientData) RemoveVersion(key string, version int64) bool {
+	t.mu.Lock()
+	t.updateClockLocked(version)
+	if t.isStaleLocked(key, version) {
+		t.mu.Unlock()
+		return false
+	}
+
+	if t.removed == nil {
+		t.removed = make(map[string]*transientRemovedEntry)
+	}
+	// Remember the removal so older entries in snapshots are ignored.
+	now := time.Now()
+	for k, entry := range t.removed {
+		if entry.expires.Before(now) {
+			delete(t.removed, k)
+		}
+	}
+	t.removed[key] = &transientRemovedEntry{
+		version: version,
+		expires: now.Add(transientDataRemovedTimeout),
+	}
+
+	prev, found := t.data[key]
+	if !found {
+		t.mu.Unlock()
+		return false
+	}
+
+	delete(t.data, key)
+	delete(t.versions, key)
+	listeners := t.getListenersLocked()
+	t.mu.Unlock()
+
+	t.notifyDeleted(listeners, key, prev)
+	return true
+}
+
+func (t *TransientData) getDataLocked() map[string]interface{} {
+	if len(t.data) == 0 {
+		return nil
+	}
+
+	result := make(map[string]interface{}, len(t.data))
+	for k, v := range t.data {
+		result[k] = v
+	}
+	return result
+}
+
+// GetData returns a copy of the current data.
+func (t *TransientData) GetData() map[string]interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.getDataLocked()
+}
+
+// GetDataVersions returns a copy of the current data and the versions of
+// the entries.
+func (t *TransientData) GetDataVersions() (map[string]interface{}, map[string]int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	data := t.getDataLocked()
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	versions := make(map[string]int64, len(t.versions))
+	for k, v := range t.versions {
+		versions[k] = v
+	}
+	return data, versions
+}
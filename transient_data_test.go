@@ -0,0 +1,415 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2021 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testTransientListener struct {
+	mu       sync.Mutex
+	messages []*ServerMessage
+}
+
+func (l *testTransientListener) SendMessage(message *ServerMessage) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, message)
+	return true
+}
+
+func (l *testTransientListener) getMessages() []*ServerMessage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result := l.messages
+	l.messages = nil
+	return result
+}
+
+func TestTransientData(t *testing.T) {
+	data := NewTransientData()
+	if data.Set("foo", nil) {
+		t.Errorf("should not have set value")
+	}
+	if !data.Set("foo", "bar") {
+		t.Errorf("should have set value")
+	}
+	if data.Set("foo", "bar") {
+		t.Errorf("should not have set value")
+	}
+	if !data.Set("foo", "baz") {
+		t.Errorf("should have set value")
+	}
+	if data.SetVersion("foo", "lala", 0) {
+		t.Errorf("should not have set outdated value")
+	}
+
+	listener := &testTransientListener{}
+	data.AddListener(listener)
+	if msgs := listener.getMessages(); len(msgs) != 1 {
+		t.Errorf("Expected one message, got %+v", msgs)
+	} else if err := checkMessageTransientInitial(msgs[0], map[string]interface{}{
+		"foo": "baz",
+	}); err != nil {
+		t.Error(err)
+	}
+
+	if !data.SetVersion("bar", "lala", 0) {
+		t.Errorf("should have set value")
+	}
+	if !data.Remove("foo") {
+		t.Errorf("should have removed value")
+	}
+	if data.Remove("foo") {
+		t.Errorf("should not have removed value")
+	}
+	if msgs := listener.getMessages(); len(msgs) != 2 {
+		t.Errorf("Expected two messages, got %+v", msgs)
+	} else {
+		if err := checkMessageTransientSet(msgs[0], "bar", "lala", nil); err != nil {
+			t.Error(err)
+		}
+		if err := checkMessageTransientRemove(msgs[1], "foo", "baz"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	data.RemoveListener(listener)
+	if !data.Set("bar", nil) {
+		t.Errorf("should have removed value")
+	}
+	if msgs := listener.getMessages(); len(msgs) != 0 {
+		t.Errorf("Expected no messages, got %+v", msgs)
+	}
+	if d := data.GetData(); len(d) != 0 {
+		t.Errorf("Expected no data, got %+v", d)
+	}
+}
+
+func TestTransientDataMerge(t *testing.T) {
+	now := time.Now().UnixNano()
+	data := NewTransientData()
+	data.SetVersion("foo", "bar", now+10)
+	data.SetVersion("bar", "baz", now+10)
+	data.RemoveVersion("bar", now+20)
+
+	listener := &testTransientListener{}
+	data.AddListener(listener)
+	listener.getMessages()
+
+	// Entries of a stale snapshot don't overwrite newer values and don't
+	// restore removed keys.
+	data.Merge(map[string]interface{}{
+		"foo": "old",
+		"bar": "old",
+		"baz": "new",
+	}, map[string]int64{
+		"foo": now + 5,
+		"bar": now + 15,
+		"baz": now + 15,
+	})
+	if msgs := listener.getMessages(); len(msgs) != 1 {
+		t.Errorf("Expected one message, got %+v", msgs)
+	} else if err := checkMessageTransientSet(msgs[0], "baz", "new", nil); err != nil {
+		t.Error(err)
+	}
+
+	data.Merge(map[string]interface{}{
+		"foo": "new",
+		"bar": "new",
+	}, map[string]int64{
+		"foo": now + 15,
+		"bar": now + 25,
+	})
+	if d := data.GetData(); !reflect.DeepEqual(d, map[string]interface{}{
+		"foo": "new",
+		"bar": "new",
+		"baz": "new",
+	}) {
+		t.Errorf("Unexpected data %+v", d)
+	}
+}
+
+func TestTransientDataVersions(t *testing.T) {
+	data := NewTransientData()
+	// Versions received from other servers advance the local clock.
+	if !data.SetVersion("foo", "bar", 100) {
+		t.Errorf("should have set value")
+	}
+	if version := data.NextVersion(); version <= 100 {
+		t.Errorf("Expected version after 100, got %d", version)
+	}
+	if !data.Set("foo", "baz") {
+		t.Errorf("should have set value")
+	}
+	if data.SetVersion("foo", "old", 100) {
+		t.Errorf("should not have set outdated value")
+	}
+
+	// Local changes are more recent than removals on other servers.
+	data.RemoveVersion("bar", 200)
+	if !data.Set("bar", "baz") {
+		t.Errorf("should have set value")
+	}
+}
+
+func TestClientTransientData(t *testing.T) {
+	hub, _, _, server, shutdown := CreateHubForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sessions must join a room before they can update transient data.
+	if err := client1.SetTransientData("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(msg, "not_in_room"); err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	if err := client1.SetTransientData("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageTransientSet(msg, "foo", "bar", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// The late joiner receives the current data.
+	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageTransientInitial(msg, map[string]interface{}{
+		"foo": "bar",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client1.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+	if err := client2.RunUntilJoined(ctx, hello1.Hello, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+
+	// Client 2 doesn't have the necessary permissions.
+	session2 := hub.GetSessionByPublicId(hello2.Hello.SessionId).(*ClientSession)
+	session2.SetPermissions([]Permission{})
+	if err := client2.RemoveTransientData("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(msg, "not_allowed"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client1.RemoveTransientData("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageTransientRemove(msg, "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageTransientRemove(msg, "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sessions that may publish media are allowed to update the data.
+	session2.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_MEDIA})
+	if err := client2.SetTransientData("bar", "baz"); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageTransientSet(msg, "bar", "baz", nil); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageTransientSet(msg, "bar", "baz", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientTransientDataCluster(t *testing.T) {
+	hub1, hub2, server1, server2, shutdown := CreateClusteredHubsForTest(t)
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server1, hub1)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	if err := client1.SetTransientData("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageTransientSet(msg, "foo", "bar", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The room is created on the second hub and will request the data from
+	// the first hub.
+	client2 := NewTestClient(t, server2, hub2)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	if err := client1.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+
+	// The second client will receive its "joined" event and the data of the
+	// first hub in undefined order. The data is either received as initial
+	// data (if the snapshot was processed before joining) or as update.
+	var joined *ServerMessage
+	var transient *ServerMessage
+	for joined == nil || transient == nil {
+		msg, err := client2.RunUntilMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.Type == "transient" {
+			if transient != nil {
+				t.Fatalf("Received multiple transient messages: %+v / %+v", transient, msg)
+			}
+			transient = msg
+		} else {
+			joined = msg
+		}
+	}
+	if err := checkMessageTransientInitial(transient, map[string]interface{}{
+		"foo": "bar",
+	}); err != nil {
+		if err := checkMessageTransientSet(transient, "foo", "bar", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client2.checkMessageJoined(joined, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+
+	if err := client2.SetTransientData("foo", "baz"); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageTransientSet(msg, "foo", "baz", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageTransientSet(msg, "foo", "baz", "bar"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel2()
+
+	if msg, err := client1.RunUntilMessage(ctx2); err != nil {
+		if err != context.DeadlineExceeded {
+			t.Fatal(err)
+		}
+	} else {
+		t.Errorf("Expected no payload, got %+v", msg)
+	}
+}
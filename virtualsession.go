@@ -123,7 +123,7 @@ func (s *VirtualSession) LeaveRoom(notify bool) *Room {
 	}
 
 	s.SetRoom(nil)
-	room.RemoveSession(s)
+	room.RemoveSession(s, notify)
 	return room
 }
 
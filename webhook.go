@@ -0,0 +1,257 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2021 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum number of events to send in one webhook request.
+	maxWebhookBatchSize = 100
+
+	// Maximum number of events to keep per backend while the webhook is
+	// not reachable, older events will be dropped.
+	maxWebhookQueueSize = 10000
+
+	// Number of retries before a batch of events is dropped.
+	maxWebhookRetries = 5
+
+	// Maximum delay between retries.
+	maxWebhookRetryDelay = 30 * time.Second
+
+	webhookRequestTimeout = 10 * time.Second
+)
+
+var (
+	// Events are collected for this interval before they are sent.
+	webhookBatchInterval = time.Second
+
+	// Delay before the first retry, will be doubled for every further retry.
+	webhookRetryDelay = time.Second
+)
+
+type webhookQueue struct {
+	backendId string
+	url       *url.URL
+	secret    []byte
+
+	events  []*BackendClientEvent
+	sending bool
+}
+
+// WebhookSender sends event notifications to the webhooks configured for
+// the backends.
+type WebhookSender struct {
+	client *BackendClient
+
+	ctx       context.Context
+	closeFunc context.CancelFunc
+
+	mu     sync.Mutex
+	queues map[string]*webhookQueue
+}
+
+func NewWebhookSender(client *BackendClient) *WebhookSender {
+	ctx, closeFunc := context.WithCancel(context.Background())
+	return &WebhookSender{
+		client: client,
+
+		ctx:       ctx,
+		closeFunc: closeFunc,
+
+		queues: make(map[string]*webhookQueue),
+	}
+}
+
+func (w *WebhookSender) Close() {
+	w.closeFunc()
+}
+
+func newWebhookEvent(eventType string, roomId string, session Session) *BackendClientEvent {
+	event := &BackendClientEvent{
+		Type:      eventType,
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		RoomId:    roomId,
+	}
+	if session != nil {
+		event.SessionId = session.PublicId()
+		if s, ok := session.(*ClientSession); ok {
+			// Must not use "UserId()" as the session might be locked.
+			event.UserId = s.AuthUserId()
+			if room := s.GetRoom(); room != nil && roomId == "" {
+				event.RoomId = room.Id()
+			}
+		} else {
+			event.UserId = session.UserId()
+		}
+	}
+	return event
+}
+
+// Send queues an event for the webhook of the given backend. The event is
+// ignored if no webhook is configured.
+func (w *WebhookSender) Send(backend *Backend, event *BackendClientEvent) {
+	if backend == nil {
+		return
+	}
+
+	u := backend.WebhookUrl()
+	if u == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	q, found := w.queues[backend.Id()]
+	if !found {
+		q = &webhookQueue{
+			backendId: backend.Id(),
+		}
+		w.queues[backend.Id()] = q
+	}
+	// The backend configuration could have been reloaded.
+	q.url = u
+	q.secret = backend.Secret()
+	if len(q.events) >= maxWebhookQueueSize {
+		log.Printf("Too many pending events for webhook of backend %s, dropping %+v", q.backendId, q.events[0])
+		q.events = q.events[1:]
+	}
+	q.events = append(q.events, event)
+	if !q.sending {
+		q.sending = true
+		go w.run(q)
+	}
+}
+
+func (w *WebhookSender) run(q *webhookQueue) {
+	select {
+	case <-time.After(webhookBatchInterval):
+	case <-w.ctx.Done():
+		return
+	}
+
+	for {
+		w.mu.Lock()
+		if len(q.events) == 0 {
+			q.sending = false
+			w.mu.Unlock()
+			return
+		}
+
+		count := len(q.events)
+		if count > maxWebhookBatchSize {
+			count = maxWebhookBatchSize
+		}
+		events := make([]*BackendClientEvent, count)
+		copy(events, q.events)
+		q.events = q.events[count:]
+		u := q.url
+		secret := q.secret
+		w.mu.Unlock()
+
+		if !w.sendEvents(u, secret, events) {
+			select {
+			case <-w.ctx.Done():
+				return
+			default:
+			}
+		}
+	}
+}
+
+func (w *WebhookSender) sendEvents(u *url.URL, secret []byte, events []*BackendClientEvent) bool {
+	request := NewBackendClientEventsRequest(events)
+	delay := webhookRetryDelay
+	for retry := 0; ; retry++ {
+		ctx, cancel := context.WithTimeout(w.ctx, webhookRequestTimeout)
+		err := w.performRequest(ctx, u, secret, request)
+		cancel()
+		if err == nil {
+			return true
+		}
+
+		if retry >= maxWebhookRetries {
+			log.Printf("Could not send %d events to webhook %s, dropping: %s", len(events), u, err)
+			return false
+		}
+
+		log.Printf("Could not send %d events to webhook %s, retrying in %s: %s", len(events), u, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-w.ctx.Done():
+			return false
+		}
+
+		delay *= 2
+		if delay > maxWebhookRetryDelay {
+			delay = maxWebhookRetryDelay
+		}
+	}
+}
+
+func (w *WebhookSender) performRequest(ctx context.Context, u *url.URL, secret []byte, request interface{}) error {
+	pool, err := w.client.getPool(u)
+	if err != nil {
+		return err
+	}
+
+	c, err := pool.Get(ctx)
+	if err != nil {
+		return err
+	}
+	defer pool.Put(c)
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "nextcloud-spreed-signaling/"+w.client.version)
+
+	// Add checksum so the backend can validate the request.
+	AddBackendChecksum(req, data, secret)
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,458 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2021 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dlintw/goconf"
+	"github.com/gorilla/mux"
+)
+
+func setWebhookIntervalsForTest() func() {
+	batchInterval := webhookBatchInterval
+	retryDelay := webhookRetryDelay
+	webhookBatchInterval = 10 * time.Millisecond
+	webhookRetryDelay = 10 * time.Millisecond
+	return func() {
+		webhookBatchInterval = batchInterval
+		webhookRetryDelay = retryDelay
+	}
+}
+
+func getTestConfigWithWebhook(server *httptest.Server) (*goconf.ConfigFile, error) {
+	config, err := getTestConfig(server)
+	if err != nil {
+		return nil, err
+	}
+
+	config.AddOption("backend", "webhook", server.URL+"/webhook")
+	return config, nil
+}
+
+// registerWebhookHandler returns a channel that receives the events sent to
+// the webhook. The first "failures" requests will be rejected.
+func registerWebhookHandler(t *testing.T, router *mux.Router, failures int32) (chan *BackendClientEvent, *int32) {
+	events := make(chan *BackendClientEvent, 64)
+	var requests int32
+	router.HandleFunc("/webhook", func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if count := atomic.AddInt32(&requests, 1); count <= failures {
+			http.Error(w, "Temporary failure", http.StatusServiceUnavailable)
+			return
+		}
+
+		if !ValidateBackendChecksum(r, body, testBackendSecret) {
+			t.Errorf("invalid checksum for webhook request %s", string(body))
+			http.Error(w, "Authentication check failed", http.StatusForbidden)
+			return
+		}
+
+		var request BackendClientRequest
+		if err := json.Unmarshal(body, &request); err != nil {
+			t.Error(err)
+			http.Error(w, "Could not read body", http.StatusBadRequest)
+			return
+		} else if request.Type != "events" || request.Events == nil {
+			t.Errorf("expected events request, got %s", string(body))
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		for _, event := range request.Events.Events {
+			events <- event
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return events, &requests
+}
+
+func checkWebhookEvent(ctx context.Context, events chan *BackendClientEvent, eventType string, roomId string, sessionId string) error {
+	select {
+	case event := <-events:
+		if event.Type != eventType {
+			return fmt.Errorf("expected event %s, got %+v", eventType, event)
+		} else if event.RoomId != roomId {
+			return fmt.Errorf("expected room %s, got %+v", roomId, event)
+		} else if event.SessionId != sessionId {
+			return fmt.Errorf("expected session %s, got %+v", sessionId, event)
+		} else if event.Timestamp == 0 {
+			return fmt.Errorf("expected timestamp, got %+v", event)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("expected event %s, got %s", eventType, ctx.Err())
+	}
+}
+
+func performInCallRequest(t *testing.T, server *httptest.Server, roomId string, sessionId string, inCall int) {
+	user := map[string]interface{}{
+		"sessionId": roomId + "-" + sessionId,
+		"inCall":    inCall,
+	}
+	msg := &BackendServerRoomRequest{
+		Type: "incall",
+		InCall: &BackendRoomInCallRequest{
+			InCall:  json.RawMessage(fmt.Sprintf("%d", inCall)),
+			Changed: []map[string]interface{}{user},
+			Users:   []map[string]interface{}{user},
+		},
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := performBackendRequest(server.URL+"/api/v1/room/"+roomId, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("Expected successful request, got %s: %s", res.Status, string(body))
+	}
+}
+
+func TestWebhook_Events(t *testing.T) {
+	defer setWebhookIntervalsForTest()()
+	hub, _, router, server, shutdown := CreateHubForTestWithConfig(t, getTestConfigWithWebhook)
+	defer shutdown()
+
+	events, _ := registerWebhookHandler(t, router, 0)
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionId := hello.Hello.SessionId
+
+	roomId := "test-room"
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client.RunUntilJoined(ctx, hello.Hello); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkWebhookEvent(ctx, events, BackendEventSessionJoined, roomId, sessionId); err != nil {
+		t.Fatal(err)
+	}
+
+	session := hub.GetSessionByPublicId(sessionId).(*ClientSession)
+	session.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_AUDIO, PERMISSION_MAY_PUBLISH_VIDEO})
+	if err := client.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: sessionId,
+	}, MessageClientMessageData{
+		Type:     "offer",
+		Sid:      "12345",
+		RoomType: "video",
+		Payload: map[string]interface{}{
+			"sdp": MockSdpOfferAudioAndVideo,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.RunUntilAnswer(ctx, MockSdpAnswerAudioAndVideo); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkWebhookEvent(ctx, events, BackendEventPublisherStarted, roomId, sessionId); err != nil {
+		t.Fatal(err)
+	}
+
+	performInCallRequest(t, server, roomId, sessionId, FlagInCall|FlagWithAudio|FlagWithVideo)
+	if msg, err := client.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(msg, "event"); err != nil {
+		t.Fatal(err)
+	} else if msg.Event.Target != "participants" {
+		t.Fatalf("Expected participants update, got %+v", msg.Event)
+	}
+	if err := checkWebhookEvent(ctx, events, BackendEventCallStarted, roomId, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Leaving the call will also close the publisher.
+	performInCallRequest(t, server, roomId, sessionId, 0)
+	if msg, err := client.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(msg, "event"); err != nil {
+		t.Fatal(err)
+	} else if msg.Event.Target != "participants" {
+		t.Fatalf("Expected participants update, got %+v", msg.Event)
+	}
+	if err := checkWebhookEvent(ctx, events, BackendEventCallEnded, roomId, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkWebhookEvent(ctx, events, BackendEventPublisherStopped, roomId, sessionId); err != nil {
+		t.Fatal(err)
+	}
+
+	if room, err := client.JoinRoom(ctx, ""); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != "" {
+		t.Fatalf("Expected empty room, got %s", room.Room.RoomId)
+	}
+
+	if err := checkWebhookEvent(ctx, events, BackendEventSessionLeft, roomId, sessionId); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhook_Retry(t *testing.T) {
+	defer setWebhookIntervalsForTest()()
+	hub, _, router, server, shutdown := CreateHubForTestWithConfig(t, getTestConfigWithWebhook)
+	defer shutdown()
+
+	events, requests := registerWebhookHandler(t, router, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	if err := checkWebhookEvent(ctx, events, BackendEventSessionJoined, roomId, hello.Hello.SessionId); err != nil {
+		t.Fatal(err)
+	}
+	if count := atomic.LoadInt32(requests); count != 3 {
+		t.Errorf("Expected 3 requests, got %d", count)
+	}
+}
+
+func TestWebhook_CallEventsClustered(t *testing.T) {
+	defer setWebhookIntervalsForTest()()
+
+	router := mux.NewRouter()
+	webhookServer := httptest.NewServer(router)
+	defer webhookServer.Close()
+	events, _ := registerWebhookHandler(t, router, 0)
+
+	hub1, hub2, server1, server2, shutdown := CreateClusteredHubsForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("backend", "webhook", webhookServer.URL+"/webhook")
+		return config, nil
+	})
+	defer shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server1, hub1)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server2, hub2)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Fatal(err)
+	}
+
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Fatal(err)
+	}
+	if err := client2.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both servers receive the update, but only one of them sends the event.
+	performInCallRequest(t, server1, roomId, hello1.Hello.SessionId, FlagInCall|FlagWithAudio)
+	for _, client := range []*TestClient{client1, client2} {
+		if msg, err := client.RunUntilMessage(ctx); err != nil {
+			t.Fatal(err)
+		} else if err := checkMessageType(msg, "event"); err != nil {
+			t.Fatal(err)
+		} else if msg.Event.Target != "participants" {
+			t.Fatalf("Expected participants update, got %+v", msg.Event)
+		}
+	}
+
+	ctx2, cancel2 := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel2()
+
+	var callStarted int
+loop:
+	for {
+		select {
+		case event := <-events:
+			if event.Type == BackendEventCallStarted {
+				callStarted++
+			}
+		case <-ctx2.Done():
+			break loop
+		}
+	}
+	if callStarted != 1 {
+		t.Errorf("Expected one %s event, got %d", BackendEventCallStarted, callStarted)
+	}
+}
+
+func TestWebhook_NoLeftEventWithoutNotify(t *testing.T) {
+	defer setWebhookIntervalsForTest()()
+	hub, _, router, server, shutdown := CreateHubForTestWithConfig(t, getTestConfigWithWebhook)
+	defer shutdown()
+
+	events, _ := registerWebhookHandler(t, router, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	roomSessionId := "the-room-session"
+	if room, err := client1.JoinRoomWithRoomSession(ctx, roomId, roomSessionId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkWebhookEvent(ctx, events, BackendEventSessionJoined, roomId, hello1.Hello.SessionId); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first session leaves the room without notifying the backend when
+	// the same room session connects again.
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if room, err := client2.JoinRoomWithRoomSession(ctx, roomId, roomSessionId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(msg, "bye"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkWebhookEvent(ctx, events, BackendEventSessionJoined, roomId, hello2.Hello.SessionId); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx2, cancel2 := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel2()
+	select {
+	case event := <-events:
+		t.Errorf("Expected no event, got %+v", event)
+	case <-ctx2.Done():
+	}
+}